@@ -0,0 +1,389 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupPaths are the parts of the data directory a backup holds.
+var backupPaths = []string{dbDir, registryDir, sqlDBFile, htmlDir, miscDir, assetsDir, batteryProfiles, batteryModelsFile, configFile}
+
+const backupManifestName = "manifest.json"
+const backupFormat = 1
+
+// backupManifest lists the files of a backup archive with their checksums.
+// It is the last entry of the archive.
+type backupManifest struct {
+	Format  int          `json:"format"`  // archive layout version
+	Created string       `json:"created"` // when the backup was taken
+	Station string       `json:"station"` // station the backup was taken on
+	Files   []backupFile `json:"files"`
+}
+
+type backupFile struct {
+	Path     string `json:"path"`     // slash separated, e.g. "data/db/RRC2040-2#3427/20211204T222338Z.json"
+	Size     int64  `json:"size"`     // bytes
+	SHA256   string `json:"sha256"`   // hex checksum of the content
+	Modified string `json:"modified"` // modification time of the file
+}
+
+// archiveName is the path of a file in the archive.
+func archiveName(file string) string {
+	return filepath.ToSlash(filepath.Clean(file))
+}
+
+// backupFiles lists the files under the backup paths, below root.
+func backupFiles(root string) ([]string, error) {
+	files := []string{}
+	for _, p := range backupPaths {
+		err := filepath.Walk(filepath.Join(root, p), func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			// Lock files belong to the running processes.
+			if info.Mode().IsRegular() && !strings.HasSuffix(file, ".lock") {
+				files = append(files, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// lockData takes the JSON store and change log locks of the data directory
+// below root, so no other instance writes while it is backed up or restored.
+func lockData(root string) (func(), error) {
+	locks := []*fileLock{}
+	unlock := func() {
+		for _, l := range locks {
+			l.Unlock()
+		}
+	}
+	for _, lockPath := range []string{filepath.Clean(dbDir) + ".lock", changeLogFile + ".lock"} {
+		lock, err := lockFile(filepath.Join(root, lockPath))
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return unlock, nil
+}
+
+// createBackup writes the data directory into a gzip compressed tar archive.
+// Writers of the JSON store and the change log wait until it is done, and
+// the SQL database is copied with VACUUM INTO, so the archive holds one
+// consistent state even while other processes are running.
+func createBackup(out io.Writer, station string, now time.Time) (backupManifest, error) {
+	manifest := backupManifest{Format: backupFormat, Created: formatTimestamp(now), Station: station}
+	unlock, err := lockData(".")
+	if err != nil {
+		return manifest, err
+	}
+	defer unlock()
+	files, err := backupFiles(".")
+	if err != nil {
+		return manifest, err
+	}
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	database := filepath.Clean(sqlDBFile)
+	for _, file := range files {
+		var entry backupFile
+		switch {
+		case file == database:
+			entry, err = addSQLSnapshot(tw, file, now)
+		case strings.HasPrefix(file, database+"-"):
+			// The journal and WAL files of the open database are in the
+			// snapshot already.
+			continue
+		default:
+			entry, err = addBackupFile(tw, file)
+		}
+		if err != nil {
+			return manifest, fmt.Errorf("adding \"%s\": %w", file, err)
+		}
+		manifest.Files = append(manifest.Files, entry)
+	}
+	payload, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return manifest, err
+	}
+	header := &tar.Header{Name: backupManifestName, Mode: 0644, Size: int64(len(payload)), ModTime: now}
+	if err := tw.WriteHeader(header); err != nil {
+		return manifest, err
+	}
+	if _, err := tw.Write(payload); err != nil {
+		return manifest, err
+	}
+	if err := tw.Close(); err != nil {
+		return manifest, err
+	}
+	return manifest, gz.Close()
+}
+
+func addBackupFile(tw *tar.Writer, file string) (backupFile, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return backupFile{Path: archiveName(file)}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return backupFile{Path: archiveName(file)}, err
+	}
+	// tar rounds to the second; truncate so restored files never look
+	// newer than the backup.
+	return addBackupEntry(tw, archiveName(file), f, info, info.ModTime().Truncate(time.Second))
+}
+
+// addSQLSnapshot adds a copy of the SQL database taken with VACUUM INTO,
+// which reads one consistent state while other connections write. It is
+// dated with the backup.
+func addSQLSnapshot(tw *tar.Writer, file string, now time.Time) (backupFile, error) {
+	dir, err := os.MkdirTemp("", "rrcreader-backup-")
+	if err != nil {
+		return backupFile{Path: archiveName(file)}, err
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, filepath.Base(file))
+	if err := vacuumSQLInto(file, snapshot); err != nil {
+		return backupFile{Path: archiveName(file)}, err
+	}
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return backupFile{Path: archiveName(file)}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return backupFile{Path: archiveName(file)}, err
+	}
+	return addBackupEntry(tw, archiveName(file), f, info, now.Truncate(time.Second))
+}
+
+// addBackupEntry writes the content of a file to the archive under name.
+func addBackupEntry(tw *tar.Writer, name string, f io.Reader, info os.FileInfo, modified time.Time) (backupFile, error) {
+	entry := backupFile{Path: name}
+	header := &tar.Header{Name: entry.Path, Mode: int64(info.Mode().Perm()), Size: info.Size(), ModTime: modified}
+	if err := tw.WriteHeader(header); err != nil {
+		return entry, err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(tw, io.TeeReader(f, hash)); err != nil {
+		return entry, err
+	}
+	entry.Size = info.Size()
+	entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	entry.Modified = formatTimestamp(modified)
+	return entry, nil
+}
+
+// checkArchiveName rejects archive paths outside the backup paths, such as
+// "../" or absolute paths in a crafted archive.
+func checkArchiveName(name string) error {
+	if name == backupManifestName {
+		return nil
+	}
+	if path.IsAbs(name) || path.Clean(name) != name || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("unsafe path \"%s\" in archive", name)
+	}
+	for _, p := range backupPaths {
+		p = archiveName(p)
+		if name == p || strings.HasPrefix(name, p+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected file \"%s\" in archive", name)
+}
+
+// walkBackup calls fn with every file of a backup archive.
+func walkBackup(archive string, fn func(header *tar.Header, content io.Reader) error) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := checkArchiveName(header.Name); err != nil {
+			return err
+		}
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// verifyBackup checks every file of an archive against its manifest.
+func verifyBackup(archive string) (backupManifest, error) {
+	var manifest backupManifest
+	found := false
+	sums := make(map[string]string)
+	err := walkBackup(archive, func(header *tar.Header, content io.Reader) error {
+		if header.Name == backupManifestName {
+			found = true
+			return json.NewDecoder(content).Decode(&manifest)
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(hash, content); err != nil {
+			return err
+		}
+		sums[header.Name] = hex.EncodeToString(hash.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return manifest, err
+	}
+	if !found {
+		return manifest, fmt.Errorf("archive has no manifest")
+	}
+	if manifest.Format > backupFormat {
+		return manifest, fmt.Errorf("archive format %d is newer than this version supports (%d)", manifest.Format, backupFormat)
+	}
+	for _, file := range manifest.Files {
+		sum, ok := sums[file.Path]
+		if !ok {
+			return manifest, fmt.Errorf("\"%s\" is missing from the archive", file.Path)
+		}
+		if sum != file.SHA256 {
+			return manifest, fmt.Errorf("checksum mismatch for \"%s\"", file.Path)
+		}
+		delete(sums, file.Path)
+	}
+	for name := range sums {
+		return manifest, fmt.Errorf("\"%s\" is not listed in the manifest", name)
+	}
+	return manifest, nil
+}
+
+// newerFiles lists the files below root changed after the backup was
+// taken, which a restore would overwrite or mix with older data.
+func newerFiles(root string, manifest backupManifest) ([]string, error) {
+	created, err := parseTimestamp(manifest.Created)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup time \"%s\"", manifest.Created)
+	}
+	files, err := backupFiles(root)
+	if err != nil {
+		return nil, err
+	}
+	newer := []string{}
+	journals := filepath.Join(root, sqlDBFile) + "-"
+	for _, file := range files {
+		if strings.HasPrefix(file, journals) {
+			// Removed when the database is restored.
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		// The backup time is stored to the second.
+		if info.ModTime().Truncate(time.Second).After(created) {
+			newer = append(newer, file)
+		}
+	}
+	sort.Strings(newer)
+	return newer, nil
+}
+
+// restoreBackup verifies an archive and writes its files below root. It
+// refuses to overwrite data changed after the backup unless forced. Files
+// that are not in the archive are left in place, except the journal files
+// of a restored SQL database, which SQLite would otherwise roll back onto it.
+func restoreBackup(archive, root string, force bool) (backupManifest, error) {
+	manifest, err := verifyBackup(archive)
+	if err != nil {
+		return manifest, err
+	}
+	unlock, err := lockData(root)
+	if err != nil {
+		return manifest, err
+	}
+	defer unlock()
+	if !force {
+		newer, err := newerFiles(root, manifest)
+		if err != nil {
+			return manifest, err
+		}
+		if len(newer) > 0 {
+			return manifest, fmt.Errorf("%d file(s) changed after the backup was taken, e.g. \"%s\"; use -force to overwrite them", len(newer), newer[0])
+		}
+	}
+	err = walkBackup(archive, func(header *tar.Header, content io.Reader) error {
+		if header.Name == backupManifestName {
+			return nil
+		}
+		file := filepath.Join(root, filepath.FromSlash(header.Name))
+		if header.Name == archiveName(sqlDBFile) {
+			for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+				if err := os.Remove(file + suffix); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+		return restoreFile(file, header, content)
+	})
+	return manifest, err
+}
+
+// restoreFile writes a file through a temporary file, so an interrupted
+// restore leaves either the old or the restored version, and keeps its
+// modification time.
+func restoreFile(file string, header *tar.Header, content io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), os.FileMode(header.Mode).Perm()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return err
+	}
+	return os.Chtimes(file, header.ModTime, header.ModTime)
+}
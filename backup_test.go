@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupOpenSQLDatabase(t *testing.T) {
+	chdirTemp(t)
+	store, err := openSQLStore(sqlDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	appendAll(t, store, testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20))
+
+	var archive bytes.Buffer
+	manifest, err := createBackup(&archive, "A", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range manifest.Files {
+		if strings.HasPrefix(f.Path, archiveName(sqlDBFile)+"-") {
+			t.Errorf("%s archived", f.Path)
+		}
+	}
+	appendAll(t, store, testReading("RRC2040-2", "#1", "2021-03-01T10:00:00Z", 30))
+
+	path := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(path, archive.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	// A journal left by a crash at the target is not rolled back onto the
+	// restored database.
+	journal := filepath.Join(root, sqlDBFile+"-journal")
+	if err := os.MkdirAll(filepath.Dir(journal), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(journal, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restoreBackup(path, root, false); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := openSQLStore(filepath.Join(root, sqlDBFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if readings, err := restored.Readings("RRC2040-2#1"); err != nil || len(readings) != 1 {
+		t.Errorf("restored database has %d readings, %v, want the 1 taken before the backup", len(readings), err)
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Errorf("journal left next to the restored database (%v)", err)
+	}
+}
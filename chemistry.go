@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// chemistrySpec holds the typical figures of a cell chemistry. They are
+// rules of thumb for when no device profile applies, not a replacement
+// for the maker's data sheet.
+type chemistrySpec struct {
+	Name               string   // as shown, e.g. "Li-ion"
+	Aliases            []string // Chemistry values reported by packs, compared without case, "-" or " "
+	NominalCellVoltage int      // mV per cell
+	MinTemperature     float64  // lowest discharge temperature in °C
+	MaxTemperature     float64  // highest discharge temperature in °C
+	MinChargeTemp      float64  // lowest charge temperature in °C
+	MaxChargeTemp      float64  // highest charge temperature in °C
+	CycleLife          int      // typical full cycles to end of life
+	StorageCharge      int      // relative charge in % for storage
+}
+
+var chemistryCatalogue = []chemistrySpec{
+	{Name: "Li-ion", Aliases: []string{"LION", "LIION", "LIPO", "LIPOLY", "LIP"}, NominalCellVoltage: 3600, MinTemperature: -20, MaxTemperature: 60, MinChargeTemp: 0, MaxChargeTemp: 45, CycleLife: 500, StorageCharge: 40},
+	{Name: "LiFePO4", Aliases: []string{"LIFEPO4", "LFP", "LIFE"}, NominalCellVoltage: 3200, MinTemperature: -20, MaxTemperature: 60, MinChargeTemp: 0, MaxChargeTemp: 45, CycleLife: 2000, StorageCharge: 50},
+	{Name: "NiMH", Aliases: []string{"NIMH"}, NominalCellVoltage: 1200, MinTemperature: -20, MaxTemperature: 50, MinChargeTemp: 0, MaxChargeTemp: 45, CycleLife: 500, StorageCharge: 40},
+	{Name: "NiCd", Aliases: []string{"NICD", "NICAD"}, NominalCellVoltage: 1200, MinTemperature: -20, MaxTemperature: 60, MinChargeTemp: 0, MaxChargeTemp: 45, CycleLife: 1000, StorageCharge: 40},
+	{Name: "Lead acid", Aliases: []string{"PB", "PBA", "PBAC", "SLA", "LEAD"}, NominalCellVoltage: 2000, MinTemperature: -20, MaxTemperature: 50, MinChargeTemp: -10, MaxChargeTemp: 40, CycleLife: 300, StorageCharge: 100},
+}
+
+// lookupChemistry finds the catalogue entry for a reported chemistry, e.g.
+// "LION" or "Li-Ion".
+func lookupChemistry(chemistry string) (chemistrySpec, bool) {
+	key := strings.NewReplacer("-", "", " ", "", "_", "").Replace(strings.ToUpper(strings.TrimSpace(chemistry)))
+	for _, spec := range chemistryCatalogue {
+		for _, alias := range spec.Aliases {
+			if key == alias {
+				return spec, true
+			}
+		}
+	}
+	return chemistrySpec{}, false
+}
+
+// seriesCells derives the number of cells in series from DesignVoltage,
+// e.g. 3 for a 10800 mV Li-ion pack. ok is false when the chemistry is
+// unknown or the design voltage is not close to a whole number of cells.
+func seriesCells(dataset rrcBatteryData) (int, bool) {
+	spec, ok := lookupChemistry(dataset.Chemistry)
+	if !ok || dataset.DesignVoltage <= 0 {
+		return 0, false
+	}
+	cells := int(math.Round(float64(dataset.DesignVoltage) / float64(spec.NominalCellVoltage)))
+	if cells < 1 {
+		return 0, false
+	}
+	off := math.Abs(float64(dataset.DesignVoltage - cells*spec.NominalCellVoltage))
+	return cells, off <= 0.1*float64(spec.NominalCellVoltage)
+}
+
+// chemistryProfile is the profile used when no device profile matches a
+// battery of a known chemistry: its cycle life as the limit, warning at
+// 90%, and the charge temperature window while charging, the discharge
+// window otherwise.
+func chemistryProfile(dataset rrcBatteryData) (batteryProfile, bool) {
+	spec, ok := lookupChemistry(dataset.Chemistry)
+	if !ok {
+		return batteryProfile{}, false
+	}
+	minTemperature, maxTemperature := spec.MinTemperature, spec.MaxTemperature
+	if dataset.Current > 0 {
+		minTemperature, maxTemperature = spec.MinChargeTemp, spec.MaxChargeTemp
+	}
+	return batteryProfile{
+		AssociatedDeviceName: spec.Name + " defaults",
+		MaxCycles:            spec.CycleLife,
+		WarnCycles:           spec.CycleLife * 9 / 10,
+		MinTemperature:       &minTemperature,
+		MaxTemperature:       &maxTemperature,
+	}, true
+}
+
+// profileFor returns the device profile chosen for a battery, or the
+// defaults of its chemistry when none matches.
+func profileFor(profiles []batteryProfile, dataset rrcBatteryData) (batteryProfile, bool) {
+	if profile, ok := matchProfile(profiles, dataset); ok {
+		return profile, true
+	}
+	return chemistryProfile(dataset)
+}
+
+// chemistrySummary interprets the chemistry and design voltage of a
+// battery, e.g. "Li-ion, 3 cells in series (3S) at 3.6 V nominal, typically
+// 500 cycles, store at 40% charge".
+func chemistrySummary(dataset rrcBatteryData) string {
+	spec, ok := lookupChemistry(dataset.Chemistry)
+	if !ok {
+		return fmt.Sprintf("chemistry \"%s\" not in the catalogue", dataset.Chemistry)
+	}
+	parts := []string{spec.Name}
+	if cells, ok := seriesCells(dataset); ok {
+		parts = append(parts, fmt.Sprintf("%d cells in series (%dS) at %.1f V nominal", cells, cells, float64(spec.NominalCellVoltage)/1000))
+	} else if dataset.DesignVoltage > 0 {
+		parts = append(parts, fmt.Sprintf("design voltage %d mV is no whole number of %.1f V cells", dataset.DesignVoltage, float64(spec.NominalCellVoltage)/1000))
+	}
+	parts = append(parts, fmt.Sprintf("typically %d cycles", spec.CycleLife), fmt.Sprintf("store at %d%% charge", spec.StorageCharge))
+	return strings.Join(parts, ", ")
+}
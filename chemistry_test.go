@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestSeriesCells(t *testing.T) {
+	tests := []struct {
+		chemistry     string
+		designVoltage int
+		cells         int
+		ok            bool
+	}{
+		{"LION", 10800, 3, true},
+		{"Li-Ion", 14400, 4, true},
+		{"LiFePO4", 12800, 4, true},
+		{"NIMH", 7200, 6, true},
+		{"SLA", 12000, 6, true},
+		{"LION", 11100, 3, true},  // 3.7 V cells, within 10% of the nominal
+		{"LION", 12600, 4, false}, // 3.5 cells
+		{"LION", 0, 0, false},
+		{"ZINC", 10800, 0, false},
+	}
+	for _, tt := range tests {
+		cells, ok := seriesCells(rrcBatteryData{Chemistry: tt.chemistry, DesignVoltage: tt.designVoltage})
+		if cells != tt.cells || ok != tt.ok {
+			t.Errorf("seriesCells(%s, %d mV) = %d, %v, want %d, %v", tt.chemistry, tt.designVoltage, cells, ok, tt.cells, tt.ok)
+		}
+	}
+}
+
+func TestChemistryProfile(t *testing.T) {
+	discharging := rrcBatteryData{Chemistry: "LION", Current: -500}
+	profile, ok := chemistryProfile(discharging)
+	if !ok || profile.AssociatedDeviceName != "Li-ion defaults" || profile.MaxCycles != 500 || profile.WarnCycles != 450 {
+		t.Fatalf("chemistryProfile = %+v, %v, want Li-ion defaults limited to 500 cycles, warning at 450", profile, ok)
+	}
+	if *profile.MinTemperature != -20 || *profile.MaxTemperature != 60 {
+		t.Errorf("discharging: window %g to %g °C, want -20 to 60", *profile.MinTemperature, *profile.MaxTemperature)
+	}
+	charging := discharging
+	charging.Current = 500
+	if profile, _ := chemistryProfile(charging); *profile.MinTemperature != 0 || *profile.MaxTemperature != 45 {
+		t.Errorf("charging: window %g to %g °C, want 0 to 45", *profile.MinTemperature, *profile.MaxTemperature)
+	}
+	if _, ok := chemistryProfile(rrcBatteryData{Chemistry: "ZINC"}); ok {
+		t.Error("chemistryProfile found defaults for an unknown chemistry")
+	}
+
+	// A matching device profile comes before the defaults.
+	device := batteryProfile{AssociatedDeviceName: "Ventilator", AssociateDevSnPrefix: "1234."}
+	charging.DevSerialNumber = "1234.1"
+	if profile, ok := profileFor([]batteryProfile{device}, charging); !ok || profile.AssociatedDeviceName != "Ventilator" {
+		t.Errorf("profileFor = %q, %v, want Ventilator", profile.AssociatedDeviceName, ok)
+	}
+	charging.DevSerialNumber = "5678.1"
+	if profile, ok := profileFor([]batteryProfile{device}, charging); !ok || profile.AssociatedDeviceName != "Li-ion defaults" {
+		t.Errorf("profileFor without a matching profile = %q, %v, want Li-ion defaults", profile.AssociatedDeviceName, ok)
+	}
+}
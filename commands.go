@@ -0,0 +1,1116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usageText = `Usage: rrcreader [command]
+
+Without a command the interactive menu is started.
+
+Commands:
+  db migrate    Copy the JSON database (./data/db) into the SQL database
+  db verify     Report unreadable, inconsistent and outdated records
+  db upgrade    Rewrite records stored with an older schema version
+                (migrate, verify and upgrade take -zone NAME, the time
+                zone old timestamps were taken in)
+  db split      Split histories that mix several packs sharing a serial
+                (-yes to split without asking)
+  device list   List registered devices
+  device add SERIAL
+                Register or update a device (-model, -owner, -location)
+  device show SERIAL
+                Show a device and every battery swap
+  device attach BATTERY DEVICE
+  device detach BATTERY
+  device reassign BATTERY DEVICE
+                Record battery swaps (-at TIME, default now)
+  device backfill
+                Build attachment histories from the device serials
+                stored with older readings
+  query         List batteries matching filters (-name, -chemistry,
+                -device, -min-cycles, -max-cycles, -min-soh, -max-soh,
+                -status green|yellow|red, -seen-after/-seen-before
+                YYYY-MM-DD, -format table|json|csv)
+  compact       Downsample old monitoring samples by the retention
+                policy and drop superseded change log entries
+                (-dry-run)
+  note add TEXT Add a note to a battery (-battery ID), one of its
+                readings (-battery ID -reading TIMESTAMP) or a device
+                (-device SERIAL), with -tags a,b and -author NAME
+  note list     List notes (-battery ID, -device SERIAL, -tag TAG)
+  note remove ID
+                Remove a note
+  sync          Exchange readings and profiles with the remote server
+                (-retries N)
+  import PATH   Merge another station's data directory into this one
+                (-dry-run, -zone NAME: the zone the source took old
+                timestamps in, default its legacyzone)
+  serve         Run the collection server stations sync with
+                (-listen ADDR, -tls-cert FILE, -tls-key FILE)
+  dedupe        Remove readouts repeated within the duplicate window
+                without a cycle change (-dry-run, -window DURATION,
+                -keep newest|oldest)
+  profile match Explain which profile a battery gets and why
+                (-battery ID, or -device SERIAL -name NAME
+                -manufacturer NAME)
+  profile list  List the battery profiles
+  profile add NAME
+                Add a profile (-prefix, -pattern, -regex, -battery-name,
+                -manufacturer, -priority, -max-cycles, -warn-cycles,
+                -min-capacity, -warn-capacity, -min-temp, -max-temp,
+                -min-voltage, -max-cell-spread, -max-age MONTHS,
+                -image-device, -image-battery)
+  profile edit NAME|#N
+                Change the given fields of a profile (same flags as add,
+                -name to rename)
+  profile remove NAME|#N
+                Remove a profile
+  profile validate [FILE]
+                Check a profile file for unknown keys, wrong types and
+                values out of range
+  model list    List the battery models readouts are checked against
+  model check   Check every reading against the rated values of its
+                model (-battery ID)
+  forecast      Predict when each battery reaches its capacity or cycle
+                limit (-battery ID, -model NAME)
+  fleet         Write the fleet overview of every battery to
+                data/html/fleet.html (-retire-months N, -stale-months N,
+                -model NAME, -open)
+  backup        Save the data directory and configuration into one
+                archive (-o FILE)
+  restore FILE  Verify and restore a backup archive (-to PATH, -force
+                to overwrite data changed after the backup)
+`
+
+// parseArgs parses flags given before, between or after the positional
+// arguments, which flag.FlagSet alone stops at.
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func runCommand(args []string, genConfig *generalConfiguration) int {
+	switch args[0] {
+	case "db":
+		return dbCommand(args[1:], genConfig)
+	case "device":
+		return deviceCommand(args[1:], *genConfig)
+	case "query":
+		return queryCommand(args[1:], *genConfig)
+	case "compact":
+		return compactCommand(args[1:], *genConfig)
+	case "note":
+		return noteCommand(args[1:], *genConfig)
+	case "sync":
+		return syncCommand(args[1:], *genConfig)
+	case "import":
+		return importCommand(args[1:], *genConfig)
+	case "serve":
+		return serveCommand(args[1:], *genConfig)
+	case "dedupe":
+		return dedupeCommand(args[1:], *genConfig)
+	case "profile":
+		return profileCommand(args[1:], *genConfig)
+	case "model":
+		return modelCommand(args[1:], *genConfig)
+	case "forecast":
+		return forecastCommand(args[1:], *genConfig)
+	case "fleet":
+		return fleetCommand(args[1:], *genConfig)
+	case "backup":
+		return backupCommand(args[1:], *genConfig)
+	case "restore":
+		return restoreCommand(args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(usageText)
+		return 0
+	default:
+		fmt.Printf("Unknown command \"%s\"\n%s", args[0], usageText)
+		return 2
+	}
+}
+
+func dbCommand(args []string, genConfig *generalConfiguration) int {
+	if len(args) == 0 {
+		fmt.Print(usageText)
+		return 2
+	}
+	switch args[0] {
+	case "migrate", "verify", "upgrade":
+		// Records written before version 2 carry no zone; -zone tells
+		// which one they were taken in when the data came from elsewhere.
+		flags := flag.NewFlagSet("db "+args[0], flag.ContinueOnError)
+		zone := flags.String("zone", genConfig.LegacyZone, "time zone of timestamps written before version 2, e.g. Europe/Helsinki")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if err := setLegacyZone(*zone); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 2
+		}
+	}
+	switch args[0] {
+	case "migrate":
+		store, err := openSQLStore(sqlDBFile)
+		if err != nil {
+			fmt.Printf("Error opening \"%s\": %v\n", sqlDBFile, err)
+			return 1
+		}
+		defer store.Close()
+		report, err := migrateJSONToSQL(dbDir, store)
+		fmt.Printf("From \"%s\" to \"%s\": %s", dbDir, sqlDBFile, report)
+		if err != nil {
+			fmt.Printf("Migration failed: %v\n", err)
+			return 1
+		}
+		if report.Skipped > 0 {
+			fmt.Printf("Database backend left unchanged, fix or remove the skipped records and migrate again\n")
+			return 1
+		}
+		genConfig.DatabaseBackend = backendSQL
+		if err := writeCfgFile(*genConfig); err != nil {
+			fmt.Printf("Error writing\"%s\":%v\n", configFile, err)
+			return 1
+		}
+		fmt.Printf("Database backend set to \"%s\"\n", backendSQL)
+		return 0
+	case "verify", "upgrade":
+		store, err := openBaseStore(*genConfig)
+		if err != nil {
+			fmt.Printf("Failed to open database: %v\n", err)
+			return 1
+		}
+		defer store.Close()
+		report, err := store.Verify()
+		if err != nil {
+			fmt.Printf("Verify failed: %v\n", err)
+			return 1
+		}
+		fmt.Print(report)
+		if args[0] == "upgrade" {
+			upgraded, err := upgradeRecords(store, report.Outdated)
+			if err == nil {
+				err = upgradeRegistry(store)
+			}
+			fmt.Printf("%d record(s) upgraded to schema version %d\n", upgraded, recordVersion)
+			if err != nil {
+				fmt.Printf("Upgrade failed: %v\n", err)
+				return 1
+			}
+		}
+		if len(report.Problems) > 0 {
+			return 1
+		}
+		return 0
+	case "split":
+		flags := flag.NewFlagSet("db split", flag.ContinueOnError)
+		yes := flags.Bool("yes", false, "split without asking")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		store, err := openStore(*genConfig)
+		if err != nil {
+			fmt.Printf("Failed to open database: %v\n", err)
+			return 1
+		}
+		defer store.Close()
+		split, err := splitMergedHistories(store, identityFields(*genConfig), func(plan string) bool {
+			fmt.Print(plan)
+			return *yes || askYesNo("Split?")
+		})
+		fmt.Printf("%d history(s) split\n", split)
+		if err != nil {
+			fmt.Printf("Split failed: %v\n", err)
+			return 1
+		}
+		return 0
+	default:
+		fmt.Printf("Unknown db command \"%s\"\n%s", args[0], usageText)
+		return 2
+	}
+}
+
+func queryCommand(args []string, genConfig generalConfiguration) int {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	var query batteryQuery
+	flags.StringVar(&query.NamePrefix, "name", "", "battery model name prefix")
+	flags.StringVar(&query.Chemistry, "chemistry", "", "chemistry, e.g. LION")
+	flags.StringVar(&query.DevSerialPrefix, "device", "", "device serial prefix")
+	flags.IntVar(&query.MinCycles, "min-cycles", 0, "minimum cycle count")
+	flags.IntVar(&query.MaxCycles, "max-cycles", -1, "maximum cycle count")
+	flags.Float64Var(&query.MinSoH, "min-soh", 0, "minimum state of health in %")
+	flags.Float64Var(&query.MaxSoH, "max-soh", -1, "maximum state of health in %")
+	flags.StringVar(&query.Status, "status", "", "health status: green, yellow or red")
+	seenAfter := flags.String("seen-after", "", "last seen on or after YYYY-MM-DD")
+	seenBefore := flags.String("seen-before", "", "last seen before YYYY-MM-DD")
+	format := flags.String("format", "table", "output format: table, json or csv")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	var err error
+	if query.SeenAfter, err = parseQueryDate(*seenAfter); err != nil {
+		fmt.Printf("Invalid date \"%s\": %v\n", *seenAfter, err)
+		return 2
+	}
+	if query.SeenBefore, err = parseQueryDate(*seenBefore); err != nil {
+		fmt.Printf("Invalid date \"%s\": %v\n", *seenBefore, err)
+		return 2
+	}
+	switch query.Status {
+	case "", statusGreen, statusYellow, statusRed:
+	default:
+		fmt.Printf("Unknown status \"%s\", use green, yellow or red\n", query.Status)
+		return 2
+	}
+	profiles, err := loadBatteryProfiles()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error reading \"%s\": %v\n", batteryProfiles, err)
+		return 1
+	}
+	store, err := openBaseStore(genConfig)
+	if err != nil {
+		fmt.Printf("Failed to open database: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+	rows, err := runQuery(store, query, profiles)
+	if err != nil {
+		fmt.Printf("Query failed: %v\n", err)
+		return 1
+	}
+	if err := writeQueryRows(os.Stdout, rows, *format); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 2
+	}
+	return 0
+}
+
+func noteCommand(args []string, genConfig generalConfiguration) int {
+	if len(args) == 0 {
+		fmt.Print(usageText)
+		return 2
+	}
+	flags := flag.NewFlagSet("note "+args[0], flag.ContinueOnError)
+	batteryID := flags.String("battery", "", "battery id")
+	reading := flags.String("reading", "", "reading timestamp")
+	device := flags.String("device", "", "device serial")
+	tags := flags.String("tags", "", "comma separated tags")
+	tag := flags.String("tag", "", "only notes with this tag")
+	author := flags.String("author", "", "note author")
+	params, err := parseArgs(flags, args[1:])
+	if err != nil {
+		return 2
+	}
+	store, err := openStore(genConfig)
+	if err != nil {
+		fmt.Printf("Failed to open database: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+	switch args[0] {
+	case "add":
+		if *reading != "" && *batteryID == "" {
+			fmt.Printf("-reading needs -battery\n")
+			return 2
+		}
+		n, err := addNote(store, genConfig, note{
+			BatteryID: *batteryID,
+			Timestamp: *reading,
+			Device:    *device,
+			Text:      strings.Join(params, " "),
+			Tags:      parseTags(*tags),
+			Author:    *author,
+		})
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Note %s added\n", n.ID)
+	case "list":
+		notes, err := store.Notes()
+		if err != nil {
+			fmt.Printf("Database read error: %v\n", err)
+			return 1
+		}
+		devices := []string{}
+		if *device != "" {
+			devices = append(devices, *device)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tCREATED\tAUTHOR\tON\tTAGS\tTEXT")
+		for _, n := range notesFor(notes, *batteryID, devices, *tag) {
+			on := n.BatteryID
+			if n.Timestamp != "" {
+				on += " @ " + n.Timestamp
+			}
+			if n.Device != "" {
+				on = "device " + n.Device
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", n.ID, n.Created, n.Author, on, strings.Join(n.Tags, ","), n.Text)
+		}
+		w.Flush()
+	case "remove":
+		if len(params) != 1 {
+			fmt.Printf("Usage: rrcreader note remove ID\n")
+			return 2
+		}
+		if err := removeNote(store, params[0]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+	default:
+		fmt.Printf("Unknown note command \"%s\"\n%s", args[0], usageText)
+		return 2
+	}
+	return 0
+}
+
+func compactCommand(args []string, genConfig generalConfiguration) int {
+	flags := flag.NewFlagSet("compact", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "show what would be merged without changing anything")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	policy, err := retentionPolicy(genConfig)
+	if err != nil {
+		fmt.Printf("Invalid retention policy: %v\n", err)
+		return 2
+	}
+	store, err := openStore(genConfig)
+	if err != nil {
+		fmt.Printf("Failed to open database: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+	report, err := compactStore(store, policy, time.Now(), *dryRun)
+	if *dryRun {
+		fmt.Printf("Dry run, nothing was changed.\n")
+	}
+	fmt.Print(report)
+	if err != nil {
+		fmt.Printf("Compaction failed: %v\n", err)
+		return 1
+	}
+	if !*dryRun {
+		kept, removed, err := openChangeLog(changeLogFile).Compact()
+		if err != nil {
+			fmt.Printf("Change log compaction failed: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Change log: %d entries kept, %d superseded entries removed\n", kept, removed)
+	}
+	return 0
+}
+
+func dedupeCommand(args []string, genConfig generalConfiguration) int {
+	flags := flag.NewFlagSet("dedupe", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "list the duplicates without removing them")
+	windowFlag := flags.String("window", "", "duplicate window, default from the configuration")
+	keep := flags.String("keep", "newest", "reading kept of each group, newest or oldest")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *windowFlag != "" {
+		genConfig.DuplicateWindow = *windowFlag
+	}
+	window, err := duplicateWindow(genConfig)
+	if err != nil {
+		fmt.Printf("Invalid duplicate window: %v\n", err)
+		return 2
+	}
+	if *keep != "newest" && *keep != "oldest" {
+		fmt.Printf("Invalid -keep \"%s\", use newest or oldest\n", *keep)
+		return 2
+	}
+	store, err := openStore(genConfig)
+	if err != nil {
+		fmt.Printf("Failed to open database: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+	report, err := dedupeStore(store, window, *keep == "oldest", *dryRun)
+	if *dryRun {
+		fmt.Printf("Dry run, nothing was changed.\n")
+	}
+	fmt.Print(report)
+	if err != nil {
+		fmt.Printf("Cleanup failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func syncCommand(args []string, genConfig generalConfiguration) int {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	retries := flags.Int("retries", 3, "retries while the server is unreachable")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	report, err := runSync(genConfig, *retries)
+	fmt.Print(report)
+	if err != nil {
+		fmt.Printf("Sync failed: %v\nUnsent changes are kept and sent on the next sync.\n", err)
+		return 1
+	}
+	fmt.Printf("Sync with \"%s\" completed\n", genConfig.RemoteHost)
+	return 0
+}
+
+func serveCommand(args []string, genConfig generalConfiguration) int {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	listen := flags.String("listen", ":"+genConfig.RemotePort, "address to listen on")
+	certFile := flags.String("tls-cert", "", "TLS certificate file")
+	keyFile := flags.String("tls-key", "", "TLS key file")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if err := runServer(genConfig, *listen, *certFile, *keyFile); err != nil {
+		fmt.Printf("Server failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func importCommand(args []string, genConfig generalConfiguration) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "show the changes without applying them")
+	zoneName := flags.String("zone", "", "time zone the source took its timestamps written before version 2 in (default: legacyzone of the source configuration, else of this one)")
+	params, err := parseArgs(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(params) != 1 {
+		fmt.Printf("Usage: rrcreader import [-dry-run] [-zone NAME] PATH\n")
+		return 2
+	}
+	if *zoneName == "" {
+		_, dataPath, _ := importPaths(params[0])
+		if *zoneName, err = sourceLegacyZone(dataPath); err != nil {
+			fmt.Printf("Error reading the source configuration: %v\n", err)
+			return 1
+		}
+	}
+	if *zoneName == "" {
+		*zoneName = genConfig.LegacyZone
+	}
+	zone, err := loadLegacyZone(*zoneName)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 2
+	}
+	src, dataPath, err := openImportSource(params[0], zone)
+	if err != nil {
+		fmt.Printf("Error opening \"%s\": %v\n", params[0], err)
+		return 1
+	}
+	defer src.Close()
+	dst, err := openStore(genConfig)
+	if err != nil {
+		fmt.Printf("Failed to open database: %v\n", err)
+		return 1
+	}
+	defer dst.Close()
+	report, err := importStore(src, dst, identityFields(genConfig), *dryRun)
+	if err == nil {
+		err = importProfiles(dataPath, &report, *dryRun)
+	}
+	if *dryRun {
+		fmt.Printf("Dry run, nothing was changed.\n")
+	}
+	fmt.Print(report)
+	if err != nil {
+		fmt.Printf("Import failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func profileCommand(args []string, genConfig generalConfiguration) int {
+	if len(args) == 0 {
+		fmt.Print(usageText)
+		return 2
+	}
+	switch args[0] {
+	case "match":
+		flags := flag.NewFlagSet("profile match", flag.ContinueOnError)
+		batteryID := flags.String("battery", "", "battery to take name, manufacturer and device from")
+		device := flags.String("device", "", "device serial")
+		name := flags.String("name", "", "battery name")
+		manufacturer := flags.String("manufacturer", "", "battery manufacturer")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		var dataset rrcBatteryData
+		if *batteryID != "" {
+			store, err := openStore(genConfig)
+			if err != nil {
+				fmt.Printf("Failed to open database: %v\n", err)
+				return 1
+			}
+			readings, err := store.Readings(*batteryID)
+			if err == nil {
+				dataset = readings[len(readings)-1]
+				dataset.DevSerialNumber, err = store.DeviceFor(*batteryID)
+			}
+			store.Close()
+			if err != nil {
+				fmt.Printf("Database read error: %v\n", err)
+				return 1
+			}
+		}
+		if *device != "" {
+			dataset.DevSerialNumber = *device
+		}
+		if *name != "" {
+			dataset.Name = *name
+		}
+		if *manufacturer != "" {
+			dataset.Manufacturer = *manufacturer
+		}
+		profiles, err := loadBatteryProfiles()
+		if err != nil {
+			fmt.Printf("Error reading \"%s\": %v\n", batteryProfiles, err)
+			return 1
+		}
+		fmt.Print(explainProfiles(profiles, dataset))
+		return 0
+	case "validate":
+		file := batteryProfiles
+		if len(args) > 1 {
+			file = args[1]
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Printf("Error reading \"%s\": %v\n", file, err)
+			return 1
+		}
+		problems := validateProfileFile(data)
+		for _, problem := range problems {
+			fmt.Printf("%s:%s\n", file, problem)
+		}
+		if len(problems) > 0 {
+			return 1
+		}
+		fmt.Printf("%s: ok\n", file)
+		return 0
+	}
+	flags := flag.NewFlagSet("profile "+args[0], flag.ContinueOnError)
+	apply := profileFlags(flags)
+	params, err := parseArgs(flags, args[1:])
+	if err != nil {
+		return 2
+	}
+	argc := map[string]int{"list": 0, "add": 1, "edit": 1, "remove": 1}
+	want, ok := argc[args[0]]
+	if !ok {
+		fmt.Printf("Unknown profile command \"%s\"\n%s", args[0], usageText)
+		return 2
+	}
+	if len(params) != want {
+		fmt.Printf("profile %s expects %d argument(s)\n", args[0], want)
+		return 2
+	}
+	profiles, err := loadBatteryProfiles()
+	if err != nil {
+		fmt.Printf("Error reading \"%s\": %v\n", batteryProfiles, err)
+		return 1
+	}
+	// Only the profile added or changed must be valid, so older mistakes
+	// in the file do not block fixing them one at a time.
+	changed := -1
+	switch args[0] {
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "#\tNAME\tMATCHES\tPRIORITY\tCYCLES WARN/MAX\tCAPACITY WARN/MIN")
+		for i, p := range profiles {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d/%d\t%g/%g\n", i+1, p.AssociatedDeviceName, profileCriteria(p), p.Priority, p.WarnCycles, p.MaxCycles, p.WarnCapacityFactor, p.MinCapacityFactor)
+		}
+		w.Flush()
+		return 0
+	case "add":
+		if _, err := findProfile(profiles, params[0]); err == nil {
+			fmt.Printf("Profile \"%s\" already exists, use profile edit\n", params[0])
+			return 1
+		}
+		profile := batteryProfile{AssociatedDeviceName: params[0]}
+		apply(&profile)
+		profiles = append(profiles, profile)
+		changed = len(profiles) - 1
+	case "edit":
+		i, err := findProfile(profiles, params[0])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		apply(&profiles[i])
+		for j, p := range profiles {
+			if j != i && p.AssociatedDeviceName == profiles[i].AssociatedDeviceName {
+				fmt.Printf("Profile \"%s\" already exists\n", p.AssociatedDeviceName)
+				return 1
+			}
+		}
+		changed = i
+	case "remove":
+		i, err := findProfile(profiles, params[0])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		profiles = append(profiles[:i], profiles[i+1:]...)
+	}
+	invalid := false
+	for _, issue := range checkProfiles(profiles) {
+		if issue.Index == changed {
+			fmt.Printf("Invalid %s\n", issue.Message)
+			invalid = true
+		}
+	}
+	if invalid {
+		fmt.Printf("\"%s\" left unchanged\n", batteryProfiles)
+		return 1
+	}
+	if err := saveBatteryProfiles(profiles); err != nil {
+		fmt.Printf("Error writing \"%s\": %v\n", batteryProfiles, err)
+		return 1
+	}
+	return 0
+}
+
+// profileFlags defines the profile fields as flags. The returned function
+// sets the fields whose flags were given.
+func profileFlags(flags *flag.FlagSet) func(*batteryProfile) {
+	name := flags.String("name", "", "new profile name")
+	prefix := flags.String("prefix", "", "device serial prefix")
+	pattern := flags.String("pattern", "", "glob on the device serial")
+	regex := flags.String("regex", "", "regular expression on the device serial")
+	batteryName := flags.String("battery-name", "", "glob on the battery name")
+	manufacturer := flags.String("manufacturer", "", "glob on the battery manufacturer")
+	priority := flags.Int("priority", 0, "priority among matching profiles")
+	maxCycles := flags.Int("max-cycles", 0, "cycle count for red status")
+	warnCycles := flags.Int("warn-cycles", 0, "cycle count for yellow status")
+	minCapacity := flags.Float64("min-capacity", 0, "capacity factor (0..1) for red status")
+	warnCapacity := flags.Float64("warn-capacity", 0, "capacity factor (0..1) for yellow status")
+	minTemperature := flags.Float64("min-temp", 0, "lowest allowed temperature in °C")
+	maxTemperature := flags.Float64("max-temp", 0, "highest allowed temperature in °C")
+	minVoltage := flags.Int("min-voltage", 0, "lowest allowed pack voltage in mV")
+	maxCellSpread := flags.Int("max-cell-spread", 0, "largest allowed cell voltage difference in mV")
+	maxAge := flags.Int("max-age", 0, "calendar age limit in months")
+	imageDevice := flags.String("image-device", "", "image file of the device")
+	imageBattery := flags.String("image-battery", "", "image file of the battery")
+	return func(p *batteryProfile) {
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "name":
+				p.AssociatedDeviceName = *name
+			case "prefix":
+				p.AssociateDevSnPrefix = *prefix
+			case "pattern":
+				p.DevSnPattern = *pattern
+			case "regex":
+				p.DevSnRegex = *regex
+			case "battery-name":
+				p.BatteryName = *batteryName
+			case "manufacturer":
+				p.Manufacturer = *manufacturer
+			case "priority":
+				p.Priority = *priority
+			case "max-cycles":
+				p.MaxCycles = *maxCycles
+			case "warn-cycles":
+				p.WarnCycles = *warnCycles
+			case "min-capacity":
+				p.MinCapacityFactor = *minCapacity
+			case "warn-capacity":
+				p.WarnCapacityFactor = *warnCapacity
+			case "min-temp":
+				p.MinTemperature = minTemperature
+			case "max-temp":
+				p.MaxTemperature = maxTemperature
+			case "min-voltage":
+				p.MinVoltage = *minVoltage
+			case "max-cell-spread":
+				p.MaxCellSpread = *maxCellSpread
+			case "max-age":
+				p.MaxAgeMonths = *maxAge
+			case "image-device":
+				p.ImageFileDevice = *imageDevice
+			case "image-battery":
+				p.ImageFileBattery = *imageBattery
+			}
+		})
+	}
+}
+
+func modelCommand(args []string, genConfig generalConfiguration) int {
+	if len(args) == 0 {
+		fmt.Print(usageText)
+		return 2
+	}
+	models, err := loadBatteryModels()
+	if err != nil {
+		fmt.Printf("Error reading \"%s\": %v\n", batteryModelsFile, err)
+		return 1
+	}
+	switch args[0] {
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tMANUFACTURER\tCAPACITY\tVOLTAGE\tCHEMISTRY\tCELLS")
+		for _, m := range models {
+			fmt.Fprintf(w, "%s\t%s\t%d mAh\t%d mV\t%s\t%s\n", m.Name, m.Manufacturer, m.DesignCapacity, m.DesignVoltage, m.Chemistry, m.Cells)
+		}
+		w.Flush()
+		return 0
+	case "check":
+		flags := flag.NewFlagSet("model check", flag.ContinueOnError)
+		batteryID := flags.String("battery", "", "check only this battery")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		store, err := openStore(genConfig)
+		if err != nil {
+			fmt.Printf("Failed to open database: %v\n", err)
+			return 1
+		}
+		defer store.Close()
+		ids := []string{*batteryID}
+		if *batteryID == "" {
+			batteries, err := store.ListBatteries(batteryFilter{})
+			if err != nil {
+				fmt.Printf("Database read error: %v\n", err)
+				return 1
+			}
+			ids = ids[:0]
+			for _, b := range batteries {
+				ids = append(ids, b.ID)
+			}
+		}
+		mismatched, unknown := 0, 0
+		for _, id := range ids {
+			readings, err := store.Readings(id)
+			if err != nil {
+				fmt.Printf("Database read error: %v\n", err)
+				return 1
+			}
+			if _, ok := findModel(models, readings[len(readings)-1]); !ok {
+				unknown++
+				continue
+			}
+			warnings := modelWarnings(models, readings)
+			if len(warnings) > 0 {
+				mismatched++
+			}
+			for _, w := range warnings {
+				fmt.Printf("%s: %s\n", id, w)
+			}
+		}
+		fmt.Printf("%d battery(s) checked: %d do not match their model, %d with a model not in the catalogue\n", len(ids), mismatched, unknown)
+		if mismatched > 0 {
+			return 1
+		}
+		return 0
+	default:
+		fmt.Printf("Unknown model command \"%s\"\n%s", args[0], usageText)
+		return 2
+	}
+}
+
+func forecastCommand(args []string, genConfig generalConfiguration) int {
+	flags := flag.NewFlagSet("forecast", flag.ContinueOnError)
+	batteryID := flags.String("battery", "", "forecast only this battery")
+	model := flags.String("model", genConfig.FadeModel, "capacity fade model")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	profiles, err := loadBatteryProfiles()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error reading \"%s\": %v\n", batteryProfiles, err)
+		return 1
+	}
+	store, err := openStore(genConfig)
+	if err != nil {
+		fmt.Printf("Failed to open database: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+	rows, err := forecastStore(store, profiles, *model, *batteryID)
+	if err != nil {
+		fmt.Printf("Database read error: %v\n", err)
+		return 1
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCYCLES\tCYCLES/DAY\tLIMIT\tEND CYCLES\tRANGE\tREPLACE BY")
+	for _, row := range rows {
+		f := row.Forecast
+		if row.Err != nil {
+			fmt.Fprintf(w, "%s\t\t\t\t\t\t%v\n", row.ID, row.Err)
+			continue
+		}
+		end, spread := "beyond", ""
+		if f.EndCycles > 0 {
+			end = fmt.Sprintf("%.0f", f.EndCycles)
+		}
+		if f.Earliest != f.EndCycles || f.Latest != f.EndCycles {
+			spread = fmt.Sprintf("%.0f-%.0f", f.Earliest, f.Latest)
+			if f.Latest == 0 {
+				spread = fmt.Sprintf("%.0f-", f.Earliest)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%.0f\t%.2f\t%s\t%s\t%s\t%s\n", row.ID, f.LastCycles, f.CyclesPerDay, f.Reason, end, spread, f.Replacement())
+	}
+	w.Flush()
+	return 0
+}
+
+func fleetCommand(args []string, genConfig generalConfiguration) int {
+	flags := flag.NewFlagSet("fleet", flag.ContinueOnError)
+	retireMonths := flags.Int("retire-months", 6, "list batteries expected to need replacing within this many months")
+	staleMonths := flags.Int("stale-months", 6, "list batteries not read for this many months")
+	model := flags.String("model", genConfig.FadeModel, "capacity fade model")
+	open := flags.Bool("open", false, "open the overview in the browser")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	profiles, err := loadBatteryProfiles()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error reading \"%s\": %v\n", batteryProfiles, err)
+		return 1
+	}
+	store, err := openStore(genConfig)
+	if err != nil {
+		fmt.Printf("Failed to open database: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+	overview, err := buildFleetOverview(store, profiles, *model, *retireMonths, *staleMonths, time.Now())
+	if err != nil {
+		fmt.Printf("Database read error: %v\n", err)
+		return 1
+	}
+	saveAs := filepath.Join(htmlDir, fleetReport)
+	f, err := os.Create(saveAs)
+	if err != nil {
+		fmt.Printf("Error creating \"%s\": %v\n", saveAs, err)
+		return 1
+	}
+	err = renderFleetOverview(f, overview)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Printf("Error writing \"%s\": %v\n", saveAs, err)
+		return 1
+	}
+	fmt.Printf("%s: %d battery(s), %d nearing retirement, %d not seen for %d months\n",
+		saveAs, len(overview.Rows), len(overview.Retiring), len(overview.Stale), *staleMonths)
+	if *open {
+		launchViewer(saveAs)
+	}
+	return 0
+}
+
+func backupCommand(args []string, genConfig generalConfiguration) int {
+	now := time.Now()
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	output := flags.String("o", "rrcreader-backup-"+timestampKey(formatTimestamp(now))+".tar.gz", "archive to write")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		fmt.Printf("Error creating \"%s\": %v\n", *output, err)
+		return 1
+	}
+	manifest, err := createBackup(f, stationName(genConfig), now)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*output)
+		fmt.Printf("Backup failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%d file(s) saved to %s\n", len(manifest.Files), *output)
+	return 0
+}
+
+func restoreCommand(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	target := flags.String("to", ".", "directory to restore the data directory into")
+	force := flags.Bool("force", false, "overwrite data changed after the backup was taken")
+	params, err := parseArgs(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(params) != 1 {
+		fmt.Printf("Usage: rrcreader restore [-to PATH] [-force] FILE\n")
+		return 2
+	}
+	manifest, err := restoreBackup(params[0], *target, *force)
+	if err != nil {
+		fmt.Printf("Restore failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%d file(s) from %s (%s) restored into %s\n", len(manifest.Files), manifest.Station, manifest.Created, filepath.Join(*target, filepath.Dir(archiveName(dbDir))))
+	return 0
+}
+
+func deviceCommand(args []string, genConfig generalConfiguration) int {
+	if len(args) == 0 {
+		fmt.Print(usageText)
+		return 2
+	}
+	flags := flag.NewFlagSet("device "+args[0], flag.ContinueOnError)
+	model := flags.String("model", "", "device model")
+	owner := flags.String("owner", "", "device owner")
+	location := flags.String("location", "", "device location")
+	at := flags.String("at", formatTimestamp(time.Now()), "time of the swap (RFC 3339, or YYYYMMDDhhmmss in local time)")
+	params, err := parseArgs(flags, args[1:])
+	if err != nil {
+		return 2
+	}
+	when, err := parseTimestamp(*at)
+	if err != nil {
+		fmt.Printf("Invalid time \"%s\": %v\n", *at, err)
+		return 2
+	}
+	*at = formatTimestamp(when)
+	store, err := openStore(genConfig)
+	if err != nil {
+		fmt.Printf("Failed to open database: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+	argc := map[string]int{"list": 0, "backfill": 0, "add": 1, "show": 1, "detach": 1, "attach": 2, "reassign": 2}
+	want, ok := argc[args[0]]
+	if !ok {
+		fmt.Printf("Unknown device command \"%s\"\n%s", args[0], usageText)
+		return 2
+	}
+	if len(params) != want {
+		fmt.Printf("device %s expects %d argument(s)\n", args[0], want)
+		return 2
+	}
+	switch args[0] {
+	case "list":
+		devices, err := store.Devices()
+		if err != nil {
+			fmt.Printf("Database read error: %v\n", err)
+			return 1
+		}
+		attachments, err := store.Attachments("")
+		if err != nil {
+			fmt.Printf("Database read error: %v\n", err)
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SERIAL\tMODEL\tOWNER\tLOCATION\tBATTERY")
+		for _, d := range devices {
+			battery := ""
+			for _, a := range attachments {
+				if a.DeviceSerial == d.Serial && a.Detached == "" && !a.Removed {
+					battery = a.BatteryID
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.Serial, d.Model, d.Owner, d.Location, battery)
+		}
+		w.Flush()
+	case "add":
+		device := deviceRecord{Serial: params[0]}
+		devices, err := store.Devices()
+		if err != nil {
+			fmt.Printf("Database read error: %v\n", err)
+			return 1
+		}
+		for _, d := range devices {
+			if d.Serial == device.Serial {
+				device = d
+			}
+		}
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "model":
+				device.Model = *model
+			case "owner":
+				device.Owner = *owner
+			case "location":
+				device.Location = *location
+			}
+		})
+		device.Updated = updatedNow()
+		if err := store.PutDevice(device); err != nil {
+			fmt.Printf("Database write error: %v\n", err)
+			return 1
+		}
+	case "show":
+		timeline, err := deviceTimeline(store, params[0])
+		if err != nil {
+			fmt.Printf("Database read error: %v\n", err)
+			return 1
+		}
+		devices, err := store.Devices()
+		if err != nil {
+			fmt.Printf("Database read error: %v\n", err)
+			return 1
+		}
+		for _, d := range devices {
+			if d.Serial == params[0] {
+				fmt.Printf("Device %s  model:\"%s\" owner:\"%s\" location:\"%s\"\n", d.Serial, d.Model, d.Owner, d.Location)
+			}
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ATTACHED\tDETACHED\tBATTERY")
+		for _, a := range timeline {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", a.Attached, a.Detached, a.BatteryID)
+		}
+		w.Flush()
+	case "attach", "reassign":
+		err := attachBattery(store, params[0], params[1], *at, args[0] == "reassign")
+		if err == errNotFound {
+			fmt.Printf("Error: no readings of battery \"%s\"\n", params[0])
+			return 1
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+	case "detach":
+		if err := detachBattery(store, params[0], *at); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+	case "backfill":
+		batteries, err := store.ListBatteries(batteryFilter{})
+		if err != nil {
+			fmt.Printf("Database read error: %v\n", err)
+			return 1
+		}
+		total := 0
+		for _, b := range batteries {
+			added, err := backfillAttachments(store, b.ID)
+			if err != nil {
+				fmt.Printf("Error in %s: %v\n", b.ID, err)
+				return 1
+			}
+			total += added
+		}
+		fmt.Printf("%d attachment(s) created\n", total)
+	}
+	return 0
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"time"
 
@@ -51,7 +53,33 @@ func generateBarItems(dataset rrcBatteryData, dataswitch string) []opts.BarData
 	return barItems
 }
 
-func generateLineChart(dataset []rrcBatteryData, profile batteryProfile) *charts.Line {
+// noteMarkers places notes on the cycle line: notes on a reading at that
+// reading, other notes at the first reading taken after they were written.
+func noteMarkers(dataset []rrcBatteryData, notes []note) []opts.MarkPointNameCoordItem {
+	markers := make([]opts.MarkPointNameCoordItem, 0)
+	for _, n := range notes {
+		at := len(dataset) - 1
+		for i := range dataset {
+			if (n.Timestamp != "" && dataset[i].Timestamp == n.Timestamp) ||
+				(n.Timestamp == "" && dataset[i].Timestamp >= n.Created) {
+				at = i
+				break
+			}
+		}
+		label := noteLabel(n)
+		if runes := []rune(label); len(runes) > 40 {
+			label = string(runes[:37]) + "..."
+		}
+		markers = append(markers, opts.MarkPointNameCoordItem{
+			Name:       label,
+			Coordinate: []interface{}{at, dataset[at].CycleCount},
+			Label:      &opts.Label{Show: true, Position: "top", Formatter: "{b}"},
+		})
+	}
+	return markers
+}
+
+func generateLineChart(dataset []rrcBatteryData, profile batteryProfile, notes []note) *charts.Line {
 	line := charts.NewLine()
 	capacity := make([]opts.LineData, 0)
 	cycles := make([]opts.LineData, 0)
@@ -59,8 +87,7 @@ func generateLineChart(dataset []rrcBatteryData, profile batteryProfile) *charts
 	for cnt := range dataset {
 		capacity = append(capacity, opts.LineData{Value: dataset[cnt].FullCapacity, Name: fmt.Sprintf("%v", cnt), YAxisIndex: 1})
 		cycles = append(cycles, opts.LineData{Value: dataset[cnt].CycleCount, Name: fmt.Sprintf("%v", cnt)})
-		tsISO, _ := time.Parse(fmtDateTime, dataset[cnt].Timestamp)
-		timestamps = append(timestamps, tsISO.Format(fmtDateTimeISO))
+		timestamps = append(timestamps, chartTime(dataset[cnt].Timestamp))
 	}
 
 	timestamps = removeEmptyStrings(timestamps)
@@ -108,16 +135,256 @@ func generateLineChart(dataset []rrcBatteryData, profile batteryProfile) *charts
 	})
 
 	line.SetXAxis(timestamps).
-		AddSeries("Cycles", cycles, charts.WithLineChartOpts(opts.LineChart{ConnectNulls: true, Stack: "Date"})).
+		AddSeries("Cycles", cycles, charts.WithLineChartOpts(opts.LineChart{ConnectNulls: true, Stack: "Date"}),
+			charts.WithMarkPointNameCoordItemOpts(noteMarkers(dataset, notes)...),
+			charts.WithMarkPointStyleOpts(opts.MarkPointStyle{Symbol: []string{"pin"}, SymbolSize: 30})).
 		AddSeries("Capacity", capacity, charts.WithLineChartOpts(opts.LineChart{YAxisIndex: 1, ConnectNulls: true, Stack: "Date"})).
 		SetSeriesOptions(charts.WithLabelOpts(opts.Label{Show: false}))
 
 	return line
 }
 
-func generateGraphs(dataset rrcBatteryData) {
+// generateCellChart draws the cell voltages of a reading, in the status
+// colour when they are further apart than the profile allows.
+func generateCellChart(dataset rrcBatteryData, profile batteryProfile) *charts.Bar {
+	bar := charts.NewBar()
+	cells := cellVoltages(dataset)
+	names := make([]string, 0)
+	items := make([]opts.BarData, 0)
+	for i, mv := range cells {
+		names = append(names, fmt.Sprintf("Cell %d", i+1))
+		items = append(items, opts.BarData{Value: mv})
+	}
+	spread, _ := cellSpread(dataset)
+	subtitle := fmt.Sprintf("mV, %d mV apart", spread)
+	color := statusColor(statusGreen)
+	if profile.MaxCellSpread > 0 {
+		subtitle = fmt.Sprintf("%s, limit %d mV", subtitle, profile.MaxCellSpread)
+		if spread > profile.MaxCellSpread {
+			color = statusColor(statusRed)
+		}
+	}
+	lowest := 0
+	for _, mv := range cells {
+		if lowest == 0 || mv < lowest {
+			lowest = mv
+		}
+	}
+	bar.SetGlobalOptions(charts.WithTitleOpts(opts.Title{
+		Title:    "Cells",
+		Subtitle: subtitle,
+	}), charts.WithYAxisOpts(opts.YAxis{
+		Type:  "value",
+		Scale: true,
+		Min:   lowest - 100,
+	}), charts.WithInitializationOpts(opts.Initialization{
+		Width:  "600px",
+		Height: "400px",
+	}))
+	bar.SetXAxis(names).
+		AddSeries("Cells", items, charts.WithItemStyleOpts(opts.ItemStyle{
+			Color:   color,
+			Opacity: 0.6,
+		}), charts.WithLabelOpts(opts.Label{Show: true, Position: "top"}))
+	return bar
+}
 
-	BatteryProfile := readBatteryProfile(dataset.DevSerialNumber)
+// generateTemperatureChart draws the temperature of every reading with the
+// profile's temperature window.
+func generateTemperatureChart(dataset []rrcBatteryData, profile batteryProfile) *charts.Line {
+	line := charts.NewLine()
+	temperatures := make([]opts.LineData, 0)
+	timestamps := make([]string, 0)
+	for _, r := range dataset {
+		if r.TemperatureK <= 0 {
+			continue
+		}
+		temperatures = append(temperatures, opts.LineData{Value: r.TemperatureC})
+		timestamps = append(timestamps, chartTime(r.Timestamp))
+	}
+	limits := make([]opts.MarkLineNameYAxisItem, 0)
+	if profile.MinTemperature != nil {
+		limits = append(limits, opts.MarkLineNameYAxisItem{Name: "min", YAxis: *profile.MinTemperature})
+	}
+	if profile.MaxTemperature != nil {
+		limits = append(limits, opts.MarkLineNameYAxisItem{Name: "max", YAxis: *profile.MaxTemperature})
+	}
+	line.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: types.ThemeInfographic}),
+		charts.WithTitleOpts(opts.Title{
+			Title:    "Temperature",
+			Subtitle: "°C",
+		}),
+		charts.WithYAxisOpts(opts.YAxis{Name: "°C", Type: "value", Show: true, Scale: true}),
+		charts.WithXAxisOpts(opts.XAxis{Name: "Date", Show: true}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: true, Trigger: "axis"}),
+	)
+	line.SetXAxis(timestamps).
+		AddSeries("Temperature", temperatures,
+			charts.WithMarkLineNameYAxisItemOpts(limits...),
+			charts.WithLineStyleOpts(opts.LineStyle{Color: "#E07010"}))
+	return line
+}
+
+// generateSoHChart draws the stored state of health over time, by capacity
+// and by energy, over bands below the profile's warn level and limit.
+func generateSoHChart(dataset []rrcBatteryData, profile batteryProfile) *charts.Line {
+	line := charts.NewLine()
+	capacity := make([]opts.LineData, 0)
+	energy := make([]opts.LineData, 0)
+	limit := make([]opts.LineData, 0)
+	warn := make([]opts.LineData, 0)
+	timestamps := make([]string, 0)
+	limitLevel := math.Round(profile.MinCapacityFactor * 100)
+	warnLevel := math.Max(math.Round(profile.WarnCapacityFactor*100)-limitLevel, 0)
+	for _, r := range dataset {
+		if r.SoH <= 0 {
+			continue
+		}
+		capacity = append(capacity, opts.LineData{Value: r.SoH})
+		energy = append(energy, opts.LineData{Value: r.EnergySoH})
+		limit = append(limit, opts.LineData{Value: limitLevel, Symbol: "none"})
+		warn = append(warn, opts.LineData{Value: warnLevel, Symbol: "none"})
+		timestamps = append(timestamps, chartTime(r.Timestamp))
+	}
+	line.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: types.ThemeInfographic}),
+		charts.WithTitleOpts(opts.Title{
+			Title:    "State of health",
+			Subtitle: "% of design capacity and design energy",
+		}),
+		charts.WithYAxisOpts(opts.YAxis{Name: "%", Type: "value", Show: true}),
+		charts.WithXAxisOpts(opts.XAxis{Name: "Date", Show: true}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: true, Trigger: "axis"}),
+		charts.WithLegendOpts(opts.Legend{Show: true, Top: "bottom"}),
+	)
+	line.SetXAxis(timestamps).
+		AddSeries("Capacity SoH", capacity, charts.WithLineStyleOpts(opts.LineStyle{Color: "#1060E0", Width: 2})).
+		AddSeries("Energy SoH", energy, charts.WithLineStyleOpts(opts.LineStyle{Color: "#10A040"}))
+	if limitLevel > 0 {
+		line.AddSeries("Limit", limit, charts.WithLineChartOpts(opts.LineChart{Stack: "bands"}),
+			charts.WithLineStyleOpts(opts.LineStyle{Color: "#E01010", Type: "dashed"}),
+			charts.WithAreaStyleOpts(opts.AreaStyle{Color: "#E01010", Opacity: 0.15}))
+	}
+	if warnLevel > 0 {
+		line.AddSeries("Warn", warn, charts.WithLineChartOpts(opts.LineChart{Stack: "bands"}),
+			charts.WithLineStyleOpts(opts.LineStyle{Color: "#E0C010", Type: "dashed"}),
+			charts.WithAreaStyleOpts(opts.AreaStyle{Color: "#E0C010", Opacity: 0.15}))
+	}
+	return line
+}
+
+// generateForecastChart draws the measured capacity over the cycle count,
+// the fitted fade projected to the end of life and its 95% band, with the
+// capacity and cycle limits as lines.
+func generateForecastChart(dataset []rrcBatteryData, forecast fadeForecast) *charts.Line {
+	line := charts.NewLine()
+	measured := make([]opts.LineData, 0)
+	for _, r := range dataset {
+		if r.FullCapacity > 0 {
+			measured = append(measured, opts.LineData{Value: []interface{}{r.CycleCount, r.FullCapacity}})
+		}
+	}
+	end := math.Max(math.Max(forecast.EndCycles, forecast.Latest), forecast.LastCycles)
+	if forecast.EndCycles == 0 {
+		end = forecast.LastCycles*1.5 + 100
+	}
+	projected := make([]opts.LineData, 0)
+	low := make([]opts.LineData, 0)
+	band := make([]opts.LineData, 0)
+	const steps = 50
+	for i := 0; i <= steps; i++ {
+		x := forecast.FirstCycles + (end-forecast.FirstCycles)*float64(i)/steps
+		y, margin := forecast.Curve.Predict(x)
+		x = math.Round(x)
+		projected = append(projected, opts.LineData{Value: []interface{}{x, math.Round(y)}, Symbol: "none"})
+		low = append(low, opts.LineData{Value: []interface{}{x, math.Round(y - margin)}, Symbol: "none"})
+		band = append(band, opts.LineData{Value: []interface{}{x, math.Round(2 * margin)}, Symbol: "none"})
+	}
+	subtitle := forecast.String()
+	if forecast.CyclesPerDay > 0 {
+		subtitle = fmt.Sprintf("%s\n%.2f cycles a day, %s fade model", subtitle, forecast.CyclesPerDay, forecast.Model)
+	}
+	line.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: types.ThemeInfographic}),
+		charts.WithTitleOpts(opts.Title{
+			Title:    "Capacity forecast",
+			Subtitle: subtitle,
+		}),
+		charts.WithXAxisOpts(opts.XAxis{Name: "Cycles", Type: "value", Show: true, Scale: true}),
+		charts.WithYAxisOpts(opts.YAxis{Name: "mAh", Type: "value", Show: true, Scale: true}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: true, Trigger: "item"}),
+		charts.WithLegendOpts(opts.Legend{Show: true, Top: "bottom"}),
+	)
+	limits := make([]opts.MarkLineNameYAxisItem, 0)
+	if forecast.CapacityLimit > 0 {
+		limits = append(limits, opts.MarkLineNameYAxisItem{Name: "capacity limit", YAxis: math.Round(forecast.CapacityLimit)})
+	}
+	cycleLimits := make([]opts.MarkLineNameXAxisItem, 0)
+	if forecast.MaxCycles > 0 {
+		cycleLimits = append(cycleLimits, opts.MarkLineNameXAxisItem{Name: "cycle limit", XAxis: forecast.MaxCycles})
+	}
+	bandStyle := opts.LineStyle{Color: "#E07010", Type: "dashed", Opacity: 0.5}
+	line.AddSeries("Measured", measured, charts.WithLineStyleOpts(opts.LineStyle{Color: "#1060E0"})).
+		AddSeries("Projected", projected,
+			charts.WithLineStyleOpts(opts.LineStyle{Color: "#E07010", Width: 2}),
+			charts.WithMarkLineNameYAxisItemOpts(limits...),
+			charts.WithMarkLineNameXAxisItemOpts(cycleLimits...)).
+		AddSeries("95% band", low, charts.WithLineChartOpts(opts.LineChart{Stack: "band"}), charts.WithLineStyleOpts(bandStyle)).
+		AddSeries("95% band ", band, charts.WithLineChartOpts(opts.LineChart{Stack: "band"}), charts.WithLineStyleOpts(bandStyle),
+			charts.WithAreaStyleOpts(opts.AreaStyle{Color: "#E07010", Opacity: 0.15}))
+	return line
+}
+
+// generateDeviceTimeline draws one bar per battery a device has held,
+// from the time it was attached until it was detached.
+func generateDeviceTimeline(device deviceRecord, timeline []attachment) *charts.Line {
+	line := charts.NewLine()
+	batteries := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, a := range timeline {
+		if !seen[a.BatteryID] {
+			seen[a.BatteryID] = true
+			batteries = append(batteries, a.BatteryID)
+		}
+	}
+	subtitle := fmt.Sprintf("%d battery swap(s)", len(timeline))
+	if device.Model != "" || device.Owner != "" || device.Location != "" {
+		subtitle = fmt.Sprintf("%s, model:%s owner:%s location:%s", subtitle, device.Model, device.Owner, device.Location)
+	}
+	line.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: types.ThemeInfographic, Height: fmt.Sprintf("%dpx", 160+40*len(batteries))}),
+		charts.WithTitleOpts(opts.Title{
+			Title:    fmt.Sprintf("Device %s", device.Serial),
+			Subtitle: subtitle,
+		}),
+		charts.WithXAxisOpts(opts.XAxis{Name: "Date", Type: "time", Show: true}),
+		charts.WithYAxisOpts(opts.YAxis{Type: "category", Data: batteries, Show: true}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: true, Trigger: "item"}),
+	)
+	now := formatTimestamp(time.Now())
+	for _, a := range timeline {
+		detached := a.Detached
+		if detached == "" {
+			detached = now
+		}
+		line.AddSeries(a.BatteryID, []opts.LineData{
+			{Name: "attached", Value: []interface{}{chartTime(a.Attached), a.BatteryID}},
+			{Name: "detached", Value: []interface{}{chartTime(detached), a.BatteryID}},
+		}, charts.WithLineStyleOpts(opts.LineStyle{Width: 12}))
+	}
+	return line
+}
+
+// batteryReport is the file name of a battery's report, as generateGraphs
+// saves it and the fleet overview links to it.
+func batteryReport(devSerial, serial string) string {
+	return fmt.Sprintf("%s-%s.html", devSerial, stripValues(serial))
+}
+
+func generateGraphs(store Store, genConfig generalConfiguration, dataset rrcBatteryData) {
+
+	BatteryProfile := readBatteryProfile(dataset)
 	batMaxCapacity := int(float64(dataset.DesignCapacity) * float64(1.2))
 	batMaxVoltage := dataset.DesignVoltage
 	batMinCapacity := int(float64(dataset.DesignCapacity) * BatteryProfile.MinCapacityFactor)
@@ -128,7 +395,7 @@ func generateGraphs(dataset rrcBatteryData) {
 	chargingCurrentString := fmt.Sprintf("Charging current: %dmA", dataset.ChargingCurrent)
 	//absoluteChargeString := fmt.Sprintf("Absolute charge: %d mA", dataset.AbsoluteCharge)
 	fullCapacityString := fmt.Sprintf("Full capacity: %dmAh", dataset.FullCapacity)
-	batMinVoltage := 0
+	batMinVoltage := BatteryProfile.MinVoltage
 
 	capbar := charts.NewBar()
 	curbar := charts.NewBar()
@@ -156,9 +423,13 @@ func generateGraphs(dataset rrcBatteryData) {
 	}), charts.WithLiquidChartOpts(opts.LiquidChart{
 		IsWaveAnimation: true,
 	}))
+	capacityColor := "#10F010"
+	if dataset.Health.Status != "" {
+		capacityColor = statusColor(dataset.Health.Status)
+	}
 	capbar.SetXAxis([]string{fullCapacityString, remCapacityString}).
 		AddSeries("Capacity", generateBarItems(dataset, "Capacity"), charts.WithItemStyleOpts(opts.ItemStyle{
-			Color:   "#10F010",
+			Color:   capacityColor,
 			Color0:  "#F01010",
 			Opacity: 0.6,
 		}))
@@ -230,26 +501,98 @@ func generateGraphs(dataset rrcBatteryData) {
 		Position: "insideTop",
 	}))
 
-	datasetAll, retCode := dbhandler("read", dbDir, dataset)
-	if retCode != 0 {
-		fmt.Printf("Error reading data for histogram!\n")
+	datasetAll, err := store.Readings(batteryKey(dataset))
+	if err != nil {
+		fmt.Printf("Error reading data for histogram: %v\n", err)
+		datasetAll = []rrcBatteryData{dataset}
+	}
+	devices := []string{}
+	if hasDevice(dataset.DevSerialNumber) {
+		devices = append(devices, dataset.DevSerialNumber)
+	}
+	notes, err := store.Notes()
+	if err != nil {
+		fmt.Printf("Error reading notes: %v\n", err)
+	}
+	histogram := generateLineChart(datasetAll, BatteryProfile, notesFor(notes, batteryKey(dataset), devices, ""))
+	temperature := generateTemperatureChart(datasetAll, BatteryProfile)
+	soh := generateSoHChart(datasetAll, BatteryProfile)
+	var forecastChart *charts.Line
+	forecast, forecastErr := forecastFade(datasetAll, BatteryProfile, genConfig.FadeModel)
+	if forecastErr != nil {
+		fmt.Printf("No capacity forecast: %v\n", forecastErr)
+	} else {
+		forecastChart = generateForecastChart(datasetAll, forecast)
+		forecastChart.Title.Left = "center"
+	}
+	var cells *charts.Bar
+	if len(cellVoltages(dataset)) > 0 {
+		cells = generateCellChart(dataset, BatteryProfile)
+		cells.Title.Left = "center"
+	}
+	var timeline *charts.Line
+	if hasDevice(dataset.DevSerialNumber) {
+		attachments, err := deviceTimeline(store, dataset.DevSerialNumber)
+		if err != nil {
+			fmt.Printf("Error reading device timeline: %v\n", err)
+		}
+		if len(attachments) > 0 {
+			device := deviceRecord{Serial: dataset.DevSerialNumber}
+			if devices, err := store.Devices(); err == nil {
+				for _, d := range devices {
+					if d.Serial == device.Serial {
+						device = d
+					}
+				}
+			}
+			timeline = generateDeviceTimeline(device, attachments)
+			timeline.Title.Left = "center"
+		}
 	}
-	histogram := generateLineChart(datasetAll, BatteryProfile)
 	relcgauge.Title.Left = "center"
 	volgauge.Title.Left = "center"
 	capbar.Title.Left = "center"
 	curbar.Title.Left = "center"
 	histogram.Title.Left = "center"
+	temperature.Title.Left = "center"
+	soh.Title.Left = "center"
+	if dataset.Health.Status != "" {
+		histogram.Title.TitleStyle = &opts.TextStyle{Color: statusColor(dataset.Health.Status)}
+		histogram.Title.Subtitle = fmt.Sprintf("%s\n%s", histogram.Title.Subtitle, healthSummary(dataset.Health))
+	}
 
 	page := components.NewPage()
 	page.SetLayout(components.PageCenterLayout)
 	page.PageTitle = fmt.Sprintf("Battery %s", dataset.Name+dataset.SerialNumber)
 	//page.BackgroundColor = "#010101"
 	//page.Theme = "white"
-	page.AddCharts(histogram, relcgauge, volgauge, capbar, curbar)
+	page.AddCharts(histogram, soh)
+	if forecastChart != nil {
+		page.AddCharts(forecastChart)
+	}
+	if timeline != nil {
+		page.AddCharts(timeline)
+	}
+	page.AddCharts(temperature, relcgauge, volgauge, capbar, curbar)
+	if cells != nil {
+		page.AddCharts(cells)
+	}
 
-	saveAs := fmt.Sprintf("%s/%s-%s.html", htmlDir, dataset.DevSerialNumber, stripValues(dataset.SerialNumber))
+	saveAs := fmt.Sprintf("%s/%s", htmlDir, batteryReport(dataset.DevSerialNumber, dataset.SerialNumber))
 	f, _ := os.Create(saveAs)
-	page.Render(f)
+	card := newSummaryCard(dataset, BatteryProfile, assetDirectory(genConfig))
+	if forecastErr == nil {
+		card.Rows = append(card.Rows, [2]string{"Forecast", forecast.String()})
+	}
+	if models, err := loadBatteryModels(); err != nil {
+		fmt.Printf("Error reading \"%s\": %v\n", batteryModelsFile, err)
+	} else if model, ok := findModel(models, dataset); ok {
+		card.Model = describeModel(model)
+		card.Warnings = modelWarnings(models, datasetAll)
+	}
+	if err := renderWithHeader(f, func(w io.Writer) error { return page.Render(w) }, card); err != nil {
+		fmt.Printf("Error writing \"%s\": %v\n", saveAs, err)
+	}
+	f.Close()
 	launchViewer(saveAs)
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNoteMarkersTruncateRunes(t *testing.T) {
+	dataset := []rrcBatteryData{testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20)}
+	text := strings.Repeat("ä", 45)
+	markers := noteMarkers(dataset, []note{{ID: "n1", Timestamp: "2021-01-15T12:30:00Z", Text: text}})
+	if len(markers) != 1 {
+		t.Fatalf("%d markers, want 1", len(markers))
+	}
+	label := markers[0].Name
+	if !utf8.ValidString(label) || !strings.HasSuffix(label, "...") || utf8.RuneCountInString(label) != 40 {
+		t.Errorf("label %q, want 37 runes and \"...\"", label)
+	}
+}
+
+func TestBatteryReport(t *testing.T) {
+	if got := batteryReport("1234.5678", "#0042"); got != "1234.5678-0042.html" {
+		t.Errorf("batteryReport = %q, want \"1234.5678-0042.html\"", got)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// updatedNow returns the change time stored with devices and attachments.
+// Sync keeps the newest version, so it is recorded with sub-second
+// resolution in a sortable form.
+func updatedNow() string {
+	return time.Now().UTC().Format(fmtUpdated)
+}
+
+func sortAttachments(attachments []attachment) {
+	sort.SliceStable(attachments, func(i, j int) bool {
+		return attachments[i].Attached < attachments[j].Attached
+	})
+}
+
+// currentAttachment returns the attachment that has not been detached yet.
+func currentAttachment(attachments []attachment) (attachment, bool) {
+	for i := len(attachments) - 1; i >= 0; i-- {
+		if attachments[i].Detached == "" && !attachments[i].Removed {
+			return attachments[i], true
+		}
+	}
+	return attachment{}, false
+}
+
+// deviceAt returns the device a battery was in at the given time.
+func deviceAt(attachments []attachment, timestamp string) string {
+	for _, a := range attachments {
+		if !a.Removed && a.Attached <= timestamp && (a.Detached == "" || timestamp < a.Detached) {
+			return a.DeviceSerial
+		}
+	}
+	return ""
+}
+
+// registerDevice makes sure a device is in the registry.
+func registerDevice(store Store, serial string) error {
+	devices, err := store.Devices()
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		if d.Serial == serial {
+			return nil
+		}
+	}
+	return store.PutDevice(deviceRecord{Serial: serial, Updated: updatedNow()})
+}
+
+// checkSwapTime rejects a swap at or before the current attachment, or
+// before the battery left an earlier device, which would overlap the
+// history.
+func checkSwapTime(attachments []attachment, when string) error {
+	for _, a := range liveAttachments(attachments) {
+		if a.Detached == "" && when <= a.Attached {
+			return fmt.Errorf("%s is not after %s, when the battery was put in device \"%s\"", when, a.Attached, a.DeviceSerial)
+		}
+		if a.Detached != "" && when < a.Detached {
+			return fmt.Errorf("%s is before %s, when the battery left device \"%s\"", when, a.Detached, a.DeviceSerial)
+		}
+	}
+	return nil
+}
+
+// attachBattery puts a battery in a device at the given time. A battery
+// that is still in another device is only moved when reassign is set.
+// Batteries without readings are errNotFound.
+func attachBattery(store Store, batteryID, devSerial, when string, reassign bool) error {
+	if !hasDevice(devSerial) {
+		return fmt.Errorf("no device serial given")
+	}
+	if _, err := store.Readings(batteryID); err != nil {
+		return err
+	}
+	attachments, err := store.Attachments(batteryID)
+	if err != nil {
+		return err
+	}
+	current, attached := currentAttachment(attachments)
+	if attached && current.DeviceSerial == devSerial {
+		return nil
+	}
+	if attached && !reassign {
+		return fmt.Errorf("%s is attached to device \"%s\" since %s, reassign it instead", batteryID, current.DeviceSerial, current.Attached)
+	}
+	if err := checkSwapTime(attachments, when); err != nil {
+		return err
+	}
+	if attached {
+		current.Detached = when
+		current.Updated = updatedNow()
+		if err := store.PutAttachment(current); err != nil {
+			return err
+		}
+	}
+	if err := registerDevice(store, devSerial); err != nil {
+		return err
+	}
+	return store.PutAttachment(attachment{
+		BatteryID:    batteryID,
+		DeviceSerial: devSerial,
+		Attached:     when,
+		Updated:      updatedNow(),
+	})
+}
+
+// detachBattery takes a battery out of its device.
+func detachBattery(store Store, batteryID, when string) error {
+	attachments, err := store.Attachments(batteryID)
+	if err != nil {
+		return err
+	}
+	current, ok := currentAttachment(attachments)
+	if !ok {
+		return fmt.Errorf("%s is not attached to a device", batteryID)
+	}
+	if err := checkSwapTime(attachments, when); err != nil {
+		return err
+	}
+	current.Detached = when
+	current.Updated = updatedNow()
+	return store.PutAttachment(current)
+}
+
+// backfillAttachments builds the attachment history of a battery recorded
+// before the device registry existed, from the device serials stored with
+// its readings. Batteries that already have a history are left alone.
+func backfillAttachments(store Store, batteryID string) (int, error) {
+	attachments, err := store.Attachments(batteryID)
+	if err != nil || len(liveAttachments(attachments)) > 0 {
+		return 0, err
+	}
+	readings, err := store.Readings(batteryID)
+	if err != nil {
+		return 0, err
+	}
+	added := 0
+	current := ""
+	for _, r := range readings {
+		if !hasDevice(r.DevSerialNumber) || r.DevSerialNumber == current {
+			continue
+		}
+		if err := attachBattery(store, batteryID, r.DevSerialNumber, r.Timestamp, true); err != nil {
+			return added, err
+		}
+		current = r.DevSerialNumber
+		added++
+	}
+	return added, nil
+}
+
+// deviceTimeline returns every attachment of a device, oldest first.
+func deviceTimeline(store Store, devSerial string) ([]attachment, error) {
+	all, err := store.Attachments("")
+	if err != nil {
+		return nil, err
+	}
+	timeline := []attachment{}
+	for _, a := range liveAttachments(all) {
+		if a.DeviceSerial == devSerial {
+			timeline = append(timeline, a)
+		}
+	}
+	return timeline, nil
+}
+
+// liveAttachments leaves out the removed attachments.
+func liveAttachments(attachments []attachment) []attachment {
+	live := []attachment{}
+	for _, a := range attachments {
+		if !a.Removed {
+			live = append(live, a)
+		}
+	}
+	return live
+}
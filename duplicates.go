@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultDuplicateWindow is how close two readouts of a battery without a
+// cycle in between must be to count as the same readout taken twice.
+const defaultDuplicateWindow = "6h"
+
+const (
+	duplicateReplace = "Replace the earlier reading"
+	duplicateKeep    = "Keep both"
+	duplicateSkip    = "Skip this reading"
+)
+
+// duplicateWindow returns the configured window, 0 when detection is off.
+func duplicateWindow(genConfig generalConfiguration) (time.Duration, error) {
+	window := genConfig.DuplicateWindow
+	if window == "" {
+		window = defaultDuplicateWindow
+	}
+	if window == "0" {
+		return 0, nil
+	}
+	d, err := parseAge(window)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duplicate window must not be negative, got \"%s\"", window)
+	}
+	return d, nil
+}
+
+// isDuplicate reports whether two readouts of the same battery are within
+// window of each other with no cycle in between. Monitoring samples and
+// their aggregates are expected to be close and are never duplicates.
+func isDuplicate(a, b rrcBatteryData, window time.Duration) bool {
+	if window <= 0 || a.Sample || b.Sample || a.CycleCount != b.CycleCount {
+		return false
+	}
+	ta, err := parseTimestamp(a.Timestamp)
+	if err != nil {
+		return false
+	}
+	tb, err := parseTimestamp(b.Timestamp)
+	if err != nil {
+		return false
+	}
+	diff := ta.Sub(tb)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= window
+}
+
+// findDuplicate returns the newest reading in history that reading
+// duplicates.
+func findDuplicate(history []rrcBatteryData, reading rrcBatteryData, window time.Duration) (rrcBatteryData, bool) {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Timestamp != reading.Timestamp && isDuplicate(history[i], reading, window) {
+			return history[i], true
+		}
+	}
+	return rrcBatteryData{}, false
+}
+
+// duplicateGroups returns the runs of readouts in a sorted history that
+// each duplicate the first of the run. Comparing with the first keeps a
+// chain of readouts a few hours apart from growing into one group that
+// spans far more than the window.
+func duplicateGroups(history []rrcBatteryData, window time.Duration) [][]rrcBatteryData {
+	groups := [][]rrcBatteryData{}
+	var group []rrcBatteryData
+	for _, r := range history {
+		if r.Sample {
+			continue
+		}
+		if len(group) > 0 && isDuplicate(group[0], r, window) {
+			group = append(group, r)
+			continue
+		}
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+		group = []rrcBatteryData{r}
+	}
+	if len(group) > 1 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// replaceReading removes an earlier reading that a new one duplicates,
+// moving its notes to the new reading.
+func replaceReading(store Store, earlier, reading rrcBatteryData) error {
+	batteryID := batteryKey(reading)
+	if err := store.Delete(batteryID, earlier.Timestamp); err != nil {
+		return err
+	}
+	return moveNotes(store, batteryID, earlier.Timestamp, reading.Timestamp)
+}
+
+type dedupeReport struct {
+	Batteries int
+	Groups    int
+	Removed   int
+	Lines     []string
+}
+
+func (r dedupeReport) String() string {
+	var b strings.Builder
+	for _, l := range r.Lines {
+		fmt.Fprintf(&b, "%s\n", l)
+	}
+	fmt.Fprintf(&b, "%d battery(s): %d group(s) of duplicate readings, %d reading(s) removed\n", r.Batteries, r.Groups, r.Removed)
+	return b.String()
+}
+
+// dedupeStore removes the near-duplicate readings of every battery, keeping
+// the newest (or oldest) reading of each group and moving the notes of the
+// removed ones to it.
+func dedupeStore(store Store, window time.Duration, keepOldest, dryRun bool) (dedupeReport, error) {
+	var report dedupeReport
+	batteries, err := store.ListBatteries(batteryFilter{})
+	if err != nil {
+		return report, err
+	}
+	for _, b := range batteries {
+		readings, err := store.Readings(b.ID)
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			return report, fmt.Errorf("reading \"%s\": %w", b.ID, err)
+		}
+		groups := duplicateGroups(readings, window)
+		if len(groups) == 0 {
+			continue
+		}
+		report.Batteries++
+		for _, group := range groups {
+			keep := group[len(group)-1]
+			if keepOldest {
+				keep = group[0]
+			}
+			report.Groups++
+			for _, r := range group {
+				if r.Timestamp == keep.Timestamp {
+					continue
+				}
+				report.Removed++
+				report.Lines = append(report.Lines, fmt.Sprintf("%s: %s duplicates %s (%d cycles)", b.ID, r.Timestamp, keep.Timestamp, r.CycleCount))
+				if dryRun {
+					continue
+				}
+				if err := store.Delete(b.ID, r.Timestamp); err != nil {
+					return report, err
+				}
+				if err := moveNotes(store, b.ID, r.Timestamp, keep.Timestamp); err != nil {
+					return report, err
+				}
+			}
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDuplicateGroups(t *testing.T) {
+	useUTC(t)
+	history := []rrcBatteryData{
+		testReading("RRC2040-2", "#1", "2021-01-15T08:00:00Z", 20),
+		testReading("RRC2040-2", "#1", "2021-01-15T12:00:00Z", 20),
+		testReading("RRC2040-2", "#1", "2021-01-15T16:00:00Z", 20),
+		testReading("RRC2040-2", "#1", "2021-01-15T20:00:00Z", 20),
+		testReading("RRC2040-2", "#1", "2021-01-16T09:00:00Z", 21),
+	}
+	groups := duplicateGroups(history, 6*time.Hour)
+	got := [][]string{}
+	for _, g := range groups {
+		got = append(got, timestampsOf(g))
+	}
+	// Each readout is within the window of the one before, but the third
+	// is 8 hours after the first and starts a new group.
+	want := [][]string{
+		{"2021-01-15T08:00:00Z", "2021-01-15T12:00:00Z"},
+		{"2021-01-15T16:00:00Z", "2021-01-15T20:00:00Z"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("groups: got %v, want %v", got, want)
+	}
+}
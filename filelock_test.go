@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockFileExcludes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.lock")
+	first, err := lockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan *fileLock)
+	go func() {
+		second, err := lockFile(path)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- second
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("second lock taken while the first is held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case second := <-acquired:
+		if second != nil {
+			second.Unlock()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second lock not taken after the first was released")
+	}
+}
+
+func TestAtomicWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "record.json")
+	for _, content := range []string{"first", "second"} {
+		if err := atomicWriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := os.ReadFile(path); err != nil || string(data) != content {
+			t.Errorf("read %q, %v, want %q", data, err, content)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("directory holds %d entries, %v, want only the file", len(entries), err)
+	}
+}
+
+// Two processes sharing a JSON store are two stores on one directory. Their
+// writes to the same battery's attachment history must not get lost, and no
+// temporary or partial file may be left.
+func TestScribbleStoreConcurrentWriters(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	const writes = 20
+	var wg sync.WaitGroup
+	for w := 0; w < 2; w++ {
+		store, err := openScribbleStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(w int, store *scribbleStore) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				ts := fmt.Sprintf("2021-01-15T12:%02d:%02dZ", w, i)
+				if err := store.Append(testReading("RRC2040-2", "#1", ts, 20)); err != nil {
+					t.Error(err)
+					return
+				}
+				a := attachment{BatteryID: "RRC2040-2#1", DeviceSerial: fmt.Sprintf("1234.%d", w), Attached: ts, Updated: updatedNow()}
+				if err := store.PutAttachment(a); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w, store)
+	}
+	wg.Wait()
+
+	store, err := openScribbleStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readings, err := store.Readings("RRC2040-2#1"); err != nil || len(readings) != 2*writes {
+		t.Errorf("%d readings, %v, want %d", len(readings), err, 2*writes)
+	}
+	if attachments, err := store.Attachments("RRC2040-2#1"); err != nil || len(attachments) != 2*writes {
+		t.Errorf("%d attachments, %v, want %d", len(attachments), err, 2*writes)
+	}
+	err = filepath.Walk(filepath.Dir(dir), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if strings.Contains(info.Name(), ".tmp") {
+			t.Errorf("temporary file \"%s\" left behind", path)
+		}
+		if strings.HasSuffix(path, ".json") {
+			if data, err := os.ReadFile(path); err != nil || !json.Valid(data) {
+				t.Errorf("\"%s\" is not a complete record (%v)", path, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
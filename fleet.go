@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/components"
+	"github.com/go-echarts/go-echarts/v2/opts"
+	"github.com/go-echarts/go-echarts/v2/types"
+)
+
+const fleetReport = "fleet.html"
+
+// fleetRow is one battery on the fleet dashboard.
+type fleetRow struct {
+	queryRow
+	Replacement string // expected replacement date, "" when unknown
+	CyclesLeft  string // cycles to the end of life, "" when unknown
+	Report      string // file name of the battery's report in htmlDir, "" if none was generated
+}
+
+// fleetOverview is what the fleet dashboard shows.
+type fleetOverview struct {
+	Generated    string
+	Rows         []fleetRow
+	Statuses     []fleetCount
+	Retiring     []fleetRow // replacement due within RetireMonths, soonest first
+	Stale        []fleetRow // not seen for StaleMonths, longest first
+	RetireMonths int
+	StaleMonths  int
+}
+
+// fleetCount is the number of batteries with a health status.
+type fleetCount struct {
+	Status string
+	Color  string
+	Count  int
+}
+
+// buildFleetOverview rates and forecasts every battery in the store.
+func buildFleetOverview(store Store, profiles []batteryProfile, fadeModel string, retireMonths, staleMonths int, now time.Time) (fleetOverview, error) {
+	overview := fleetOverview{Generated: now.Format(fmtDateTimeISO), RetireMonths: retireMonths, StaleMonths: staleMonths}
+	rows, err := runQuery(store, batteryQuery{MaxCycles: -1, MaxSoH: -1}, profiles)
+	if err != nil {
+		return overview, err
+	}
+	forecasts, err := forecastStore(store, profiles, fadeModel, "")
+	if err != nil {
+		return overview, err
+	}
+	byID := make(map[string]fadeForecast)
+	for _, f := range forecasts {
+		if f.Err == nil {
+			byID[f.ID] = f.Forecast
+		}
+	}
+	counts := make(map[string]int)
+	retireBy := now.AddDate(0, retireMonths, 0).Format(fmtDateTimeISO)
+	staleBefore := now.AddDate(0, -staleMonths, 0)
+	for _, r := range rows {
+		row := fleetRow{queryRow: r}
+		if f, ok := byID[r.ID]; ok {
+			row.Replacement = f.Replacement()
+			if f.EndCycles > 0 {
+				row.CyclesLeft = fmt.Sprintf("%.0f", math.Max(f.EndCycles-f.LastCycles, 0))
+			}
+		}
+		report := batteryReport(r.DevSerialNumber, r.SerialNumber)
+		if _, err := os.Stat(filepath.Join(htmlDir, report)); err == nil {
+			row.Report = report
+		}
+		counts[r.Status]++
+		overview.Rows = append(overview.Rows, row)
+		if row.Replacement != "" && row.Replacement <= retireBy {
+			overview.Retiring = append(overview.Retiring, row)
+		}
+		if seen, err := parseTimestamp(r.LastSeen); err == nil && seen.Before(staleBefore) {
+			overview.Stale = append(overview.Stale, row)
+		}
+	}
+	for _, status := range []string{statusGreen, statusYellow, statusRed, ""} {
+		name := status
+		if name == "" {
+			name = "unrated"
+		}
+		overview.Statuses = append(overview.Statuses, fleetCount{Status: name, Color: statusColor(status), Count: counts[status]})
+	}
+	sort.SliceStable(overview.Retiring, func(i, j int) bool {
+		return overview.Retiring[i].Replacement < overview.Retiring[j].Replacement
+	})
+	sort.SliceStable(overview.Stale, func(i, j int) bool {
+		return overview.Stale[i].LastSeen < overview.Stale[j].LastSeen
+	})
+	return overview, nil
+}
+
+// sohBuckets are the lower bounds of the SoH distribution bars in %.
+var sohBuckets = []float64{0, 50, 60, 70, 80, 90, 100}
+
+// generateSoHDistribution counts the batteries per SoH range.
+func generateSoHDistribution(rows []fleetRow) *charts.Bar {
+	bar := charts.NewBar()
+	labels := make([]string, len(sohBuckets))
+	counts := make([]int, len(sohBuckets))
+	for i, low := range sohBuckets {
+		switch {
+		case i == 0:
+			labels[i] = fmt.Sprintf("< %.0f%%", sohBuckets[1])
+		case i == len(sohBuckets)-1:
+			labels[i] = fmt.Sprintf("≥ %.0f%%", low)
+		default:
+			labels[i] = fmt.Sprintf("%.0f-%.0f%%", low, sohBuckets[i+1])
+		}
+	}
+	for _, r := range rows {
+		if r.SoH <= 0 {
+			continue
+		}
+		i := sort.SearchFloat64s(sohBuckets, r.SoH)
+		if i == len(sohBuckets) || sohBuckets[i] > r.SoH {
+			i--
+		}
+		counts[i]++
+	}
+	items := make([]opts.BarData, 0)
+	for _, c := range counts {
+		items = append(items, opts.BarData{Value: c})
+	}
+	bar.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: types.ThemeInfographic}),
+		charts.WithTitleOpts(opts.Title{Title: "State of health", Subtitle: "batteries by full capacity, % of design", Left: "center"}),
+		charts.WithYAxisOpts(opts.YAxis{Name: "Batteries", Type: "value", Show: true}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: true}),
+	)
+	bar.SetXAxis(labels).AddSeries("Batteries", items)
+	return bar
+}
+
+// generateStatusChart counts the batteries per health status.
+func generateStatusChart(statuses []fleetCount) *charts.Bar {
+	bar := charts.NewBar()
+	labels := make([]string, 0)
+	items := make([]opts.BarData, 0)
+	for _, s := range statuses {
+		labels = append(labels, s.Status)
+		items = append(items, opts.BarData{Value: s.Count, ItemStyle: &opts.ItemStyle{Color: s.Color}})
+	}
+	bar.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: types.ThemeInfographic}),
+		charts.WithTitleOpts(opts.Title{Title: "Health", Subtitle: "batteries by status of the latest reading", Left: "center"}),
+		charts.WithYAxisOpts(opts.YAxis{Name: "Batteries", Type: "value", Show: true}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: true}),
+	)
+	bar.SetXAxis(labels).AddSeries("Batteries", items)
+	return bar
+}
+
+var fleetHeaderTemplate = template.Must(template.New("fleet").Parse(`
+<style>
+.fleet {max-width: 1100px; margin: 16px auto; font-family: sans-serif;}
+.fleet .counts {display: flex; gap: 16px;}
+.fleet .count {border: 1px solid #ccc; border-left: 8px solid; border-radius: 4px; padding: 4px 16px;}
+.fleet .count b {font-size: 1.6em; display: block;}
+.fleet table {border-collapse: collapse; margin-bottom: 16px;}
+.fleet th, .fleet td {padding: 2px 10px 2px 0; text-align: left;}
+.fleet th.sort {cursor: pointer;}
+.fleet .status {font-weight: bold;}
+</style>
+<div class="fleet">
+<h1>Fleet overview</h1>
+<p>{{len .Rows}} battery(s), generated {{.Generated}}</p>
+<div class="counts">
+{{range .Statuses}}<div class="count" style="border-left-color: {{.Color}}"><b>{{.Count}}</b>{{.Status}}</div>
+{{end}}</div>
+<h2>Nearing retirement</h2>
+{{with .Retiring}}<table>
+<tr><th>Battery</th><th>Device</th><th>Cycles</th><th>SoH</th><th>Cycles left</th><th>Replace by</th></tr>
+{{range .}}<tr><td>{{template "battery" .}}</td><td>{{.DevSerialNumber}}</td><td>{{.CycleCount}}</td><td>{{printf "%.1f%%" .SoH}}</td><td>{{.CyclesLeft}}</td><td>{{.Replacement}}</td></tr>
+{{end}}</table>{{else}}<p>No battery is expected to reach its limits within {{.RetireMonths}} months.</p>{{end}}
+<h2>Not seen for {{.StaleMonths}} months</h2>
+{{with .Stale}}<table>
+<tr><th>Battery</th><th>Device</th><th>Last seen</th></tr>
+{{range .}}<tr><td>{{template "battery" .}}</td><td>{{.DevSerialNumber}}</td><td>{{.LastSeen}}</td></tr>
+{{end}}</table>{{else}}<p>Every battery was read within {{.StaleMonths}} months.</p>{{end}}
+</div>
+{{define "battery"}}{{if .Report}}<a href="{{.Report}}">{{.ID}}</a>{{else}}{{.ID}}{{end}}{{end}}
+`))
+
+var fleetTableTemplate = template.Must(template.Must(fleetHeaderTemplate.Clone()).New("table").Parse(`
+<div class="fleet">
+<h2>Batteries</h2>
+<table id="batteries">
+<thead><tr><th class="sort">Battery</th><th class="sort">Chemistry</th><th class="sort">Device</th><th class="sort">Profile</th><th class="sort" data-type="number">Cycles</th><th class="sort" data-type="number">SoH %</th><th class="sort">Status</th><th class="sort">Replace by</th><th class="sort" data-type="number">Readings</th><th class="sort">Last seen</th></tr></thead>
+<tbody>
+{{range .Rows}}<tr><td>{{template "battery" .}}</td><td>{{.Chemistry}}</td><td>{{.DevSerialNumber}}</td><td>{{.Profile}}</td><td>{{.CycleCount}}</td><td>{{printf "%.1f" .SoH}}</td><td class="status" style="color: {{.Color}}">{{.Status}}</td><td>{{.Replacement}}</td><td>{{.Readings}}</td><td>{{.LastSeen}}</td></tr>
+{{end}}</tbody>
+</table>
+</div>
+<script>
+document.querySelectorAll("#batteries th.sort").forEach(function (th, column) {
+	th.addEventListener("click", function () {
+		var body = th.closest("table").tBodies[0];
+		var number = th.dataset.type === "number";
+		// Empty number cells sort below every number.
+		var value = function (text) {
+			var v = parseFloat(text);
+			return isNaN(v) ? -Infinity : v;
+		};
+		var ascending = th.dataset.order !== "asc";
+		th.dataset.order = ascending ? "asc" : "desc";
+		var rows = Array.prototype.slice.call(body.rows);
+		rows.sort(function (a, b) {
+			var x = a.cells[column].textContent, y = b.cells[column].textContent;
+			var order = x.localeCompare(y);
+			if (number) {
+				x = value(x);
+				y = value(y);
+				order = x < y ? -1 : x > y ? 1 : 0;
+			}
+			return ascending ? order : -order;
+		});
+		rows.forEach(function (row) { body.appendChild(row); });
+	});
+});
+</script>
+`))
+
+// Color is the colour of the row's health status.
+func (r fleetRow) Color() string {
+	return statusColor(r.Status)
+}
+
+// renderFleetOverview writes the dashboard: counts and lists at the top,
+// the charts, and the sortable table of every battery at the bottom.
+func renderFleetOverview(out io.Writer, overview fleetOverview) error {
+	page := components.NewPage()
+	page.SetLayout(components.PageCenterLayout)
+	page.PageTitle = "Fleet overview"
+	page.AddCharts(generateStatusChart(overview.Statuses), generateSoHDistribution(overview.Rows))
+	var header, footer bytes.Buffer
+	if err := fleetHeaderTemplate.Execute(&header, overview); err != nil {
+		return err
+	}
+	if err := fleetTableTemplate.ExecuteTemplate(&footer, "table", overview); err != nil {
+		return err
+	}
+	return renderWithHTML(out, func(w io.Writer) error { return page.Render(w) }, header.Bytes(), footer.Bytes())
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const defaultFadeModel = "linear"
+
+// forecastHorizon is how many cycles past the last reading a forecast
+// looks for the end of life.
+const forecastHorizon = 20000
+
+// fadeModel fits FullCapacity over the cycle count of a battery. Models are
+// registered in fadeModels and chosen with "fademodel" in the configuration.
+type fadeModel interface {
+	Fit(cycles, capacity []float64) (fadeCurve, error)
+}
+
+// fadeCurve is a fitted model: the expected capacity at a cycle count and
+// the half width of its 95% prediction band there.
+type fadeCurve interface {
+	Predict(cycles float64) (capacity, margin float64)
+}
+
+var fadeModels = map[string]fadeModel{
+	"linear": linearFade{},
+}
+
+// linearFade fits a straight line by least squares.
+type linearFade struct{}
+
+type lineFit struct {
+	Intercept float64
+	Slope     float64
+	n         int
+	meanX     float64
+	sxx       float64 // sum of squared deviations of x
+	residual  float64 // standard deviation of the residuals
+}
+
+// fitLine fits y = Intercept + Slope*x. It needs two different x values.
+func fitLine(xs, ys []float64) (lineFit, error) {
+	f := lineFit{n: len(xs)}
+	if f.n < 2 {
+		return f, fmt.Errorf("%d point(s), need at least 2", f.n)
+	}
+	var meanY float64
+	for i := range xs {
+		f.meanX += xs[i]
+		meanY += ys[i]
+	}
+	f.meanX /= float64(f.n)
+	meanY /= float64(f.n)
+	var sxy float64
+	for i := range xs {
+		f.sxx += (xs[i] - f.meanX) * (xs[i] - f.meanX)
+		sxy += (xs[i] - f.meanX) * (ys[i] - meanY)
+	}
+	if f.sxx == 0 {
+		return f, fmt.Errorf("all points at %g, need at least two", xs[0])
+	}
+	f.Slope = sxy / f.sxx
+	f.Intercept = meanY - f.Slope*f.meanX
+	if f.n > 2 {
+		var sse float64
+		for i := range xs {
+			r := ys[i] - (f.Intercept + f.Slope*xs[i])
+			sse += r * r
+		}
+		f.residual = math.Sqrt(sse / float64(f.n-2))
+	}
+	return f, nil
+}
+
+func (linearFade) Fit(cycles, capacity []float64) (fadeCurve, error) {
+	return fitLine(cycles, capacity)
+}
+
+// tQuantiles are the 97.5% quantiles of Student's t distribution for 1 to
+// 30 degrees of freedom.
+var tQuantiles = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// tQuantile returns the 97.5% quantile of Student's t distribution, the
+// factor of a two-sided 95% band, for df degrees of freedom. Past the table
+// it uses the Cornish-Fisher expansion around the normal quantile.
+func tQuantile(df int) float64 {
+	if df < 1 {
+		return math.Inf(1)
+	}
+	if df <= len(tQuantiles) {
+		return tQuantiles[df-1]
+	}
+	z, n := 1.959964, float64(df)
+	return z + (z*z*z+z)/(4*n) + (5*math.Pow(z, 5)+16*z*z*z+3*z)/(96*n*n)
+}
+
+func (f lineFit) Predict(x float64) (float64, float64) {
+	margin := tQuantile(f.n-2) * f.residual * math.Sqrt(1+1/float64(f.n)+(x-f.meanX)*(x-f.meanX)/f.sxx)
+	return f.Intercept + f.Slope*x, margin
+}
+
+// fadeForecast is the expected end of life of a battery: where the
+// capacity crosses the profile's limit or the cycles reach MaxCycles,
+// whichever comes first.
+type fadeForecast struct {
+	Model         string
+	Curve         fadeCurve
+	FirstCycles   float64 // cycle count of the first reading fitted
+	LastCycles    float64 // cycle count of the latest reading
+	CapacityLimit float64 // MinCapacityFactor × DesignCapacity in mAh, 0 if not limited
+	MaxCycles     int     // 0 if not limited
+	Reason        string  // what ends the battery's life: "capacity" or "cycles"
+	EndCycles     float64 // expected cycle count at the end of life, 0 if beyond the horizon
+	Earliest      float64 // end of life at the low edge of the band
+	Latest        float64 // end of life at the high edge of the band, 0 if beyond the horizon
+	CyclesPerDay  float64 // usage, 0 if unknown
+	usage         lineFit // cycles over days since the first reading
+	start         time.Time
+}
+
+// crossing returns the first cycle count after from at which the capacity
+// (offset by side times the band) is at or below limit, or 0 when it stays
+// above it within the horizon.
+func crossing(curve fadeCurve, from, limit, side float64) float64 {
+	at := func(x float64) bool {
+		y, margin := curve.Predict(x)
+		return y+side*margin <= limit
+	}
+	if at(from) {
+		return from
+	}
+	step := 10.0
+	lo := from
+	for hi := from + step; hi <= from+forecastHorizon; hi += step {
+		if at(hi) {
+			for hi-lo > 0.5 {
+				mid := (lo + hi) / 2
+				if at(mid) {
+					hi = mid
+				} else {
+					lo = mid
+				}
+			}
+			return hi
+		}
+		lo = hi
+	}
+	return 0
+}
+
+// forecastFade fits a fade model over the readings of a battery and
+// predicts when it reaches the limits of its profile.
+func forecastFade(readings []rrcBatteryData, profile batteryProfile, modelName string) (fadeForecast, error) {
+	if modelName == "" {
+		modelName = defaultFadeModel
+	}
+	forecast := fadeForecast{Model: modelName, MaxCycles: profile.MaxCycles}
+	model, ok := fadeModels[modelName]
+	if !ok {
+		return forecast, fmt.Errorf("unknown fade model \"%s\"", modelName)
+	}
+	cycles, capacity, days := []float64{}, []float64{}, []float64{}
+	latest := readings[len(readings)-1]
+	for _, r := range readings {
+		if r.FullCapacity <= 0 {
+			continue
+		}
+		taken, err := parseTimestamp(r.Timestamp)
+		if err != nil {
+			continue
+		}
+		if forecast.start.IsZero() {
+			forecast.start = taken
+		}
+		cycles = append(cycles, float64(r.CycleCount))
+		capacity = append(capacity, float64(r.FullCapacity))
+		days = append(days, taken.Sub(forecast.start).Hours()/24)
+	}
+	if len(cycles) < 3 {
+		return forecast, fmt.Errorf("%d reading(s) with a capacity, need at least 3", len(cycles))
+	}
+	curve, err := model.Fit(cycles, capacity)
+	if err != nil {
+		return forecast, err
+	}
+	forecast.Curve = curve
+	forecast.FirstCycles = cycles[0]
+	forecast.LastCycles = float64(latest.CycleCount)
+	if usage, err := fitLine(days, cycles); err == nil && usage.Slope > 0 {
+		forecast.usage = usage
+		forecast.CyclesPerDay = usage.Slope
+	}
+	if profile.MinCapacityFactor > 0 && latest.DesignCapacity > 0 {
+		forecast.CapacityLimit = profile.MinCapacityFactor * float64(latest.DesignCapacity)
+		forecast.Reason = "capacity"
+		forecast.EndCycles = crossing(curve, forecast.LastCycles, forecast.CapacityLimit, 0)
+		forecast.Earliest = crossing(curve, forecast.LastCycles, forecast.CapacityLimit, -1)
+		forecast.Latest = crossing(curve, forecast.LastCycles, forecast.CapacityLimit, 1)
+	}
+	if maxCycles := float64(profile.MaxCycles); maxCycles > 0 {
+		// The cycle limit caps the forecast and both edges of its band.
+		limit := math.Max(maxCycles, forecast.LastCycles)
+		if forecast.EndCycles == 0 || forecast.EndCycles > maxCycles {
+			forecast.Reason = "cycles"
+			forecast.EndCycles = limit
+		}
+		if forecast.Earliest == 0 || forecast.Earliest > maxCycles {
+			forecast.Earliest = limit
+		}
+		if forecast.Latest == 0 || forecast.Latest > maxCycles {
+			forecast.Latest = limit
+		}
+	}
+	if forecast.Reason == "" {
+		return forecast, fmt.Errorf("profile %s sets no capacity or cycle limit", profile.AssociatedDeviceName)
+	}
+	return forecast, nil
+}
+
+// dateAt returns when the battery is expected to reach a cycle count at
+// its usage so far; ok is false when the usage is unknown.
+func (f fadeForecast) dateAt(cycles float64) (time.Time, bool) {
+	if f.CyclesPerDay <= 0 || cycles <= 0 {
+		return time.Time{}, false
+	}
+	days := (cycles - f.usage.Intercept) / f.usage.Slope
+	return f.start.Add(time.Duration(days * 24 * float64(time.Hour))), true
+}
+
+// Replacement is the expected replacement date, "" when unknown.
+func (f fadeForecast) Replacement() string {
+	if at, ok := f.dateAt(f.EndCycles); ok {
+		return at.Format(fmtDateTimeISO)
+	}
+	return ""
+}
+
+// String describes the forecast in one line, e.g. "replace at about 480
+// cycles (capacity limit 5175 mAh, 430 to 540), around 2027-03-01".
+func (f fadeForecast) String() string {
+	if f.EndCycles == 0 {
+		return fmt.Sprintf("capacity stays above %.0f mAh for the next %d cycles", f.CapacityLimit, forecastHorizon)
+	}
+	limit := fmt.Sprintf("cycle limit %d", f.MaxCycles)
+	if f.Reason == "capacity" {
+		limit = fmt.Sprintf("capacity limit %.0f mAh", f.CapacityLimit)
+	}
+	s := fmt.Sprintf("replace at about %.0f cycles (%s", f.EndCycles, limit)
+	if f.Earliest != f.EndCycles || f.Latest != f.EndCycles {
+		latest := fmt.Sprintf("%.0f", f.Latest)
+		if f.Latest == 0 {
+			latest = "beyond"
+		}
+		s += fmt.Sprintf(", %.0f to %s", f.Earliest, latest)
+	}
+	s += ")"
+	if date := f.Replacement(); date != "" {
+		s += ", around " + date
+		early, okEarly := f.dateAt(f.Earliest)
+		late, okLate := f.dateAt(f.Latest)
+		if okEarly && okLate && f.Earliest != f.Latest {
+			s += fmt.Sprintf(" (%s to %s)", early.Format(fmtDateTimeISO), late.Format(fmtDateTimeISO))
+		}
+	} else {
+		s += ", replacement date unknown without cycles over time"
+	}
+	return s
+}
+
+// forecastRow is one line of the forecast command.
+type forecastRow struct {
+	ID       string
+	Forecast fadeForecast
+	Err      error
+}
+
+// forecastStore forecasts every battery, or one, soonest replacement first.
+func forecastStore(store Store, profiles []batteryProfile, modelName, batteryID string) ([]forecastRow, error) {
+	ids := []string{batteryID}
+	if batteryID == "" {
+		batteries, err := store.ListBatteries(batteryFilter{})
+		if err != nil {
+			return nil, err
+		}
+		ids = ids[:0]
+		for _, b := range batteries {
+			ids = append(ids, b.ID)
+		}
+	}
+	rows := []forecastRow{}
+	for _, id := range ids {
+		readings, err := store.Readings(id)
+		if err != nil {
+			return nil, fmt.Errorf("reading \"%s\": %w", id, err)
+		}
+		latest := readings[len(readings)-1]
+		if latest.DevSerialNumber, err = store.DeviceFor(id); err != nil {
+			return nil, err
+		}
+		row := forecastRow{ID: id}
+		if profile, ok := profileFor(profiles, latest); ok {
+			row.Forecast, row.Err = forecastFade(readings, profile, modelName)
+		} else {
+			row.Err = fmt.Errorf("no profile matches")
+		}
+		rows = append(rows, row)
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i].Forecast.Replacement(), rows[j].Forecast.Replacement()
+		if (a == "") != (b == "") {
+			return a != ""
+		}
+		return a < b
+	})
+	return rows, nil
+}
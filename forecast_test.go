@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestFitLine(t *testing.T) {
+	tests := []struct {
+		name                       string
+		xs, ys                     []float64
+		intercept, slope, residual float64
+		fails                      bool
+	}{
+		{"exact line", []float64{0, 1, 2}, []float64{1, 3, 5}, 1, 2, 0, false},
+		{"scattered", []float64{0, 1, 2, 3}, []float64{0, 2, 1, 3}, 0.3, 0.8, math.Sqrt(0.9), false},
+		{"two points", []float64{0, 10}, []float64{100, 50}, 100, -5, 0, false},
+		{"one point", []float64{1}, []float64{1}, 0, 0, 0, true},
+		{"same x", []float64{2, 2, 2}, []float64{1, 2, 3}, 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		f, err := fitLine(tt.xs, tt.ys)
+		if (err != nil) != tt.fails {
+			t.Errorf("%s: err = %v, want failure %v", tt.name, err, tt.fails)
+			continue
+		}
+		if tt.fails {
+			continue
+		}
+		if math.Abs(f.Intercept-tt.intercept) > 1e-9 || math.Abs(f.Slope-tt.slope) > 1e-9 || math.Abs(f.residual-tt.residual) > 1e-9 {
+			t.Errorf("%s: fit %g + %g*x, residual %g, want %g + %g*x, residual %g", tt.name, f.Intercept, f.Slope, f.residual, tt.intercept, tt.slope, tt.residual)
+		}
+	}
+}
+
+// bandCurve is a straight fade with a band of constant width.
+type bandCurve struct {
+	intercept, slope, margin float64
+}
+
+func (c bandCurve) Predict(x float64) (float64, float64) {
+	return c.intercept + c.slope*x, c.margin
+}
+
+func TestCrossing(t *testing.T) {
+	tests := []struct {
+		name              string
+		curve             bandCurve
+		from, limit, side float64
+		want              float64
+	}{
+		{"centre", bandCurve{1000, -1, 100}, 0, 500, 0, 500},
+		{"low edge", bandCurve{1000, -1, 100}, 0, 500, -1, 400},
+		{"high edge", bandCurve{1000, -1, 100}, 0, 500, 1, 600},
+		{"already below", bandCurve{1000, -1, 0}, 700, 500, 0, 700},
+		{"no fade", bandCurve{1000, 0, 0}, 0, 500, 0, 0},
+		{"beyond the horizon", bandCurve{1000, -0.01, 0}, 0, 500, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := crossing(tt.curve, tt.from, tt.limit, tt.side); math.Abs(got-tt.want) > 0.5 {
+			t.Errorf("%s: crossing = %g, want %g", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestForecastFade(t *testing.T) {
+	useUTC(t)
+	// Capacity falls 3 mAh per cycle from 6883 mAh and crosses 75% of the
+	// 6900 mAh design capacity at about 569 cycles.
+	readings := []rrcBatteryData{}
+	for i, capacity := range []int{6900, 6550, 6300} {
+		r := testReading("RRC2040-2", "#1", fmt.Sprintf("2021-01-%02dT12:00:00Z", 10+i*10), i*100)
+		r.FullCapacity = capacity
+		readings = append(readings, r)
+	}
+	tests := []struct {
+		name        string
+		readings    []rrcBatteryData
+		profile     batteryProfile
+		reason      string
+		end, latest float64
+		fails       bool
+	}{
+		{"capacity first, band past the cycle limit", readings, batteryProfile{MinCapacityFactor: 0.75, MaxCycles: 600}, "capacity", 569.4, 600, false},
+		{"cycles first", readings, batteryProfile{MinCapacityFactor: 0.75, MaxCycles: 300}, "cycles", 300, 300, false},
+		{"cycle limit already passed", readings, batteryProfile{MaxCycles: 150}, "cycles", 200, 200, false},
+		{"no limits", readings, batteryProfile{}, "", 0, 0, true},
+		{"too few readings", readings[:2], batteryProfile{MaxCycles: 600}, "", 0, 0, true},
+	}
+	for _, tt := range tests {
+		f, err := forecastFade(tt.readings, tt.profile, "")
+		if (err != nil) != tt.fails {
+			t.Errorf("%s: err = %v, want failure %v", tt.name, err, tt.fails)
+			continue
+		}
+		if tt.fails {
+			continue
+		}
+		if f.Reason != tt.reason || math.Abs(f.EndCycles-tt.end) > 1 || f.Latest != tt.latest {
+			t.Errorf("%s: %s at %g, latest %g, want %s at %g, latest %g", tt.name, f.Reason, f.EndCycles, f.Latest, tt.reason, tt.end, tt.latest)
+		}
+		if f.Earliest > f.EndCycles || f.Earliest < f.LastCycles {
+			t.Errorf("%s: earliest %g outside %g to %g", tt.name, f.Earliest, f.LastCycles, f.EndCycles)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	promptui "github.com/manifoldco/promptui"
+)
+
+const (
+	statusGreen  = "green"
+	statusYellow = "yellow"
+	statusRed    = "red"
+)
+
+// stateOfHealth returns FullCapacity as a percentage of DesignCapacity, or
+// 0 when the design capacity is unknown.
+func stateOfHealth(dataset rrcBatteryData) float64 {
+	if dataset.DesignCapacity <= 0 {
+		return 0
+	}
+	return float64(dataset.FullCapacity) * 100 / float64(dataset.DesignCapacity)
+}
+
+// energyStateOfHealth returns the energy the pack holds when full as a
+// percentage of its design energy, or 0 when a figure is unknown. The pack
+// reports no energy, so it is approximated as FullCapacity × Voltage against
+// DesignCapacity × DesignVoltage: the pack voltage at the reading stands in
+// for the mean voltage over a discharge, which is closest at mid charge.
+func energyStateOfHealth(dataset rrcBatteryData) float64 {
+	voltage := dataset.Voltage
+	if voltage <= 0 {
+		voltage = dataset.VoltageMeasured
+	}
+	if dataset.FullCapacity <= 0 || voltage <= 0 || dataset.DesignCapacity <= 0 || dataset.DesignVoltage <= 0 {
+		return 0
+	}
+	return float64(dataset.FullCapacity) * float64(voltage) * 100 / (float64(dataset.DesignCapacity) * float64(dataset.DesignVoltage))
+}
+
+// setStateOfHealth stores both state of health figures in a reading,
+// rounded to 0.1%.
+func setStateOfHealth(dataset *rrcBatteryData) {
+	dataset.SoH = math.Round(stateOfHealth(*dataset)*10) / 10
+	dataset.EnergySoH = math.Round(energyStateOfHealth(*dataset)*10) / 10
+}
+
+// healthReport is the rating of a reading against a battery profile.
+type healthReport struct {
+	Status  string   `json:"status"`  // "green", "yellow" or "red", "" when no profile matched
+	Profile string   `json:"profile"` // name of the profile the reading was rated against
+	Reasons []string `json:"reasons"` // why the status is not green, e.g. "212 cycles, warn level 200"
+}
+
+// statusRank orders the statuses, worst last.
+var statusRank = map[string]int{statusGreen: 0, statusYellow: 1, statusRed: 2}
+
+func (h *healthReport) raise(status, reason string) {
+	if statusRank[status] > statusRank[h.Status] {
+		h.Status = status
+	}
+	h.Reasons = append(h.Reasons, reason)
+}
+
+// evaluateHealth rates a reading against the profile's limits: red at or
+// past MaxCycles or MinCapacityFactor, yellow at or past the warn levels,
+// and red outside the temperature window, below MinVoltage, past
+// MaxCellSpread or older than MaxAgeMonths. Limits left at 0 (or null for
+// temperatures) are not checked.
+func evaluateHealth(dataset rrcBatteryData, profile batteryProfile) healthReport {
+	h := healthReport{Status: statusGreen, Profile: profile.AssociatedDeviceName}
+	switch {
+	case profile.MaxCycles > 0 && dataset.CycleCount >= profile.MaxCycles:
+		h.raise(statusRed, fmt.Sprintf("%d cycles, limit %d", dataset.CycleCount, profile.MaxCycles))
+	case profile.WarnCycles > 0 && dataset.CycleCount >= profile.WarnCycles:
+		h.raise(statusYellow, fmt.Sprintf("%d cycles, warn level %d", dataset.CycleCount, profile.WarnCycles))
+	}
+	if profile.MinCapacityFactor > 0 || profile.WarnCapacityFactor > 0 {
+		evaluateCapacity(&h, dataset, profile)
+	}
+	evaluateLimits(&h, dataset, profile)
+	return h
+}
+
+// evaluateCapacity rates FullCapacity against the capacity factors.
+func evaluateCapacity(h *healthReport, dataset rrcBatteryData, profile batteryProfile) {
+	if dataset.DesignCapacity <= 0 {
+		h.raise(statusYellow, "design capacity unknown, capacity not rated")
+		return
+	}
+	soh := stateOfHealth(dataset)
+	switch {
+	case profile.MinCapacityFactor > 0 && soh/100 <= profile.MinCapacityFactor:
+		h.raise(statusRed, fmt.Sprintf("full capacity %.1f%% of design, limit %.0f%%", soh, profile.MinCapacityFactor*100))
+	case profile.WarnCapacityFactor > 0 && soh/100 <= profile.WarnCapacityFactor:
+		h.raise(statusYellow, fmt.Sprintf("full capacity %.1f%% of design, warn level %.0f%%", soh, profile.WarnCapacityFactor*100))
+	}
+}
+
+// evaluateLimits checks the temperature, voltage, cell and age limits.
+// Values the battery did not report are not rated.
+func evaluateLimits(h *healthReport, dataset rrcBatteryData, profile batteryProfile) {
+	if dataset.TemperatureK > 0 {
+		if profile.MinTemperature != nil && dataset.TemperatureC < *profile.MinTemperature {
+			h.raise(statusRed, fmt.Sprintf("temperature %.1f °C, limit %g °C", dataset.TemperatureC, *profile.MinTemperature))
+		}
+		if profile.MaxTemperature != nil && dataset.TemperatureC > *profile.MaxTemperature {
+			h.raise(statusRed, fmt.Sprintf("temperature %.1f °C, limit %g °C", dataset.TemperatureC, *profile.MaxTemperature))
+		}
+	}
+	if voltage := packVoltage(dataset); profile.MinVoltage > 0 && voltage > 0 && voltage < profile.MinVoltage {
+		h.raise(statusRed, fmt.Sprintf("pack voltage %d mV, limit %d mV", voltage, profile.MinVoltage))
+	}
+	if spread, ok := cellSpread(dataset); profile.MaxCellSpread > 0 && ok && spread > profile.MaxCellSpread {
+		h.raise(statusRed, fmt.Sprintf("cell voltages %d mV apart, limit %d mV", spread, profile.MaxCellSpread))
+	}
+	if profile.MaxAgeMonths > 0 {
+		months, err := ageMonths(dataset)
+		switch {
+		case err != nil:
+			h.raise(statusYellow, "manufacture date unknown, age not rated")
+		case months >= profile.MaxAgeMonths:
+			h.raise(statusRed, fmt.Sprintf("%d months old, limit %d", months, profile.MaxAgeMonths))
+		}
+	}
+}
+
+// packVoltage is the measured pack voltage in mV, or the reported one when
+// nothing was measured.
+func packVoltage(dataset rrcBatteryData) int {
+	if dataset.VoltageMeasured > 0 {
+		return dataset.VoltageMeasured
+	}
+	return dataset.Voltage
+}
+
+// cellVoltages returns the cell voltages in mV from the OptMfg 0x3f..0x3c
+// registers (cell 1 to 4), e.g. "0e85 hex" for 3717 mV. Cells reading 0 are
+// not fitted.
+func cellVoltages(dataset rrcBatteryData) []int {
+	cells := []int{}
+	for _, register := range []string{dataset.OptMfg3f, dataset.OptMfg3e, dataset.OptMfg3d, dataset.OptMfg3c} {
+		mv, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(register), "hex")), 16, 32)
+		if err == nil && mv > 0 {
+			cells = append(cells, int(mv))
+		}
+	}
+	return cells
+}
+
+// cellSpread is the difference between the highest and the lowest cell
+// voltage in mV; ok is false with fewer than two cells.
+func cellSpread(dataset rrcBatteryData) (spread int, ok bool) {
+	cells := cellVoltages(dataset)
+	if len(cells) < 2 {
+		return 0, false
+	}
+	lowest, highest := cells[0], cells[0]
+	for _, mv := range cells[1:] {
+		if mv < lowest {
+			lowest = mv
+		}
+		if mv > highest {
+			highest = mv
+		}
+	}
+	return highest - lowest, true
+}
+
+// manufactureDate parses MfgDate, e.g. "2021 / 1 / 25".
+func manufactureDate(dataset rrcBatteryData) (time.Time, error) {
+	var year, month, day int
+	if _, err := fmt.Sscanf(strings.TrimSpace(dataset.MfgDate), "%d / %d / %d", &year, &month, &day); err != nil {
+		return time.Time{}, fmt.Errorf("invalid manufacture date \"%s\"", dataset.MfgDate)
+	}
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC), nil
+}
+
+// ageMonths is the calendar age of the battery in whole months when the
+// reading was taken.
+func ageMonths(dataset rrcBatteryData) (int, error) {
+	made, err := manufactureDate(dataset)
+	if err != nil {
+		return 0, err
+	}
+	taken, err := parseTimestamp(dataset.Timestamp)
+	if err != nil {
+		return 0, err
+	}
+	months := (taken.Year()-made.Year())*12 + int(taken.Month()-made.Month())
+	if taken.Day() < made.Day() {
+		months--
+	}
+	if months < 0 {
+		months = 0
+	}
+	return months, nil
+}
+
+// rateReading rates a reading against the profile chosen for it, or the
+// defaults of its chemistry. The status is empty when neither applies.
+func rateReading(dataset rrcBatteryData) healthReport {
+	profiles, err := loadBatteryProfiles()
+	if err != nil {
+		return healthReport{Reasons: []string{fmt.Sprintf("battery profiles unreadable: %v", err)}}
+	}
+	profile, ok := profileFor(profiles, dataset)
+	if !ok {
+		return healthReport{Reasons: []string{"no profile matches and the chemistry is unknown, see rrcreader profile match"}}
+	}
+	return evaluateHealth(dataset, profile)
+}
+
+// statusColor is the colour a status is shown in on reports.
+func statusColor(status string) string {
+	switch status {
+	case statusGreen:
+		return "#10A010"
+	case statusYellow:
+		return "#E0A000"
+	case statusRed:
+		return "#E01010"
+	}
+	return "#808080"
+}
+
+// healthSummary is a one line description of the rating for reports.
+func healthSummary(h healthReport) string {
+	if len(h.Reasons) == 0 {
+		return fmt.Sprintf("Health: %s, within all limits", strings.ToUpper(h.Status))
+	}
+	return fmt.Sprintf("Health: %s, %s", strings.ToUpper(h.Status), strings.Join(h.Reasons, "; "))
+}
+
+// String describes the rating for the terminal, the status in colour.
+func (h healthReport) String() string {
+	if h.Status == "" {
+		return fmt.Sprintf("Health: not rated (%s)\n", strings.Join(h.Reasons, ", "))
+	}
+	styles := map[string]func(interface{}) string{
+		statusGreen:  promptui.Styler(promptui.FGGreen, promptui.FGBold),
+		statusYellow: promptui.Styler(promptui.FGYellow, promptui.FGBold),
+		statusRed:    promptui.Styler(promptui.FGRed, promptui.FGBold),
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Health: %s (profile %s)\n", styles[h.Status](strings.ToUpper(h.Status)), h.Profile)
+	if len(h.Reasons) == 0 {
+		fmt.Fprintf(&b, "  within all limits\n")
+	}
+	for _, r := range h.Reasons {
+		fmt.Fprintf(&b, "  - %s\n", r)
+	}
+	return b.String()
+}
@@ -0,0 +1,103 @@
+package main
+
+import "testing"
+
+func TestEvaluateHealth(t *testing.T) {
+	profile := batteryProfile{AssociatedDeviceName: "Ventilator", MaxCycles: 300, WarnCycles: 250, MinCapacityFactor: 0.75, WarnCapacityFactor: 0.8}
+	reading := func(cycles, fullCapacity, designCapacity int) rrcBatteryData {
+		r := testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", cycles)
+		r.FullCapacity, r.DesignCapacity = fullCapacity, designCapacity
+		return r
+	}
+	tests := []struct {
+		name    string
+		reading rrcBatteryData
+		profile batteryProfile
+		status  string
+		reasons int
+	}{
+		{"within every limit", reading(100, 6800, 6900), profile, statusGreen, 0},
+		{"below the cycle warn level", reading(249, 6800, 6900), profile, statusGreen, 0},
+		{"at the cycle warn level", reading(250, 6800, 6900), profile, statusYellow, 1},
+		{"past the cycle warn level", reading(260, 6800, 6900), profile, statusYellow, 1},
+		{"at the cycle limit", reading(300, 6800, 6900), profile, statusRed, 1},
+		{"past the cycle limit", reading(310, 6800, 6900), profile, statusRed, 1},
+		{"capacity above the warn level", reading(100, 5521, 6900), profile, statusGreen, 0},
+		{"capacity at the warn level", reading(100, 5520, 6900), profile, statusYellow, 1},
+		{"capacity just above the limit", reading(100, 5176, 6900), profile, statusYellow, 1},
+		{"capacity at the limit", reading(100, 5175, 6900), profile, statusRed, 1},
+		{"design capacity unknown", reading(100, 5175, 0), profile, statusYellow, 1},
+		{"cycles warn, capacity red", reading(260, 5000, 6900), profile, statusRed, 2},
+		{"no limits set", reading(5000, 100, 6900), batteryProfile{}, statusGreen, 0},
+		{"only a warn level", reading(260, 6800, 6900), batteryProfile{WarnCycles: 250}, statusYellow, 1},
+	}
+	for _, tt := range tests {
+		h := evaluateHealth(tt.reading, tt.profile)
+		if h.Status != tt.status || len(h.Reasons) != tt.reasons {
+			t.Errorf("%s: %s %q, want %s with %d reason(s)", tt.name, h.Status, h.Reasons, tt.status, tt.reasons)
+		}
+	}
+}
+
+func TestEvaluateLimits(t *testing.T) {
+	zero, cold, hot := 0.0, -10.0, 45.0
+	reading := func(change func(r *rrcBatteryData)) rrcBatteryData {
+		r := testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20)
+		change(&r)
+		return r
+	}
+	at := func(celsius float64) rrcBatteryData {
+		return reading(func(r *rrcBatteryData) { r.TemperatureC, r.TemperatureK = celsius, celsius+273.15 })
+	}
+	tests := []struct {
+		name    string
+		reading rrcBatteryData
+		profile batteryProfile
+		status  string
+	}{
+		{"below a 0 °C limit", at(-1), batteryProfile{MinTemperature: &zero}, statusRed},
+		{"at a 0 °C limit", at(0), batteryProfile{MinTemperature: &zero}, statusGreen},
+		{"no temperature limits", at(-20), batteryProfile{}, statusGreen},
+		{"inside the window", at(20), batteryProfile{MinTemperature: &cold, MaxTemperature: &hot}, statusGreen},
+		{"above the window", at(46), batteryProfile{MinTemperature: &cold, MaxTemperature: &hot}, statusRed},
+		{"temperature not reported", reading(func(r *rrcBatteryData) { r.TemperatureC = -5 }), batteryProfile{MinTemperature: &zero}, statusGreen},
+		{"measured voltage below the floor", reading(func(r *rrcBatteryData) { r.VoltageMeasured, r.Voltage = 8900, 9500 }), batteryProfile{MinVoltage: 9000}, statusRed},
+		{"reported voltage when none measured", reading(func(r *rrcBatteryData) { r.Voltage = 8900 }), batteryProfile{MinVoltage: 9000}, statusRed},
+		{"voltage at the floor", reading(func(r *rrcBatteryData) { r.VoltageMeasured = 9000 }), batteryProfile{MinVoltage: 9000}, statusGreen},
+		{"voltage not reported", reading(func(r *rrcBatteryData) {}), batteryProfile{MinVoltage: 9000}, statusGreen},
+		{"cells too far apart", reading(func(r *rrcBatteryData) { r.OptMfg3f, r.OptMfg3e = "0e10 hex", "0e74 hex" }), batteryProfile{MaxCellSpread: 50}, statusRed},
+		{"cells at the spread limit", reading(func(r *rrcBatteryData) { r.OptMfg3f, r.OptMfg3e = "0e10 hex", "0e74 hex" }), batteryProfile{MaxCellSpread: 100}, statusGreen},
+		{"one cell", reading(func(r *rrcBatteryData) { r.OptMfg3f = "0e10 hex" }), batteryProfile{MaxCellSpread: 50}, statusGreen},
+		{"at the age limit", reading(func(r *rrcBatteryData) { r.MfgDate = "2019 / 1 / 15" }), batteryProfile{MaxAgeMonths: 24}, statusRed},
+		{"a day short of the age limit", reading(func(r *rrcBatteryData) { r.MfgDate = "2019 / 1 / 16" }), batteryProfile{MaxAgeMonths: 24}, statusGreen},
+		{"manufacture date missing", reading(func(r *rrcBatteryData) {}), batteryProfile{MaxAgeMonths: 24}, statusYellow},
+		{"manufacture date missing, no age limit", reading(func(r *rrcBatteryData) {}), batteryProfile{}, statusGreen},
+	}
+	for _, tt := range tests {
+		h := healthReport{Status: statusGreen}
+		evaluateLimits(&h, tt.reading, tt.profile)
+		if h.Status != tt.status {
+			t.Errorf("%s: %s %q, want %s", tt.name, h.Status, h.Reasons, tt.status)
+		}
+	}
+}
+
+func TestCellSpread(t *testing.T) {
+	tests := []struct {
+		name      string
+		registers [4]string // OptMfg3f, 3e, 3d, 3c
+		spread    int
+		ok        bool
+	}{
+		{"four cells", [4]string{"0e10 hex", "0e74 hex", "0e42 hex", "0e20 hex"}, 100, true},
+		{"unfitted cells read 0", [4]string{"0e10 hex", "0e1a hex", "0000 hex", "0000 hex"}, 10, true},
+		{"one cell", [4]string{"0e10 hex", "", "", ""}, 0, false},
+		{"unreadable registers", [4]string{"zz hex", "", "", ""}, 0, false},
+	}
+	for _, tt := range tests {
+		r := rrcBatteryData{OptMfg3f: tt.registers[0], OptMfg3e: tt.registers[1], OptMfg3d: tt.registers[2], OptMfg3c: tt.registers[3]}
+		if spread, ok := cellSpread(r); spread != tt.spread || ok != tt.ok {
+			t.Errorf("%s: cellSpread = %d, %v, want %d, %v", tt.name, spread, ok, tt.spread, tt.ok)
+		}
+	}
+}
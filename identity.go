@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// defaultIdentityFields are added to Name+SerialNumber when the
+// configuration does not list identity fields. SBS serial numbers are only
+// 16 bits and repeat across production lots.
+var defaultIdentityFields = []string{"manufacturer", "mfgdate", "chemistry"}
+
+func identityFields(genConfig generalConfiguration) []string {
+	if genConfig.IdentityFields == nil {
+		return defaultIdentityFields
+	}
+	return genConfig.IdentityFields
+}
+
+func identityValue(dataset rrcBatteryData, field string) string {
+	switch field {
+	case "manufacturer":
+		return dataset.Manufacturer
+	case "mfgdate":
+		return dataset.MfgDate
+	case "chemistry":
+		return dataset.Chemistry
+	case "designcapacity":
+		return fmt.Sprintf("%d", dataset.DesignCapacity)
+	case "designvoltage":
+		return fmt.Sprintf("%d", dataset.DesignVoltage)
+	default:
+		return ""
+	}
+}
+
+var identityUnsafe = regexp.MustCompile(`[^A-Za-z0-9#.+-]+`)
+
+// compositeID joins Name+SerialNumber with the identity fields into a key
+// that is safe to use as a directory name, e.g.
+// "RRC2040-2#3427_RRC_2021-1-25_LION".
+func compositeID(dataset rrcBatteryData, fields []string) string {
+	parts := []string{dataset.Name + dataset.SerialNumber}
+	for _, field := range fields {
+		value := strings.ReplaceAll(identityValue(dataset, field), " ", "")
+		value = identityUnsafe.ReplaceAllString(value, "-")
+		if value == "" {
+			value = "-"
+		}
+		parts = append(parts, value)
+	}
+	return strings.Join(parts, "_")
+}
+
+// sameIdentity tells whether two readings agree on every identity field.
+func sameIdentity(a, b rrcBatteryData, fields []string) bool {
+	for _, field := range fields {
+		if identityValue(a, field) != identityValue(b, field) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameBattery tells whether next can be a later reading of the pack that
+// produced prev. The reason is set when it cannot.
+func sameBattery(prev, next rrcBatteryData, fields []string) (bool, string) {
+	for _, field := range fields {
+		if a, b := identityValue(prev, field), identityValue(next, field); a != b {
+			return false, fmt.Sprintf("%s changed from \"%s\" to \"%s\"", field, a, b)
+		}
+	}
+	if next.CycleCount < prev.CycleCount {
+		return false, fmt.Sprintf("cycle count went back from %d to %d", prev.CycleCount, next.CycleCount)
+	}
+	return true, ""
+}
+
+// uniqueID returns id, or id with a numeric suffix if it is already taken.
+func uniqueID(id string, taken map[string]bool) string {
+	candidate := id
+	for n := 2; taken[candidate]; n++ {
+		candidate = fmt.Sprintf("%s_%d", id, n)
+	}
+	return candidate
+}
+
+// resolveBatteryID finds the history a new reading belongs to among the
+// batteries sharing its name and serial number, or makes up a new identity.
+func resolveBatteryID(store Store, reading rrcBatteryData, fields []string) (string, error) {
+	candidates, err := store.ListBatteries(batteryFilter{Name: reading.Name, SerialNumber: reading.SerialNumber})
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].LastSeen > candidates[j].LastSeen })
+	taken := make(map[string]bool)
+	for _, c := range candidates {
+		taken[c.ID] = true
+		readings, err := store.Readings(c.ID)
+		if err != nil {
+			return "", err
+		}
+		if same, _ := sameBattery(readings[len(readings)-1], reading, fields); same {
+			return c.ID, nil
+		}
+	}
+	id := reading.Name + reading.SerialNumber
+	if len(fields) > 0 {
+		id = compositeID(reading, fields)
+	}
+	id = uniqueID(id, taken)
+	if len(candidates) > 0 {
+		fmt.Printf("Serial %s is already known from another pack, recording this one as \"%s\"\n", reading.SerialNumber, id)
+	}
+	return id, nil
+}
+
+// historySegment is a run of readings that look like one physical pack.
+type historySegment struct {
+	Readings []rrcBatteryData
+	Reason   string // why the segment was split from the previous one
+}
+
+// splitHistory cuts a battery's readings wherever sameBattery fails.
+func splitHistory(readings []rrcBatteryData, fields []string) []historySegment {
+	segments := []historySegment{}
+	for i, r := range readings {
+		if i == 0 {
+			segments = append(segments, historySegment{Readings: []rrcBatteryData{r}})
+			continue
+		}
+		if same, reason := sameBattery(readings[i-1], r, fields); !same {
+			segments = append(segments, historySegment{Readings: []rrcBatteryData{r}, Reason: reason})
+			continue
+		}
+		last := &segments[len(segments)-1]
+		last.Readings = append(last.Readings, r)
+	}
+	return segments
+}
+
+// moveRegistry moves the attachments and notes of a split battery along
+// with its readings: an attachment or battery note belongs to the segment
+// it was made in, a note on a reading to the segment holding the reading.
+func moveRegistry(store Store, batteryID string, segments []historySegment, ids []string) error {
+	// segmentAt returns the index of the segment running at timestamp.
+	segmentAt := func(timestamp string) int {
+		at := 0
+		for i, seg := range segments {
+			if seg.Readings[0].Timestamp <= timestamp {
+				at = i
+			}
+		}
+		return at
+	}
+	attachments, err := store.Attachments(batteryID)
+	if err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		i := segmentAt(a.Attached)
+		if i == 0 || a.Removed {
+			continue
+		}
+		moved := a
+		moved.BatteryID = ids[i]
+		moved.Updated = updatedNow()
+		if err := store.PutAttachment(moved); err != nil {
+			return err
+		}
+		a.Removed = true
+		a.Updated = updatedNow()
+		if err := store.PutAttachment(a); err != nil {
+			return err
+		}
+	}
+	notes, err := store.Notes()
+	if err != nil {
+		return err
+	}
+	for _, n := range notes {
+		if n.BatteryID != batteryID || n.Removed {
+			continue
+		}
+		at := n.Timestamp
+		if at == "" {
+			at = n.Created
+		}
+		if i := segmentAt(at); i > 0 {
+			n.BatteryID = ids[i]
+			n.Updated = updatedNow()
+			if err := store.PutNote(n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// splitMergedHistories looks for histories holding more than one pack and
+// moves the later packs to identities of their own. confirm is asked before
+// each battery is split.
+func splitMergedHistories(store Store, fields []string, confirm func(string) bool) (int, error) {
+	batteries, err := store.ListBatteries(batteryFilter{})
+	if err != nil {
+		return 0, err
+	}
+	taken := make(map[string]bool)
+	for _, b := range batteries {
+		taken[b.ID] = true
+	}
+	split := 0
+	for _, b := range batteries {
+		readings, err := store.Readings(b.ID)
+		if err != nil {
+			return split, fmt.Errorf("reading \"%s\": %w", b.ID, err)
+		}
+		segments := splitHistory(readings, fields)
+		if len(segments) < 2 {
+			continue
+		}
+		var plan strings.Builder
+		fmt.Fprintf(&plan, "\"%s\" looks like %d different packs:\n", b.ID, len(segments))
+		ids := make([]string, len(segments))
+		ids[0] = b.ID
+		for i, seg := range segments {
+			if i > 0 {
+				id := seg.Readings[0].Name + seg.Readings[0].SerialNumber
+				if len(fields) > 0 {
+					id = compositeID(seg.Readings[0], fields)
+				}
+				ids[i] = uniqueID(id, taken)
+				taken[ids[i]] = true
+			}
+			first, last := seg.Readings[0], seg.Readings[len(seg.Readings)-1]
+			fmt.Fprintf(&plan, "  %s: %d reading(s) %s .. %s, cycles %d .. %d", ids[i], len(seg.Readings), first.Timestamp, last.Timestamp, first.CycleCount, last.CycleCount)
+			if seg.Reason != "" {
+				fmt.Fprintf(&plan, " (%s)", seg.Reason)
+			}
+			plan.WriteString("\n")
+		}
+		if !confirm(plan.String()) {
+			continue
+		}
+		for i, seg := range segments[1:] {
+			for _, r := range seg.Readings {
+				r.BatteryID = ids[i+1]
+				if err := store.Append(r); err != nil {
+					return split, err
+				}
+				if err := store.Delete(b.ID, r.Timestamp); err != nil {
+					return split, err
+				}
+			}
+		}
+		if err := moveRegistry(store, b.ID, segments, ids); err != nil {
+			return split, err
+		}
+		split++
+	}
+	return split, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestSplitMergedHistories(t *testing.T) {
+	fields := defaultIdentityFields
+	first := testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20)
+	second := testReading("RRC2040-2", "#1", "2021-02-01T09:00:00Z", 25)
+	// A replacement pack reusing the serial number.
+	other := testReading("RRC2040-2", "#1", "2021-03-01T10:00:00Z", 5)
+	other.MfgDate = "2021-1-25"
+	forEachBackend(t, func(t *testing.T, store Store) {
+		appendAll(t, store, first, second, other)
+		for _, a := range []attachment{
+			{BatteryID: "RRC2040-2#1", DeviceSerial: "1234.1", Attached: "2021-01-15T12:30:00Z", Detached: "2021-03-01T10:00:00Z", Updated: "20210301100000.000000"},
+			{BatteryID: "RRC2040-2#1", DeviceSerial: "1234.2", Attached: "2021-03-01T10:00:00Z", Updated: "20210301100000.000000"},
+		} {
+			if err := store.PutAttachment(a); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, n := range []note{
+			{ID: "n1", BatteryID: "RRC2040-2#1", Timestamp: "2021-01-15T12:30:00Z", Text: "first", Created: "2021-01-15T13:00:00Z"},
+			{ID: "n2", BatteryID: "RRC2040-2#1", Timestamp: "2021-03-01T10:00:00Z", Text: "on the new pack", Created: "2021-03-01T11:00:00Z"},
+			{ID: "n3", BatteryID: "RRC2040-2#1", Text: "swapped", Created: "2021-03-02T08:00:00Z"},
+		} {
+			if err := store.PutNote(n); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		split, err := splitMergedHistories(store, fields, func(string) bool { return true })
+		if err != nil || split != 1 {
+			t.Fatalf("splitMergedHistories = %d, %v, want 1", split, err)
+		}
+		newID := compositeID(other, fields)
+		if readings, err := store.Readings("RRC2040-2#1"); err != nil || len(readings) != 2 {
+			t.Errorf("old battery has %d readings, %v, want 2", len(readings), err)
+		}
+		if readings, err := store.Readings(newID); err != nil || len(readings) != 1 {
+			t.Errorf("\"%s\" has %d readings, %v, want 1", newID, len(readings), err)
+		}
+		if device, err := store.DeviceFor("RRC2040-2#1"); err != nil || device != "" {
+			t.Errorf("old battery DeviceFor = %q, %v, want detached", device, err)
+		}
+		if device, err := store.DeviceFor(newID); err != nil || device != "1234.2" {
+			t.Errorf("new battery DeviceFor = %q, %v, want 1234.2", device, err)
+		}
+		notes, err := store.Notes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"n1": "RRC2040-2#1", "n2": newID, "n3": newID}
+		for _, n := range notes {
+			if n.BatteryID != want[n.ID] {
+				t.Errorf("note %s is on \"%s\", want \"%s\"", n.ID, n.BatteryID, want[n.ID])
+			}
+		}
+	})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type importReport struct {
+	Batteries   int
+	NewReadings int
+	Duplicates  int
+	Registry    int
+	Notes       int
+	Profiles    int
+	Identities  []string // batteries stored under another key here
+	Conflicts   []string
+}
+
+func (r importReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d battery(s): %d new reading(s), %d already present, %d device/attachment update(s), %d note update(s), %d profile update(s)\n", r.Batteries, r.NewReadings, r.Duplicates, r.Registry, r.Notes, r.Profiles)
+	for _, id := range r.Identities {
+		fmt.Fprintf(&b, "Identity: %s\n", id)
+	}
+	for _, c := range r.Conflicts {
+		fmt.Fprintf(&b, "Conflict: %s\n", c)
+	}
+	return b.String()
+}
+
+// importPaths returns the database and the data directory of an import
+// source: the database in path when it holds rrcreader.db or db/, else path
+// itself as a JSON database directory inside its data directory.
+func importPaths(path string) (database, dataPath string, sql bool) {
+	if _, err := os.Stat(filepath.Join(path, filepath.Base(sqlDBFile))); err == nil {
+		return filepath.Join(path, filepath.Base(sqlDBFile)), path, true
+	}
+	if info, err := os.Stat(filepath.Join(path, filepath.Base(dbDir))); err == nil && info.IsDir() {
+		return filepath.Join(path, filepath.Base(dbDir)), path, false
+	}
+	return path, filepath.Dir(path), false
+}
+
+// sourceLegacyZone returns the legacyzone of the configuration in an import
+// source's data directory, "" when it sets none.
+func sourceLegacyZone(dataPath string) (string, error) {
+	byteValue, err := os.ReadFile(filepath.Join(dataPath, filepath.Base(configFile)))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var cfg generalConfiguration
+	if err := json.Unmarshal(byteValue, &cfg); err != nil {
+		return "", fmt.Errorf("\"%s\": %w", filepath.Join(dataPath, filepath.Base(configFile)), err)
+	}
+	return cfg.LegacyZone, nil
+}
+
+// openImportSource opens another station's database for reading only; it is
+// neither changed nor migrated. path may be a data directory (holding db/ or
+// rrcreader.db) or a JSON database directory. Its timestamps written before
+// version 2 are read in zone, the zone of the station that took them.
+func openImportSource(path string, zone *time.Location) (Store, string, error) {
+	database, dataPath, sql := importPaths(path)
+	var store Store
+	var err error
+	inLegacyZone(zone, func() {
+		if sql {
+			store, err = openSQLSource(database)
+		} else {
+			store, err = openScribbleSource(database)
+		}
+	})
+	if err != nil {
+		return nil, dataPath, err
+	}
+	return zonedStore{store, zone}, dataPath, nil
+}
+
+// zonedStore reads a store with legacyZone set to the zone of the station
+// that wrote it.
+type zonedStore struct {
+	Store
+	zone *time.Location
+}
+
+func (s zonedStore) Readings(batteryID string) (readings []rrcBatteryData, err error) {
+	inLegacyZone(s.zone, func() { readings, err = s.Store.Readings(batteryID) })
+	return readings, err
+}
+
+func (s zonedStore) DeviceFor(batteryID string) (serial string, err error) {
+	inLegacyZone(s.zone, func() { serial, err = s.Store.DeviceFor(batteryID) })
+	return serial, err
+}
+
+func (s zonedStore) Attachments(batteryID string) (list []attachment, err error) {
+	inLegacyZone(s.zone, func() { list, err = s.Store.Attachments(batteryID) })
+	return list, err
+}
+
+func (s zonedStore) Notes() (list []note, err error) {
+	inLegacyZone(s.zone, func() { list, err = s.Store.Notes() })
+	return list, err
+}
+
+func (s zonedStore) ListBatteries(filter batteryFilter) (list []batterySummary, err error) {
+	inLegacyZone(s.zone, func() { list, err = s.Store.ListBatteries(filter) })
+	return list, err
+}
+
+// dryRunStore reads from a store and discards the writes, so a dry run
+// counts exactly what an import would change.
+type dryRunStore struct {
+	Store
+}
+
+func (dryRunStore) Append(rrcBatteryData) error    { return nil }
+func (dryRunStore) Delete(string, string) error    { return nil }
+func (dryRunStore) PutDevice(deviceRecord) error   { return nil }
+func (dryRunStore) PutAttachment(attachment) error { return nil }
+func (dryRunStore) PutNote(note) error             { return nil }
+
+// importIdentity returns the local key for an imported battery, given its
+// first reading. A local battery with the same name, serial number and
+// identity fields is the same pack, whatever key it is stored under. A pack
+// not known here keeps its key unless another pack already holds it.
+func importIdentity(dst Store, first rrcBatteryData, id string, fields []string, taken map[string]bool) (string, error) {
+	candidates, err := dst.ListBatteries(batteryFilter{Name: first.Name, SerialNumber: first.SerialNumber})
+	if err != nil {
+		return "", err
+	}
+	for _, c := range candidates {
+		readings, err := dst.Readings(c.ID)
+		if err != nil {
+			return "", err
+		}
+		if len(readings) > 0 && sameIdentity(readings[len(readings)-1], first, fields) {
+			return c.ID, nil
+		}
+	}
+	if !taken[id] {
+		return id, nil
+	}
+	newID := first.Name + first.SerialNumber
+	if len(fields) > 0 {
+		newID = compositeID(first, fields)
+	}
+	return uniqueID(newID, taken), nil
+}
+
+// importStore merges every reading, device, attachment and note of src into
+// dst.
+// Batteries are matched by their identity fields, readings by battery and
+// timestamp. Differing device associations and differing readings with the
+// same timestamp are reported, and the local data kept.
+func importStore(src, dst Store, fields []string, dryRun bool) (importReport, error) {
+	var report importReport
+	if dryRun {
+		dst = dryRunStore{dst}
+	}
+	batteries, err := src.ListBatteries(batteryFilter{})
+	if err != nil {
+		return report, err
+	}
+	known, err := dst.ListBatteries(batteryFilter{})
+	if err != nil {
+		return report, err
+	}
+	taken := make(map[string]bool)
+	for _, b := range known {
+		taken[b.ID] = true
+	}
+	// battery key in src -> battery key in dst
+	ids := make(map[string]string)
+	for _, b := range batteries {
+		incoming, err := src.Readings(b.ID)
+		if err != nil {
+			return report, fmt.Errorf("reading \"%s\": %w", b.ID, err)
+		}
+		if len(incoming) == 0 {
+			continue
+		}
+		id, err := importIdentity(dst, incoming[0], b.ID, fields, taken)
+		if err != nil {
+			return report, err
+		}
+		ids[b.ID] = id
+		taken[id] = true
+		if id != b.ID {
+			report.Identities = append(report.Identities, fmt.Sprintf("%s is imported as \"%s\"", b.ID, id))
+		}
+		local, err := dst.Readings(id)
+		if err != nil && err != errNotFound {
+			return report, err
+		}
+		report.Batteries++
+		if len(local) > 0 {
+			localDevSN, err := dst.DeviceFor(id)
+			if err != nil {
+				return report, err
+			}
+			importDevSN, err := src.DeviceFor(b.ID)
+			if err != nil {
+				return report, err
+			}
+			if localDevSN != "" && importDevSN != "" && localDevSN != importDevSN {
+				report.Conflicts = append(report.Conflicts, fmt.Sprintf("%s is attached to device \"%s\" here but to \"%s\" in the import", id, localDevSN, importDevSN))
+			}
+		}
+		existing := make(map[string]rrcBatteryData)
+		for _, r := range local {
+			existing[r.Timestamp] = r
+		}
+		for _, r := range incoming {
+			r.BatteryID = id
+			if have, ok := existing[r.Timestamp]; ok {
+				report.Duplicates++
+				if !reflect.DeepEqual(have, r) {
+					report.Conflicts = append(report.Conflicts, fmt.Sprintf("%s reading %s differs from the local one", id, r.Timestamp))
+				}
+				continue
+			}
+			report.NewReadings++
+			if err := dst.Append(r); err != nil {
+				return report, err
+			}
+		}
+	}
+	devices, err := src.Devices()
+	if err != nil {
+		return report, err
+	}
+	attachments, err := src.Attachments("")
+	if err != nil {
+		return report, err
+	}
+	for i, a := range attachments {
+		if id, ok := ids[a.BatteryID]; ok {
+			attachments[i].BatteryID = id
+		}
+	}
+	report.Registry, err = applyRegistry(dst, devices, attachments)
+	if err != nil {
+		return report, err
+	}
+	notes, err := src.Notes()
+	if err != nil {
+		return report, err
+	}
+	for i, n := range notes {
+		if id, ok := ids[n.BatteryID]; ok {
+			notes[i].BatteryID = id
+		}
+	}
+	report.Notes, err = applyNotes(dst, notes)
+	return report, err
+}
+
+// importProfiles merges the profiles of another data directory.
+func importProfiles(dataPath string, report *importReport, dryRun bool) error {
+	byteValue, err := os.ReadFile(filepath.Join(dataPath, filepath.Base(batteryProfiles)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	incoming, err := parseBatteryProfiles(byteValue)
+	if err != nil {
+		return err
+	}
+	local, err := loadProfileRecords()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	merged, changed, conflicts := mergeProfiles(local, incoming)
+	report.Profiles = changed
+	for _, c := range conflicts {
+		report.Conflicts = append(report.Conflicts, fmt.Sprintf("profile %s differs from the local one", c))
+	}
+	if dryRun || changed == 0 {
+		return nil
+	}
+	return saveProfileRecords(merged)
+}
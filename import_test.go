@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestImportSourceReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rrcreader.db")
+	store, err := openSQLStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, store, testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20))
+	store.Close()
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, _, err := openImportSource(dir, legacyZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readings, err := src.Readings("RRC2040-2#1"); err != nil || len(readings) != 1 {
+		t.Errorf("Readings = %d, %v, want 1", len(readings), err)
+	}
+	if err := src.Append(testReading("RRC2040-2", "#1", "2021-03-01T10:00:00Z", 30)); err != errReadOnly {
+		t.Errorf("Append = %v, want %v", err, errReadOnly)
+	}
+	src.Close()
+	if after, err := os.ReadFile(path); err != nil || !bytes.Equal(before, after) {
+		t.Errorf("source database changed by the import (%v)", err)
+	}
+
+	// A database of an older version is read from a migrated copy.
+	oldDir := t.TempDir()
+	oldPath := filepath.Join(oldDir, "rrcreader.db")
+	db, err := sql.Open("sqlite", oldPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(sqlSchema); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if src, _, err = openImportSource(oldDir, legacyZone); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Attachments(""); err != nil {
+		t.Errorf("Attachments of the migrated copy: %v", err)
+	}
+	src.Close()
+	if db, err = sql.Open("sqlite", oldPath); err != nil {
+		t.Fatal(err)
+	}
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil || version != 0 {
+		t.Errorf("source user_version = %d, %v, want 0", version, err)
+	}
+	db.Close()
+
+	jsonDir := t.TempDir()
+	jsonStore, err := openScribbleStore(filepath.Join(jsonDir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, jsonStore, testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20))
+	if src, _, err = openImportSource(jsonDir, legacyZone); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Attachments(""); err != nil {
+		t.Fatal(err)
+	}
+	src.Close()
+	if _, err := os.Stat(filepath.Join(jsonDir, "registry")); !os.IsNotExist(err) {
+		t.Errorf("registry directory created in the source (%v)", err)
+	}
+}
+
+func TestImportStoreIdentities(t *testing.T) {
+	fields := defaultIdentityFields
+	pack := testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20)
+	pack.MfgDate = "2020-1-10"
+	other := testReading("RRC2040-2", "#1", "2021-02-01T09:00:00Z", 5)
+	other.MfgDate = "2021-1-25"
+
+	dst := newMemStore()
+	appendAll(t, dst, pack)
+	src := newMemStore()
+	// The same pack under its composite key, and another pack holding the
+	// key the local pack is stored under.
+	samePack := pack
+	samePack.BatteryID = compositeID(pack, fields)
+	later := samePack
+	later.Timestamp, later.CycleCount = "2021-03-01T10:00:00Z", 30
+	appendAll(t, src, samePack, later, other)
+	if err := src.PutNote(note{ID: "n1", BatteryID: "RRC2040-2#1", Text: "new pack", Updated: "20210201090000.000000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := importStore(src, dst, fields, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.NewReadings != 2 || report.Duplicates != 1 || report.Notes != 1 || len(report.Identities) != 2 {
+		t.Errorf("dry run report = %+v, want 2 new readings, 1 duplicate, 1 note and 2 batteries under other keys", report)
+	}
+	if readings, _ := dst.Readings("RRC2040-2#1"); len(readings) != 1 {
+		t.Errorf("dry run stored %d readings, want none", len(readings)-1)
+	}
+
+	if _, err := importStore(src, dst, fields, false); err != nil {
+		t.Fatal(err)
+	}
+	if readings, err := dst.Readings("RRC2040-2#1"); err != nil || len(readings) != 2 {
+		t.Errorf("local pack has %d readings, %v, want 2", len(readings), err)
+	}
+	otherID := compositeID(other, fields)
+	if readings, err := dst.Readings(otherID); err != nil || len(readings) != 1 {
+		t.Errorf("other pack \"%s\" has %d readings, %v, want 1", otherID, len(readings), err)
+	}
+	if notes, err := dst.Notes(); err != nil || len(notes) != 1 || notes[0].BatteryID != otherID {
+		t.Errorf("Notes = %+v, %v, want the note moved to \"%s\"", notes, err, otherID)
+	}
+}
+
+// Timestamps the source wrote before version 2 are read in its own zone, so
+// a reading both stations have is not imported again, shifted.
+func TestImportSourceLegacyZone(t *testing.T) {
+	useUTC(t)
+	dir := t.TempDir()
+	recordDir := filepath.Join(dir, "db", "RRC2040-2#1")
+	if err := os.MkdirAll(recordDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(recordDir, "20210115123000.json"), []byte(legacyRecord), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "GeneralConfiguration.json"), []byte(`{"legacyzone": "Europe/Helsinki"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	name, err := sourceLegacyZone(dir)
+	if err != nil || name != "Europe/Helsinki" {
+		t.Fatalf("sourceLegacyZone = %q, %v, want Europe/Helsinki", name, err)
+	}
+	zone, err := loadLegacyZone(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, _, err := openImportSource(dir, zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst := newMemStore()
+	local, _, err := decodeRecord([]byte(legacyRecord))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Timestamp = "2021-01-15T10:30:00Z"
+	appendAll(t, dst, local)
+	report, err := importStore(src, dst, defaultIdentityFields, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.NewReadings != 0 || report.Duplicates != 1 {
+		t.Errorf("import: %+v, want the reading found as a duplicate", report)
+	}
+	if legacyZone != time.UTC {
+		t.Errorf("legacyZone left at %v, want UTC", legacyZone)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// changeEntry records one write to the store. Seq increases by one for every
+// entry; sync uses it to find what changed since the last exchange.
+type changeEntry struct {
+	Seq       int64  `json:"seq"`
+	Kind      string `json:"kind"`      // "reading", "delete", "device", "attachment" or "note"
+	BatteryID string `json:"battery"`   // battery key
+	Timestamp string `json:"timestamp"` // reading timestamp, attach time for attachments
+	Device    string `json:"device"`    // device serial for devices
+	Note      string `json:"note"`      // note id for notes
+	Origin    string `json:"origin"`    // station that produced the change, "" for this one
+	Time      string `json:"time"`      // when the change was recorded
+}
+
+// changeLog is an append-only JSON-lines journal of changes.
+type changeLog struct {
+	mu   sync.Mutex
+	path string
+	// newest sequence number and how much of which file it was read from,
+	// so a write only reads what other processes appended since
+	seq  int64
+	file os.FileInfo
+	size int64
+}
+
+func openChangeLog(path string) *changeLog {
+	return &changeLog{path: path}
+}
+
+// Entries returns every entry with a sequence number above since.
+func (l *changeLog) Entries(since int64) ([]changeEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.entries(since)
+}
+
+func (l *changeLog) entries(since int64) ([]changeEntry, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	entries := []changeEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry changeEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn last line from an interrupted write is not fatal.
+			continue
+		}
+		if entry.Seq > since {
+			// Entries written before version 2 hold old local timestamps.
+			entry.Timestamp = normalizeTimestamp(entry.Timestamp)
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// LastSeq returns the sequence number of the newest entry, 0 if none.
+func (l *changeLog) LastSeq() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastSeq()
+}
+
+func (l *changeLog) lastSeq() (int64, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			l.seq, l.file, l.size = 0, nil, 0
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	// Compaction replaces the file; start over when it is not the one read.
+	if l.file == nil || !os.SameFile(l.file, info) || info.Size() < l.size {
+		l.seq, l.size = 0, 0
+	}
+	l.file = info
+	if info.Size() == l.size {
+		return l.seq, nil
+	}
+	if _, err := f.Seek(l.size, io.SeekStart); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// An unfinished line is read again once it is complete.
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		l.size += int64(len(line))
+		var entry changeEntry
+		if json.Unmarshal(line, &entry) == nil && entry.Seq > l.seq {
+			l.seq = entry.Seq
+		}
+	}
+	return l.seq, nil
+}
+
+// Record appends an entry and assigns its sequence number. The lock file
+// <path>.lock keeps other processes from assigning the same number.
+func (l *changeLog) Record(entry changeEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock, err := lockFile(l.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	seq, err := l.lastSeq()
+	if err != nil {
+		return err
+	}
+	entry.Seq = seq + 1
+	if entry.Time == "" {
+		entry.Time = formatTimestamp(time.Now())
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	l.seq = entry.Seq
+	l.size += int64(len(line)) + 1
+	return nil
+}
+
+// changeKey identifies what an entry changed; a later entry with the same
+// key supersedes it.
+func changeKey(e changeEntry) string {
+	switch e.Kind {
+	case "reading", "delete":
+		return "reading\x00" + e.BatteryID + "\x00" + e.Timestamp
+	case "device":
+		return "device\x00" + e.Device
+	case "attachment":
+		return "attachment\x00" + e.BatteryID + "\x00" + e.Timestamp
+	case "note":
+		return "note\x00" + e.Note
+	}
+	return e.Kind
+}
+
+// Compact drops the entries superseded by a later one for the same reading,
+// device, attachment or note. The kept entries keep their sequence numbers,
+// so the sync cursors of other stations stay valid. It returns how many
+// entries were kept and removed.
+func (l *changeLog) Compact() (int, int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock, err := lockFile(l.path + ".lock")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer lock.Unlock()
+	entries, err := l.entries(0)
+	if err != nil || len(entries) == 0 {
+		return 0, 0, err
+	}
+	latest := make(map[string]int64)
+	for _, e := range entries {
+		latest[changeKey(e)] = e.Seq
+	}
+	var buf bytes.Buffer
+	kept := 0
+	for _, e := range entries {
+		if latest[changeKey(e)] != e.Seq {
+			continue
+		}
+		line, err := json.Marshal(e)
+		if err != nil {
+			return 0, 0, err
+		}
+		buf.Write(append(line, '\n'))
+		kept++
+	}
+	if kept == len(entries) {
+		return kept, 0, nil
+	}
+	if err := atomicWriteFile(l.path, buf.Bytes(), 0644); err != nil {
+		return 0, 0, err
+	}
+	l.file = nil
+	return kept, len(entries) - kept, nil
+}
+
+// trackedStore records every write in a change log.
+type trackedStore struct {
+	Store
+	log    *changeLog
+	origin string
+}
+
+func newTrackedStore(store Store, log *changeLog, origin string) *trackedStore {
+	return &trackedStore{Store: store, log: log, origin: origin}
+}
+
+func (s *trackedStore) Append(reading rrcBatteryData) error {
+	if err := s.Store.Append(reading); err != nil {
+		return err
+	}
+	return s.log.Record(changeEntry{
+		Kind:      "reading",
+		BatteryID: batteryKey(reading),
+		Timestamp: reading.Timestamp,
+		Origin:    s.origin,
+	})
+}
+
+func (s *trackedStore) Delete(batteryID, timestamp string) error {
+	if err := s.Store.Delete(batteryID, timestamp); err != nil {
+		return err
+	}
+	return s.log.Record(changeEntry{
+		Kind:      "delete",
+		BatteryID: batteryID,
+		Timestamp: timestamp,
+		Origin:    s.origin,
+	})
+}
+
+func (s *trackedStore) PutDevice(device deviceRecord) error {
+	if err := s.Store.PutDevice(device); err != nil {
+		return err
+	}
+	return s.log.Record(changeEntry{
+		Kind:   "device",
+		Device: device.Serial,
+		Origin: s.origin,
+	})
+}
+
+func (s *trackedStore) PutAttachment(a attachment) error {
+	if err := s.Store.PutAttachment(a); err != nil {
+		return err
+	}
+	return s.log.Record(changeEntry{
+		Kind:      "attachment",
+		BatteryID: a.BatteryID,
+		Timestamp: a.Attached,
+		Origin:    s.origin,
+	})
+}
+
+func (s *trackedStore) PutNote(n note) error {
+	if err := s.Store.PutNote(n); err != nil {
+		return err
+	}
+	return s.log.Record(changeEntry{
+		Kind:   "note",
+		Note:   n.ID,
+		Origin: s.origin,
+	})
+}
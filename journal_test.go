@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestChangeLogSequence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "changelog.jsonl")
+	first, second := openChangeLog(path), openChangeLog(path)
+	for i, l := range []*changeLog{first, first, second, first} {
+		if err := l.Record(changeEntry{Kind: "note", Note: "n1"}); err != nil {
+			t.Fatal(err)
+		}
+		if seq, err := l.LastSeq(); err != nil || seq != int64(i+1) {
+			t.Fatalf("after write #%d: LastSeq = %d, %v, want %d", i+1, seq, err, i+1)
+		}
+	}
+}
+
+func TestChangeLogCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "changelog.jsonl")
+	l := openChangeLog(path)
+	for _, e := range []changeEntry{
+		{Kind: "reading", BatteryID: "RRC2040-2#1", Timestamp: "2021-01-15T12:30:00Z"},
+		{Kind: "note", Note: "n1"},
+		{Kind: "delete", BatteryID: "RRC2040-2#1", Timestamp: "2021-01-15T12:30:00Z"},
+		{Kind: "reading", BatteryID: "RRC2040-2#1", Timestamp: "2021-03-01T10:00:00Z"},
+		{Kind: "note", Note: "n1"},
+	} {
+		if err := l.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kept, removed, err := l.Compact()
+	if err != nil || kept != 3 || removed != 2 {
+		t.Fatalf("Compact = %d, %d, %v, want 3 kept and 2 removed", kept, removed, err)
+	}
+	entries, err := openChangeLog(path).Entries(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqs := []int64{}
+	for _, e := range entries {
+		seqs = append(seqs, e.Seq)
+	}
+	if len(seqs) != 3 || seqs[0] != 3 || seqs[1] != 4 || seqs[2] != 5 {
+		t.Errorf("entries after compaction have seq %v, want [3 4 5]", seqs)
+	}
+	if err := l.Record(changeEntry{Kind: "note", Note: "n2"}); err != nil {
+		t.Fatal(err)
+	}
+	if seq, err := openChangeLog(path).LastSeq(); err != nil || seq != 6 {
+		t.Errorf("LastSeq after compaction = %d, %v, want 6", seq, err)
+	}
+}
@@ -24,7 +24,18 @@ func main() {
 		ReadTimeout: time.Millisecond * 30000,
 	}
 	replaceInputStr, platformName := platformSpecifics()
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		// Reading the configuration would first create the default files,
+		// which the restore then refuses to overwrite.
+		os.Exit(runCommand(os.Args[1:], &generalConfiguration{}))
+	}
 	genConfig := readCfgFile()
+	if err := setLegacyZone(genConfig.LegacyZone); err != nil {
+		log.Fatalf("Error in \"%s\": %v\n", configFile, err)
+	}
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:], &genConfig))
+	}
 	config.Name = genConfig.SerialPort
 	proceedCondition := false
 	DevSNFMT := "(none)"
@@ -44,6 +55,9 @@ func main() {
 			time.Sleep(time.Millisecond * 100)
 			fmt.Printf("Waiting for data (%s) ... ", config.Name)
 			proceedCondition = true
+		case "Monitor battery":
+			time.Sleep(time.Millisecond * 100)
+			monitorBattery(config, genConfig, demoData, omitWrites)
 		case "Serial config":
 			time.Sleep(time.Millisecond * 100)
 			fmt.Printf("Enter port [%s]:> ", config.Name)
@@ -67,229 +81,122 @@ func main() {
 			break
 		}
 	}
-	const startendLine string = "-----------------------------------"
 	thisBattery := new(rrcBatteryData)
 	if !demoData {
-		stream, err := serial.OpenPort(config)
-		if err != nil {
-			log.Fatal(err)
-		}
-		scanner := bufio.NewScanner(stream)
-		buf := make([]byte, maxRx)
-		scanner.Buffer(buf, maxRx)
-		scanner.Split(ScanCR)
-		scannerState := false
-		scannedLine := ""
-		var unknownFields []string
-		for scanner.Scan() {
-			scannedLine = scanner.Text()
-			if scannerState {
-				if scannedLine != startendLine {
-					splitted := strings.Split(scannedLine, ":")
-					splitted[0] = strings.TrimSpace(splitted[0])
-					splitted[1] = strings.TrimSpace(splitted[1])
-					switch splitted[0] {
-					case "MANUFACTURER":
-						thisBattery.Manufacturer = splitted[1]
-					case "BATTERY NAME":
-						thisBattery.Name = splitted[1]
-					case "CHEMISTRY":
-						thisBattery.Chemistry = splitted[1]
-					case "SPECIFICATION":
-						thisBattery.Specification = splitted[1]
-					case "SERIAL NUMBER":
-						thisBattery.SerialNumber = splitted[1]
-					case "MANUFACT. DATE":
-						thisBattery.MfgDate = splitted[1]
-					case "VOLTAGE":
-						thisBattery.Voltage, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error(voltage): %v", err)
-						}
-					case "VOLTAGE MEASURED":
-						thisBattery.VoltageMeasured, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error(voltmeasured): %v", err)
-						}
-					case "CURRENT":
-						thisBattery.Current, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error(current): %v", err)
-						}
-					case "TEMPERATURE":
-						tempK, tempC, err := parseTemps(splitted[1])
-						if err != "" {
-							fmt.Printf("Error(s) encountered: parseTemps(%s) %v\n", splitted[1], err)
-							thisBattery.TemperatureK = 0.0
-							thisBattery.TemperatureC = 0.0
-						} else {
-							thisBattery.TemperatureK = tempK
-							thisBattery.TemperatureC = tempC
-						}
-					case "NTC MEASURED":
-						thisBattery.NTC, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error: %v", err)
-						}
-					case "RELATIVE CHARGE":
-						thisBattery.RelativeCharge, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error: %v", err)
-						}
-					case "ABSOLUTE CHARGE":
-						thisBattery.AbsoluteCharge, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error: %v", err)
-						}
-					case "DESIGN CAPACITY":
-						thisBattery.DesignCapacity, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error: %v", err)
-						}
-					case "DESIGN VOLTAGE":
-						thisBattery.DesignVoltage, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error: %v", err)
-						}
-					case "REMAIN. CAPACITY":
-						thisBattery.RemainingCapacity, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error: %v", err)
-						}
-					case "FULL CAPACITY":
-						thisBattery.FullCapacity, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error: %v", err)
-						}
-					case "CHARGING VOLTAGE":
-						thisBattery.ChargingVoltage, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error: %v", err)
-						}
-					case "CHARGING CURRENT":
-						thisBattery.ChargingCurrent, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error: %v", err)
-						}
-					case "TIME TO EMPTY":
-						thisBattery.TimeToEmpty, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error: %v", err)
-						}
-					case "TIME TO FULL":
-						thisBattery.TimeToFull, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error: %v", err)
-						}
-					case "CAPACITY ALARM":
-						thisBattery.CapacityAlarm, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error: %v", err)
-						}
-					case "TIME ALARM":
-						thisBattery.TimeAlarm, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error: %v", err)
-						}
-					case "CYCLE COUNT":
-						thisBattery.CycleCount, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error: %v", err)
-						}
-					case "MAX ERROR":
-						thisBattery.MaxError, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
-						if err != nil {
-							fmt.Printf("Conversion error: %v", err)
-						}
-					case "STATE REGISTER":
-						thisBattery.StateRegister = splitted[1]
-					case "MODE REGISTER":
-						thisBattery.ModeRegister = splitted[1]
-					case "OptMfg 0x2f":
-						thisBattery.OptMfg2f = splitted[1]
-					case "OptMfg 0x3c":
-						thisBattery.OptMfg3c = splitted[1]
-					case "OptMfg 0x3d":
-						thisBattery.OptMfg3d = splitted[1]
-					case "OptMfg 0x3e":
-						thisBattery.OptMfg3e = splitted[1]
-					case "OptMfg 0x3f":
-						thisBattery.OptMfg3f = splitted[1]
-					case "BATTERY USES PEC":
-						thisBattery.BatteryUsesPEC = splitted[1]
-					default:
-						unknownFields = append(unknownFields, fmt.Sprintf("\"Unspecified: %s (= %s)\"", splitted[0], splitted[1]))
-					}
-				}
-			}
-			if scannedLine == startendLine {
-				scannerState = !scannerState
-				if !scannerState {
-					stream.Flush()
-					stream.Close()
-					break
-				} else {
-					fmt.Printf("OK!\n")
-				}
-			}
-		}
-		if err := scanner.Err(); err != nil {
-			log.Fatal(err)
-		}
-		if len(unknownFields) != 0 {
-			fmt.Println("Warning! Following entries were discarded (unknown data):")
-			fmt.Printf("%s\n", unknownFields)
-		}
+		*thisBattery = readSerial(config)
 	} else {
 		*thisBattery = demoBat(DevSNFMT)
 	}
-	var retData []rrcBatteryData
-	var retCode int
-
-	retData, retCode = dbhandler("check", dbDir, *thisBattery)
-	if retCode != 0 {
-		fmt.Printf("New battery? Attach to device :>")
+	store, err := openStore(genConfig)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v\n", err)
+	}
+	thisBattery.BatteryID, err = resolveBatteryID(store, *thisBattery, identityFields(genConfig))
+	if err != nil {
+		fmt.Printf("Database read error: %v\n", err)
+	}
+	batteryID := batteryKey(*thisBattery)
+	devSN, err := store.DeviceFor(batteryID)
+	newDevice := false
+	if err != nil || devSN == "" {
+		if err != nil && err != errNotFound {
+			fmt.Printf("Database read error: %v\n", err)
+		}
+		if err == nil {
+			fmt.Printf("Battery is not attached to a device. Attach to device :>")
+		} else {
+			fmt.Printf("New battery? Attach to device :>")
+		}
 		time.Sleep(time.Millisecond * 100)
 		reader := bufio.NewReader(os.Stdin)
 		text, _ := reader.ReadString('\n')
 		text = strings.Replace(text, replaceInputStr, "", -1)
 		if text != "" {
 			thisBattery.DevSerialNumber = text
+			newDevice = true
 		} else {
 			thisBattery.DevSerialNumber = ""
 		}
 	} else {
-		for i := range retData {
-			thisBattery.DevSerialNumber = retData[i].DevSerialNumber
-		}
+		thisBattery.DevSerialNumber = devSN
 		fmt.Printf("Battery identified! Associated device sn:\"%s\"\n", thisBattery.DevSerialNumber)
 	}
 	tStamp := time.Now()
-	thisBattery.Timestamp = tStamp.Format(fmtDateTime)
+	thisBattery.Timestamp = formatTimestamp(tStamp)
+	thisBattery.Zone = zoneOf(tStamp)
+	thisBattery.SchemaVersion = recordVersion
+	setStateOfHealth(thisBattery)
+	thisBattery.Health = rateReading(*thisBattery)
+	fmt.Print(thisBattery.Health)
+	fmt.Printf("Chemistry: %s\n", chemistrySummary(*thisBattery))
+	if models, err := loadBatteryModels(); err != nil {
+		fmt.Printf("Error reading \"%s\": %v\n", batteryModelsFile, err)
+	} else {
+		fmt.Print(modelSummary(models, *thisBattery))
+	}
 
+	action := duplicateKeep
+	var earlier rrcBatteryData
 	if !omitWrites {
-		_, retCode = dbhandler("write", dbDir, *thisBattery)
-		if retCode != 0 {
-			fmt.Printf("dbhandler(write>%s) returned: %d\n", dbDir, retCode)
+		if _, err := backfillAttachments(store, batteryID); err != nil && err != errNotFound {
+			fmt.Printf("Database write error: %v\n", err)
+		}
+		window, err := duplicateWindow(genConfig)
+		if err != nil {
+			fmt.Printf("Invalid duplicate window: %v\n", err)
+		}
+		history, err := store.Readings(batteryID)
+		if err != nil && err != errNotFound {
+			fmt.Printf("Database read error: %v\n", err)
+		}
+		if found, ok := findDuplicate(history, *thisBattery, window); ok {
+			earlier = found
+			action = promptDuplicate(earlier, *thisBattery)
 		}
 	}
-	var dbArgData rrcBatteryData
-	dbArgData.Name = thisBattery.Name
-	dbArgData.SerialNumber = thisBattery.SerialNumber
-	dbArgData.DevSerialNumber = DevSNFMT
-
-	retData, retCode = dbhandler("read", dbDir, dbArgData)
-	recEntryAmt := 0
-	if retCode == 0 {
-		for _, f := range retData {
-			if f.DevSerialNumber != thisBattery.DevSerialNumber {
-				fmt.Printf("Warning! Record %d: \"%s-%sT%s\" device association mismatch!\nGot: \"%s\". Expected: \"%s\".\n", recEntryAmt, f.Name, f.SerialNumber, f.Timestamp, f.DevSerialNumber, thisBattery.DevSerialNumber)
+	if !omitWrites && action != duplicateSkip {
+		if err := store.Append(*thisBattery); err != nil {
+			fmt.Printf("Database write error: %v\n", err)
+		} else if action == duplicateReplace {
+			if err := replaceReading(store, earlier, *thisBattery); err != nil {
+				fmt.Printf("Database write error: %v\n", err)
+			}
+		}
+		if newDevice {
+			if err := attachBattery(store, batteryID, thisBattery.DevSerialNumber, thisBattery.Timestamp, false); err != nil {
+				fmt.Printf("Database write error: %v\n", err)
+			}
+		}
+		reader := bufio.NewReader(os.Stdin)
+		fmt.Printf("Note for this reading (empty to skip) :>")
+		text, _ := reader.ReadString('\n')
+		text = strings.Replace(text, replaceInputStr, "", -1)
+		fmt.Printf("Tags, comma separated (e.g. dropped, swollen) :>")
+		tags, _ := reader.ReadString('\n')
+		tags = strings.Replace(tags, replaceInputStr, "", -1)
+		if text != "" || tags != "" {
+			_, err := addNote(store, genConfig, note{BatteryID: batteryID, Timestamp: thisBattery.Timestamp, Text: text, Tags: parseTags(tags)})
+			if err != nil {
+				fmt.Printf("Database write error: %v\n", err)
 			}
-			recEntryAmt++
 		}
 	}
-	if retCode != 0 {
-		fmt.Printf("dbhandler(read>%s) returned: %d\n", dbDir, retCode)
+	readings, err := store.Readings(batteryID)
+	if err != nil {
+		fmt.Printf("Database read error: %v\n", err)
+	}
+	attachments, err := store.Attachments(batteryID)
+	if err != nil {
+		fmt.Printf("Database read error: %v\n", err)
+	}
+	for recEntryAmt, f := range readings {
+		expected := thisBattery.DevSerialNumber
+		if len(liveAttachments(attachments)) > 0 {
+			expected = deviceAt(attachments, f.Timestamp)
+		}
+		if hasDevice(f.DevSerialNumber) && f.DevSerialNumber != expected {
+			fmt.Printf("Warning! Record %d: \"%s-%sT%s\" device association mismatch!\nGot: \"%s\". Expected: \"%s\".\n", recEntryAmt, f.Name, f.SerialNumber, f.Timestamp, f.DevSerialNumber, expected)
+		}
 	}
 
 	/*saveAs := fmt.Sprintf("./data/%sT%v-%s", thisBattery.DevSerialNumber, tStamp.Format(fmtDateTime), stripValues(thisBattery.SerialNumber))
@@ -299,11 +206,189 @@ func main() {
 		fmt.Printf("Error writing to file: %v", err)
 		os.Exit(1)
 	}*/
-	generateGraphs(*thisBattery)
-	err := writeCfgFile(genConfig)
+	generateGraphs(store, genConfig, *thisBattery)
+	store.Close()
+	err = writeCfgFile(genConfig)
 	if err != nil {
 		fmt.Printf("Error writing\"%s\":%v\n", configFile, err)
 	}
 	fmt.Printf("All done!\n")
 	os.Exit(0)
 }
+
+// readSerial waits for the next readout on the serial port and parses it.
+func readSerial(config *serial.Config) rrcBatteryData {
+	const startendLine string = "-----------------------------------"
+	thisBattery := new(rrcBatteryData)
+	stream, err := serial.OpenPort(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	scanner := bufio.NewScanner(stream)
+	buf := make([]byte, maxRx)
+	scanner.Buffer(buf, maxRx)
+	scanner.Split(ScanCR)
+	scannerState := false
+	scannedLine := ""
+	var unknownFields []string
+	for scanner.Scan() {
+		scannedLine = scanner.Text()
+		if scannerState {
+			if scannedLine != startendLine {
+				splitted := strings.Split(scannedLine, ":")
+				splitted[0] = strings.TrimSpace(splitted[0])
+				splitted[1] = strings.TrimSpace(splitted[1])
+				switch splitted[0] {
+				case "MANUFACTURER":
+					thisBattery.Manufacturer = splitted[1]
+				case "BATTERY NAME":
+					thisBattery.Name = splitted[1]
+				case "CHEMISTRY":
+					thisBattery.Chemistry = splitted[1]
+				case "SPECIFICATION":
+					thisBattery.Specification = splitted[1]
+				case "SERIAL NUMBER":
+					thisBattery.SerialNumber = splitted[1]
+				case "MANUFACT. DATE":
+					thisBattery.MfgDate = splitted[1]
+				case "VOLTAGE":
+					thisBattery.Voltage, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error(voltage): %v", err)
+					}
+				case "VOLTAGE MEASURED":
+					thisBattery.VoltageMeasured, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error(voltmeasured): %v", err)
+					}
+				case "CURRENT":
+					thisBattery.Current, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error(current): %v", err)
+					}
+				case "TEMPERATURE":
+					tempK, tempC, err := parseTemps(splitted[1])
+					if err != "" {
+						fmt.Printf("Error(s) encountered: parseTemps(%s) %v\n", splitted[1], err)
+						thisBattery.TemperatureK = 0.0
+						thisBattery.TemperatureC = 0.0
+					} else {
+						thisBattery.TemperatureK = tempK
+						thisBattery.TemperatureC = tempC
+					}
+				case "NTC MEASURED":
+					thisBattery.NTC, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error: %v", err)
+					}
+				case "RELATIVE CHARGE":
+					thisBattery.RelativeCharge, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error: %v", err)
+					}
+				case "ABSOLUTE CHARGE":
+					thisBattery.AbsoluteCharge, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error: %v", err)
+					}
+				case "DESIGN CAPACITY":
+					thisBattery.DesignCapacity, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error: %v", err)
+					}
+				case "DESIGN VOLTAGE":
+					thisBattery.DesignVoltage, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error: %v", err)
+					}
+				case "REMAIN. CAPACITY":
+					thisBattery.RemainingCapacity, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error: %v", err)
+					}
+				case "FULL CAPACITY":
+					thisBattery.FullCapacity, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error: %v", err)
+					}
+				case "CHARGING VOLTAGE":
+					thisBattery.ChargingVoltage, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error: %v", err)
+					}
+				case "CHARGING CURRENT":
+					thisBattery.ChargingCurrent, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error: %v", err)
+					}
+				case "TIME TO EMPTY":
+					thisBattery.TimeToEmpty, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error: %v", err)
+					}
+				case "TIME TO FULL":
+					thisBattery.TimeToFull, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error: %v", err)
+					}
+				case "CAPACITY ALARM":
+					thisBattery.CapacityAlarm, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error: %v", err)
+					}
+				case "TIME ALARM":
+					thisBattery.TimeAlarm, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error: %v", err)
+					}
+				case "CYCLE COUNT":
+					thisBattery.CycleCount, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error: %v", err)
+					}
+				case "MAX ERROR":
+					thisBattery.MaxError, err = strconv.Atoi(strings.TrimSpace(stripValues(splitted[1])))
+					if err != nil {
+						fmt.Printf("Conversion error: %v", err)
+					}
+				case "STATE REGISTER":
+					thisBattery.StateRegister = splitted[1]
+				case "MODE REGISTER":
+					thisBattery.ModeRegister = splitted[1]
+				case "OptMfg 0x2f":
+					thisBattery.OptMfg2f = splitted[1]
+				case "OptMfg 0x3c":
+					thisBattery.OptMfg3c = splitted[1]
+				case "OptMfg 0x3d":
+					thisBattery.OptMfg3d = splitted[1]
+				case "OptMfg 0x3e":
+					thisBattery.OptMfg3e = splitted[1]
+				case "OptMfg 0x3f":
+					thisBattery.OptMfg3f = splitted[1]
+				case "BATTERY USES PEC":
+					thisBattery.BatteryUsesPEC = splitted[1]
+				default:
+					unknownFields = append(unknownFields, fmt.Sprintf("\"Unspecified: %s (= %s)\"", splitted[0], splitted[1]))
+				}
+			}
+		}
+		if scannedLine == startendLine {
+			scannerState = !scannerState
+			if !scannerState {
+				stream.Flush()
+				stream.Close()
+				break
+			} else {
+				fmt.Printf("OK!\n")
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	if len(unknownFields) != 0 {
+		fmt.Println("Warning! Following entries were discarded (unknown data):")
+		fmt.Printf("%s\n", unknownFields)
+	}
+	return *thisBattery
+}
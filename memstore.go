@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// memStore is a Store kept in memory. The store tests run the same
+// contract against it and the file and SQL backends.
+type memStore struct {
+	mu          sync.Mutex
+	readings    map[string][]rrcBatteryData
+	devices     map[string]deviceRecord
+	attachments []attachment
+	notes       map[string]note
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		readings: make(map[string][]rrcBatteryData),
+		devices:  make(map[string]deviceRecord),
+		notes:    make(map[string]note),
+	}
+}
+
+func (s *memStore) Readings(batteryID string) ([]rrcBatteryData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	readings, ok := s.readings[batteryID]
+	if !ok {
+		return nil, errNotFound
+	}
+	// Like the stored records of the other backends, readings kept with an
+	// older schema version are upgraded when they are read.
+	list := []rrcBatteryData{}
+	for _, r := range readings {
+		upgraded, err := upgradeReading(r)
+		if err != nil {
+			skipRecord(fmt.Sprintf("%s %s", batteryID, r.Timestamp), err)
+			continue
+		}
+		list = append(list, upgraded)
+	}
+	sortReadings(list)
+	return list, nil
+}
+
+func (s *memStore) Append(reading rrcBatteryData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := batteryKey(reading)
+	readings := s.readings[id]
+	replaced := false
+	for i := range readings {
+		if normalizeTimestamp(readings[i].Timestamp) == normalizeTimestamp(reading.Timestamp) {
+			readings[i] = reading
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		readings = append(readings, reading)
+	}
+	sortReadings(readings)
+	s.readings[id] = readings
+	return nil
+}
+
+func (s *memStore) Delete(batteryID, timestamp string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	readings, ok := s.readings[batteryID]
+	if !ok {
+		return errNotFound
+	}
+	for i := range readings {
+		if normalizeTimestamp(readings[i].Timestamp) == normalizeTimestamp(timestamp) {
+			readings = append(readings[:i], readings[i+1:]...)
+			if len(readings) == 0 {
+				delete(s.readings, batteryID)
+			} else {
+				s.readings[batteryID] = readings
+			}
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (s *memStore) DeviceFor(batteryID string) (string, error) {
+	readings, err := s.Readings(batteryID)
+	if err != nil {
+		return "", err
+	}
+	attachments, err := s.Attachments(batteryID)
+	if err != nil {
+		return "", err
+	}
+	return deviceFromHistory(batteryID, attachments, readings), nil
+}
+
+func (s *memStore) Devices() ([]deviceRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []deviceRecord{}
+	for _, d := range s.devices {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Serial < list[j].Serial })
+	return list, nil
+}
+
+func (s *memStore) PutDevice(device deviceRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices[device.Serial] = device
+	return nil
+}
+
+func (s *memStore) Attachments(batteryID string) ([]attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []attachment{}
+	for _, a := range s.attachments {
+		if batteryID == "" || a.BatteryID == batteryID {
+			list = append(list, a)
+		}
+	}
+	sortAttachments(list)
+	return list, nil
+}
+
+func (s *memStore) PutAttachment(a attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.attachments {
+		if s.attachments[i].BatteryID == a.BatteryID && s.attachments[i].Attached == a.Attached {
+			s.attachments[i] = a
+			return nil
+		}
+	}
+	s.attachments = append(s.attachments, a)
+	return nil
+}
+
+func (s *memStore) Notes() ([]note, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []note{}
+	for _, n := range s.notes {
+		list = append(list, n)
+	}
+	sortNotes(list)
+	return list, nil
+}
+
+func (s *memStore) PutNote(n note) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notes[n.ID] = n
+	return nil
+}
+
+func (s *memStore) ListBatteries(filter batteryFilter) ([]batterySummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []batterySummary{}
+	for id, readings := range s.readings {
+		if summary := summarize(id, readings); filter.match(summary) {
+			list = append(list, summary)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+func (s *memStore) Verify() (verifyReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var report verifyReport
+	for id, readings := range s.readings {
+		for _, r := range readings {
+			payload, err := json.Marshal(r)
+			if err != nil {
+				return report, err
+			}
+			report.verifyRecord(fmt.Sprintf("%s %s", id, r.Timestamp), id, r.Timestamp, payload)
+		}
+	}
+	return report, nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// batteryModel is the rated specification of a pack model. Readouts that
+// differ from it point to counterfeit, mis-programmed or rebuilt packs.
+type batteryModel struct {
+	Name           string `json:"name"`           // battery name as reported, e.g. "RRC2040-2"
+	Manufacturer   string `json:"manufacturer"`   // (optional) e.g. "RRC"
+	DesignCapacity int    `json:"designcapacity"` // rated capacity in mAh
+	DesignVoltage  int    `json:"designvoltage"`  // rated voltage in mV
+	Chemistry      string `json:"chemistry"`      // e.g. "LION"
+	Cells          string `json:"cells"`          // cell configuration, e.g. "3S2P"
+}
+
+// builtinModels are the models known without a BatteryModels.json. Entries
+// in the file replace them by name.
+var builtinModels = []batteryModel{
+	{Name: "RRC2020", Manufacturer: "RRC", DesignCapacity: 3200, DesignVoltage: 10800, Chemistry: "LION", Cells: "3S1P"},
+	{Name: "RRC2040-2", Manufacturer: "RRC", DesignCapacity: 6900, DesignVoltage: 10800, Chemistry: "LION", Cells: "3S2P"},
+}
+
+// loadBatteryModels returns the built-in models merged with the ones in
+// BatteryModels.json, sorted by name.
+func loadBatteryModels() ([]batteryModel, error) {
+	models := make(map[string]batteryModel)
+	for _, m := range builtinModels {
+		models[strings.ToUpper(m.Name)] = m
+	}
+	byteValue, err := os.ReadFile(batteryModelsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var list []batteryModel
+		if err := json.Unmarshal(byteValue, &list); err != nil {
+			return nil, positionError(byteValue, err, "model")
+		}
+		for i, m := range list {
+			if strings.TrimSpace(m.Name) == "" {
+				return nil, fmt.Errorf("model #%d has no name", i+1)
+			}
+			if m.Cells != "" {
+				if _, _, err := parseCells(m.Cells); err != nil {
+					return nil, fmt.Errorf("model %s: %w", m.Name, err)
+				}
+			}
+			models[strings.ToUpper(m.Name)] = m
+		}
+	}
+	list := []batteryModel{}
+	for _, m := range models {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// findModel returns the model a battery reports itself as.
+func findModel(models []batteryModel, dataset rrcBatteryData) (batteryModel, bool) {
+	for _, m := range models {
+		if strings.EqualFold(m.Name, strings.TrimSpace(dataset.Name)) {
+			return m, true
+		}
+	}
+	return batteryModel{}, false
+}
+
+// parseCells splits a cell configuration such as "3S2P" into cells in
+// series and in parallel.
+func parseCells(cells string) (series, parallel int, err error) {
+	if _, err := fmt.Sscanf(strings.ToUpper(cells), "%dS%dP", &series, &parallel); err != nil || series < 1 || parallel < 1 {
+		return 0, 0, fmt.Errorf("invalid cell configuration \"%s\", e.g. 3S2P", cells)
+	}
+	return series, parallel, nil
+}
+
+// describeModel is a one line summary of the rated values.
+func describeModel(m batteryModel) string {
+	return fmt.Sprintf("%s: %d mAh, %.1f V, %s %s", m.Name, m.DesignCapacity, float64(m.DesignVoltage)/1000, m.Chemistry, m.Cells)
+}
+
+// checkModel compares a reading with the rated values of its model. Values
+// the model leaves at 0 or "" are not checked.
+func checkModel(m batteryModel, dataset rrcBatteryData) []string {
+	problems := []string{}
+	if m.DesignCapacity > 0 && dataset.DesignCapacity != m.DesignCapacity {
+		problems = append(problems, fmt.Sprintf("design capacity %d mAh, %s is rated %d mAh", dataset.DesignCapacity, m.Name, m.DesignCapacity))
+	}
+	if m.DesignVoltage > 0 && dataset.DesignVoltage != m.DesignVoltage {
+		problems = append(problems, fmt.Sprintf("design voltage %d mV, %s is rated %d mV", dataset.DesignVoltage, m.Name, m.DesignVoltage))
+	}
+	if m.Chemistry != "" && !sameChemistry(m.Chemistry, dataset.Chemistry) {
+		problems = append(problems, fmt.Sprintf("chemistry \"%s\", %s is %s", dataset.Chemistry, m.Name, m.Chemistry))
+	}
+	if m.Manufacturer != "" && dataset.Manufacturer != "" && !strings.EqualFold(strings.TrimSpace(dataset.Manufacturer), m.Manufacturer) {
+		problems = append(problems, fmt.Sprintf("manufacturer \"%s\", %s is made by %s", dataset.Manufacturer, m.Name, m.Manufacturer))
+	}
+	if series, _, err := parseCells(m.Cells); err == nil {
+		if cells, ok := seriesCells(dataset); ok && cells != series {
+			problems = append(problems, fmt.Sprintf("design voltage means %d cells in series, %s has %s", cells, m.Name, m.Cells))
+		}
+		// The pack reports up to four cell voltages.
+		if reported := len(cellVoltages(dataset)); reported > 0 && series <= 4 && reported != series {
+			problems = append(problems, fmt.Sprintf("%d cell voltages reported, %s has %s", reported, m.Name, m.Cells))
+		}
+	}
+	return problems
+}
+
+// sameChemistry compares chemistries through the catalogue, so "LION" and
+// "Li-ion" are the same.
+func sameChemistry(a, b string) bool {
+	specA, okA := lookupChemistry(a)
+	specB, okB := lookupChemistry(b)
+	if okA && okB {
+		return specA.Name == specB.Name
+	}
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+// modelWarnings checks every reading of a battery against its model and
+// returns each mismatch once, with how many readings show it.
+func modelWarnings(models []batteryModel, readings []rrcBatteryData) []string {
+	warnings := []string{}
+	count := make(map[string]int)
+	first := make(map[string]string)
+	checked := 0
+	for _, r := range readings {
+		m, ok := findModel(models, r)
+		if !ok {
+			continue
+		}
+		checked++
+		for _, problem := range checkModel(m, r) {
+			if count[problem] == 0 {
+				warnings = append(warnings, problem)
+				first[problem] = r.Timestamp
+			}
+			count[problem]++
+		}
+	}
+	for i, w := range warnings {
+		if count[w] < checked {
+			warnings[i] = fmt.Sprintf("%s (%d of %d readings, first %s)", w, count[w], checked, first[w])
+		}
+	}
+	return warnings
+}
+
+// modelSummary describes how a reading compares to its model for the
+// terminal.
+func modelSummary(models []batteryModel, dataset rrcBatteryData) string {
+	m, ok := findModel(models, dataset)
+	if !ok {
+		return fmt.Sprintf("Model: \"%s\" not in the catalogue\n", dataset.Name)
+	}
+	problems := checkModel(m, dataset)
+	if len(problems) == 0 {
+		return fmt.Sprintf("Model: matches %s\n", describeModel(m))
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Warning! Model mismatch, counterfeit, mis-programmed or rebuilt pack? Rated %s\n", describeModel(m))
+	for _, p := range problems {
+		fmt.Fprintf(&b, "  - %s\n", p)
+	}
+	return b.String()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	serial "github.com/tarm/serial"
+)
+
+// demoSampleInterval is how often demo mode produces a sample while
+// monitoring.
+const demoSampleInterval = 10 * time.Second
+
+// monitorBattery stores every readout arriving on the serial port as a
+// monitoring sample until the program is stopped. Nothing is asked: the
+// device comes from the registry, and samples are never treated as
+// duplicates. The retention policy downsamples them as they age.
+func monitorBattery(config *serial.Config, genConfig generalConfiguration, demoData, omitWrites bool) {
+	store, err := openStore(genConfig)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v\n", err)
+	}
+	defer store.Close()
+	fmt.Printf("Monitoring, stop with Ctrl+C\n")
+	for {
+		var reading rrcBatteryData
+		if demoData {
+			time.Sleep(demoSampleInterval)
+			reading = demoBat("(none)")
+		} else {
+			fmt.Printf("Waiting for data (%s) ... ", config.Name)
+			reading = readSerial(config)
+		}
+		if err := storeSample(store, genConfig, &reading, time.Now(), omitWrites); err != nil {
+			fmt.Printf("Database write error: %v\n", err)
+			continue
+		}
+		fmt.Printf("%s %s: %d%%, %d mV, %d mA, %.1f°C\n", reading.Timestamp, batteryKey(reading), reading.RelativeCharge, reading.Voltage, reading.Current, reading.TemperatureC)
+	}
+}
+
+// storeSample completes a readout taken while monitoring and stores it
+// marked as a sample.
+func storeSample(store Store, genConfig generalConfiguration, reading *rrcBatteryData, now time.Time, omitWrites bool) error {
+	var err error
+	reading.BatteryID, err = resolveBatteryID(store, *reading, identityFields(genConfig))
+	if err != nil {
+		return err
+	}
+	devSN, err := store.DeviceFor(reading.BatteryID)
+	if err != nil && err != errNotFound {
+		return err
+	}
+	reading.DevSerialNumber = devSN
+	reading.Timestamp = formatTimestamp(now)
+	reading.Zone = zoneOf(now)
+	reading.SchemaVersion = recordVersion
+	reading.Sample = true
+	setStateOfHealth(reading)
+	reading.Health = rateReading(*reading)
+	if omitWrites {
+		return nil
+	}
+	return store.Append(*reading)
+}
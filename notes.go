@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+func sortNotes(notes []note) {
+	sort.SliceStable(notes, func(i, j int) bool {
+		if notes[i].Created != notes[j].Created {
+			return notes[i].Created < notes[j].Created
+		}
+		return notes[i].ID < notes[j].ID
+	})
+}
+
+// newNoteID returns a random id, unique across stations.
+func newNoteID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(id)
+}
+
+// noteAuthor is the configured operator, or the login name.
+func noteAuthor(genConfig generalConfiguration) string {
+	if genConfig.Operator != "" {
+		return genConfig.Operator
+	}
+	for _, env := range []string{"USER", "USERNAME"} {
+		if name := os.Getenv(env); name != "" {
+			return name
+		}
+	}
+	return stationName(genConfig)
+}
+
+// parseTags splits a comma separated tag list.
+func parseTags(list string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(list, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// addNote stores a new note on a reading (battery and timestamp), a battery
+// or a device.
+func addNote(store Store, genConfig generalConfiguration, target note) (note, error) {
+	if strings.TrimSpace(target.Text) == "" && len(target.Tags) == 0 {
+		return target, fmt.Errorf("empty note")
+	}
+	if (target.BatteryID == "") == (target.Device == "") {
+		return target, fmt.Errorf("a note belongs to either a battery or a device")
+	}
+	if target.BatteryID != "" {
+		readings, err := store.Readings(target.BatteryID)
+		if err == errNotFound {
+			return target, fmt.Errorf("unknown battery \"%s\"", target.BatteryID)
+		}
+		if err != nil {
+			return target, err
+		}
+		if target.Timestamp != "" {
+			target.Timestamp = normalizeTimestamp(target.Timestamp)
+			found := false
+			for _, r := range readings {
+				found = found || r.Timestamp == target.Timestamp
+			}
+			if !found {
+				return target, fmt.Errorf("%s has no reading at %s", target.BatteryID, target.Timestamp)
+			}
+		}
+	}
+	target.ID = newNoteID()
+	if target.Author == "" {
+		target.Author = noteAuthor(genConfig)
+	}
+	target.Created = formatTimestamp(time.Now())
+	target.Updated = updatedNow()
+	return target, store.PutNote(target)
+}
+
+// removeNote marks a note as removed.
+func removeNote(store Store, id string) error {
+	notes, err := store.Notes()
+	if err != nil {
+		return err
+	}
+	for _, n := range notes {
+		if n.ID == id && !n.Removed {
+			n.Removed = true
+			n.Updated = updatedNow()
+			return store.PutNote(n)
+		}
+	}
+	return fmt.Errorf("no note \"%s\"", id)
+}
+
+// moveNotes moves the notes on one reading of a battery to another.
+func moveNotes(store Store, batteryID, from, to string) error {
+	notes, err := store.Notes()
+	if err != nil {
+		return err
+	}
+	for _, n := range notes {
+		if n.BatteryID != batteryID || n.Timestamp != from || n.Removed {
+			continue
+		}
+		n.Timestamp = to
+		n.Updated = updatedNow()
+		if err := store.PutNote(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notesFor returns the notes, not removed, on a battery and its readings and
+// on the given devices. tag limits the result to notes with that tag.
+func notesFor(notes []note, batteryID string, devices []string, tag string) []note {
+	list := []note{}
+	for _, n := range notes {
+		if n.Removed {
+			continue
+		}
+		match := batteryID != "" && n.BatteryID == batteryID
+		for _, d := range devices {
+			match = match || (d != "" && n.Device == d)
+		}
+		if batteryID == "" && len(devices) == 0 {
+			match = true
+		}
+		if !match || (tag != "" && !hasTag(n, tag)) {
+			continue
+		}
+		list = append(list, n)
+	}
+	return list
+}
+
+func hasTag(n note, tag string) bool {
+	for _, t := range n.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// noteLabel is the short text of a note shown on charts.
+func noteLabel(n note) string {
+	label := n.Text
+	if len(n.Tags) > 0 {
+		label = "[" + strings.Join(n.Tags, ", ") + "] " + label
+	}
+	return strings.TrimSpace(label)
+}
+
+// applyNotes stores the incoming notes that are newer than the local ones.
+func applyNotes(store Store, notes []note) (int, error) {
+	if len(notes) == 0 {
+		return 0, nil
+	}
+	local, err := store.Notes()
+	if err != nil {
+		return 0, err
+	}
+	known := make(map[string]note)
+	for _, n := range local {
+		known[n.ID] = n
+	}
+	applied := 0
+	for _, n := range notes {
+		n = normalizeNote(n)
+		if err := checkName("note ID", n.ID); err != nil {
+			return applied, err
+		}
+		if have, ok := known[n.ID]; ok && have.Updated >= n.Updated {
+			continue
+		}
+		if err := store.PutNote(n); err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	return applied, nil
+}
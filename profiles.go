@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// profileMatch explains how one profile compares to a battery.
+type profileMatch struct {
+	Index    int // position in BatteryProfiles.json, from 0
+	Profile  batteryProfile
+	Matched  bool
+	Criteria int      // number of criteria the profile sets
+	Reasons  []string // one line per criterion
+}
+
+// matchGlob matches a glob case-insensitively, e.g. "rrc20*" and "RRC2040-2".
+func matchGlob(pattern, value string) (bool, error) {
+	return path.Match(strings.ToLower(pattern), strings.ToLower(value))
+}
+
+// evaluateProfile checks every criterion a profile sets against a battery.
+// A profile matches when all of them hold; one without criteria matches
+// every battery.
+func evaluateProfile(index int, profile batteryProfile, dataset rrcBatteryData) profileMatch {
+	m := profileMatch{Index: index, Profile: profile, Matched: true}
+	devSN := dataset.DevSerialNumber
+	if !hasDevice(devSN) {
+		devSN = ""
+	}
+	check := func(ok bool, yes, no string) {
+		m.Criteria++
+		if ok {
+			m.Reasons = append(m.Reasons, yes)
+		} else {
+			m.Matched = false
+			m.Reasons = append(m.Reasons, no)
+		}
+	}
+	checkGlob := func(field, pattern, value string) {
+		ok, err := matchGlob(pattern, value)
+		if err != nil {
+			check(false, "", fmt.Sprintf("invalid %s pattern %q: %v", field, pattern, err))
+			return
+		}
+		check(ok, fmt.Sprintf("%s %q matches %q", field, value, pattern), fmt.Sprintf("%s %q does not match %q", field, value, pattern))
+	}
+	if profile.AssociateDevSnPrefix != "" {
+		check(strings.HasPrefix(devSN, profile.AssociateDevSnPrefix),
+			fmt.Sprintf("device serial %q has prefix %q", devSN, profile.AssociateDevSnPrefix),
+			fmt.Sprintf("device serial %q lacks prefix %q", devSN, profile.AssociateDevSnPrefix))
+	}
+	if profile.DevSnPattern != "" {
+		checkGlob("device serial", profile.DevSnPattern, devSN)
+	}
+	if profile.DevSnRegex != "" {
+		re, err := regexp.Compile(profile.DevSnRegex)
+		if err != nil {
+			check(false, "", fmt.Sprintf("invalid device serial expression %q: %v", profile.DevSnRegex, err))
+		} else {
+			check(re.MatchString(devSN),
+				fmt.Sprintf("device serial %q matches /%s/", devSN, profile.DevSnRegex),
+				fmt.Sprintf("device serial %q does not match /%s/", devSN, profile.DevSnRegex))
+		}
+	}
+	if profile.BatteryName != "" {
+		checkGlob("battery name", profile.BatteryName, dataset.Name)
+	}
+	if profile.Manufacturer != "" {
+		checkGlob("manufacturer", profile.Manufacturer, dataset.Manufacturer)
+	}
+	if m.Criteria == 0 {
+		m.Reasons = append(m.Reasons, "no criteria, matches every battery")
+	}
+	return m
+}
+
+// evaluateProfiles compares every profile with a battery.
+func evaluateProfiles(profiles []batteryProfile, dataset rrcBatteryData) []profileMatch {
+	matches := make([]profileMatch, 0, len(profiles))
+	for i, p := range profiles {
+		matches = append(matches, evaluateProfile(i, p, dataset))
+	}
+	return matches
+}
+
+// betterMatch orders matching profiles: the higher priority wins, then the
+// profile setting more criteria, then the longer device serial prefix.
+// Remaining ties go to the profile listed first.
+func betterMatch(a, b profileMatch) bool {
+	if a.Profile.Priority != b.Profile.Priority {
+		return a.Profile.Priority > b.Profile.Priority
+	}
+	if a.Criteria != b.Criteria {
+		return a.Criteria > b.Criteria
+	}
+	return len(a.Profile.AssociateDevSnPrefix) > len(b.Profile.AssociateDevSnPrefix)
+}
+
+// chooseProfile returns the best of the matching profiles and how many
+// other matches tie with it.
+func chooseProfile(matches []profileMatch) (profileMatch, int, bool) {
+	var best profileMatch
+	found, ties := false, 0
+	for _, m := range matches {
+		if !m.Matched {
+			continue
+		}
+		switch {
+		case !found || betterMatch(m, best):
+			best, found, ties = m, true, 0
+		case !betterMatch(best, m):
+			ties++
+		}
+	}
+	return best, ties, found
+}
+
+// matchProfile returns the profile chosen for a battery.
+func matchProfile(profiles []batteryProfile, dataset rrcBatteryData) (batteryProfile, bool) {
+	best, _, ok := chooseProfile(evaluateProfiles(profiles, dataset))
+	return best.Profile, ok
+}
+
+// explainProfiles describes why each profile was or was not chosen for a
+// battery.
+func explainProfiles(profiles []batteryProfile, dataset rrcBatteryData) string {
+	var b strings.Builder
+	devSN := dataset.DevSerialNumber
+	if !hasDevice(devSN) {
+		devSN = "(none)"
+	}
+	fmt.Fprintf(&b, "Battery %q by %q in device %s\n", dataset.Name, dataset.Manufacturer, devSN)
+	matches := evaluateProfiles(profiles, dataset)
+	for _, m := range matches {
+		result := "no match"
+		if m.Matched {
+			result = fmt.Sprintf("match, priority %d, %d criteria", m.Profile.Priority, m.Criteria)
+		}
+		fmt.Fprintf(&b, "#%d %s: %s\n", m.Index+1, m.Profile.AssociatedDeviceName, result)
+		for _, r := range m.Reasons {
+			fmt.Fprintf(&b, "    %s\n", r)
+		}
+	}
+	best, ties, ok := chooseProfile(matches)
+	switch {
+	case !ok:
+		if profile, ok := chemistryProfile(dataset); ok {
+			fmt.Fprintf(&b, "No profile matches, %s apply.\n", profile.AssociatedDeviceName)
+		} else {
+			fmt.Fprintf(&b, "No profile matches.\n")
+		}
+	case ties > 0:
+		fmt.Fprintf(&b, "Chosen: #%d %s, listed first of %d equally good matches; set priorities to make the choice explicit.\n", best.Index+1, best.Profile.AssociatedDeviceName, ties+1)
+	default:
+		fmt.Fprintf(&b, "Chosen: #%d %s\n", best.Index+1, best.Profile.AssociatedDeviceName)
+	}
+	return b.String()
+}
+
+// prefixKeyAlias is the correctly spelled key for AssociateDevSnPrefix,
+// accepted when reading. Profiles are written with the original
+// "assosiatedevsnprefix" so older stations can still read them.
+const prefixKeyAlias = "associatedevsnprefix"
+
+type prefixAlias struct {
+	Prefix string `json:"associatedevsnprefix"`
+}
+
+// profileKeys are the keys a profile may have.
+func profileKeys() map[string]bool {
+	keys := map[string]bool{prefixKeyAlias: true}
+	t := reflect.TypeOf(batteryProfile{})
+	for i := 0; i < t.NumField(); i++ {
+		keys[strings.Split(t.Field(i).Tag.Get("json"), ",")[0]] = true
+	}
+	return keys
+}
+
+// lineColumn converts a byte offset into a 1-based line and column.
+func lineColumn(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	return line, int(offset) - bytes.LastIndexByte(before, '\n')
+}
+
+// positionError adds the line and column to JSON syntax and type errors.
+// item names the entries of a list, e.g. "profile".
+func positionError(data []byte, err error, item string) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		line, col := lineColumn(data, syntaxErr.Offset)
+		return fmt.Errorf("line %d, column %d: %v", line, col, err)
+	case errors.As(err, &typeErr):
+		line, col := lineColumn(data, typeErr.Offset)
+		// Field is "0.maxcycles" for the first entry of a list.
+		field := typeErr.Field
+		if i := strings.IndexByte(field, '.'); i > 0 {
+			if n, err := strconv.Atoi(field[:i]); err == nil {
+				field = fmt.Sprintf("%s #%d: %s", item, n+1, field[i+1:])
+			}
+		}
+		return fmt.Errorf("line %d, column %d: %s must be %s, not %s", line, col, field, typeErr.Type, typeErr.Value)
+	}
+	return err
+}
+
+// isProfileList reports whether a profile file holds a list. Older versions
+// wrote a single profile object on first start.
+func isProfileList(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	return len(trimmed) == 0 || trimmed[0] != '{'
+}
+
+// parseBatteryProfiles reads a profile list, or a single profile as a list
+// of one. Errors give the line and column.
+func parseBatteryProfiles(byteValue []byte) ([]batteryProfile, error) {
+	var profiles []batteryProfile
+	var aliases []prefixAlias
+	if isProfileList(byteValue) {
+		if err := json.Unmarshal(byteValue, &profiles); err != nil {
+			return nil, positionError(byteValue, err, "profile")
+		}
+		json.Unmarshal(byteValue, &aliases)
+	} else {
+		profiles, aliases = make([]batteryProfile, 1), make([]prefixAlias, 1)
+		if err := json.Unmarshal(byteValue, &profiles[0]); err != nil {
+			return nil, positionError(byteValue, err, "profile")
+		}
+		json.Unmarshal(byteValue, &aliases[0])
+	}
+	for i := range profiles {
+		if i < len(aliases) && profiles[i].AssociateDevSnPrefix == "" {
+			profiles[i].AssociateDevSnPrefix = aliases[i].Prefix
+		}
+	}
+	return profiles, nil
+}
+
+// profileProblem is a schema or range error in a profile file.
+type profileProblem struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (p profileProblem) String() string {
+	if p.Line == 0 {
+		return p.Message
+	}
+	return fmt.Sprintf("line %d, column %d: %s", p.Line, p.Column, p.Message)
+}
+
+// checkProfile returns the range errors of one profile.
+func checkProfile(p batteryProfile) []string {
+	problems := []string{}
+	if strings.TrimSpace(p.AssociatedDeviceName) == "" {
+		problems = append(problems, "associateddevicename is required")
+	}
+	if p.MaxCycles < 0 || p.WarnCycles < 0 {
+		problems = append(problems, "cycle limits must not be negative")
+	}
+	if p.MaxCycles > 0 && p.WarnCycles > 0 && p.WarnCycles >= p.MaxCycles {
+		problems = append(problems, fmt.Sprintf("warncycles %d must be below maxcycles %d", p.WarnCycles, p.MaxCycles))
+	}
+	for _, f := range []struct {
+		key   string
+		value float64
+	}{{"mincapacityfactor", p.MinCapacityFactor}, {"warncapacityfactor", p.WarnCapacityFactor}} {
+		if f.value < 0 || f.value > 1 {
+			problems = append(problems, fmt.Sprintf("%s %g must be between 0 and 1", f.key, f.value))
+		}
+	}
+	if p.MinCapacityFactor > 0 && p.WarnCapacityFactor > 0 && p.WarnCapacityFactor <= p.MinCapacityFactor {
+		problems = append(problems, fmt.Sprintf("warncapacityfactor %g must be above mincapacityfactor %g", p.WarnCapacityFactor, p.MinCapacityFactor))
+	}
+	if p.MinTemperature != nil && p.MaxTemperature != nil && *p.MinTemperature >= *p.MaxTemperature {
+		problems = append(problems, fmt.Sprintf("mintemperature %g must be below maxtemperature %g", *p.MinTemperature, *p.MaxTemperature))
+	}
+	if p.MinVoltage < 0 || p.MaxCellSpread < 0 || p.MaxAgeMonths < 0 {
+		problems = append(problems, "minvoltage, maxcellspread and maxagemonths must not be negative")
+	}
+	for _, g := range []struct{ key, pattern string }{{"devsnpattern", p.DevSnPattern}, {"batteryname", p.BatteryName}, {"manufacturer", p.Manufacturer}} {
+		if _, err := path.Match(g.pattern, ""); err != nil {
+			problems = append(problems, fmt.Sprintf("%s %q is not a valid pattern", g.key, g.pattern))
+		}
+	}
+	if _, err := regexp.Compile(p.DevSnRegex); err != nil {
+		problems = append(problems, fmt.Sprintf("devsnregex: %v", err))
+	}
+	return problems
+}
+
+// profileIssue is a range error of the profile at Index.
+type profileIssue struct {
+	Index   int
+	Message string
+}
+
+// checkProfiles validates a profile list: names must be unique and every
+// profile within range.
+func checkProfiles(profiles []batteryProfile) []profileIssue {
+	issues := []profileIssue{}
+	seen := make(map[string]bool)
+	for i, p := range profiles {
+		if p.Removed {
+			continue
+		}
+		label := fmt.Sprintf("profile #%d %q", i+1, p.AssociatedDeviceName)
+		if p.AssociatedDeviceName != "" && seen[p.AssociatedDeviceName] {
+			issues = append(issues, profileIssue{Index: i, Message: label + ": name used twice"})
+		}
+		seen[p.AssociatedDeviceName] = true
+		for _, problem := range checkProfile(p) {
+			issues = append(issues, profileIssue{Index: i, Message: label + ": " + problem})
+		}
+	}
+	return issues
+}
+
+// profileKeyProblems walks the tokens of a profile file for the position of
+// every profile and reports the keys a profile may not have. Values are
+// decoded whole, so every string at the depth of the profile objects is a
+// key.
+func profileKeyProblems(data []byte) (starts []int64, problems []profileProblem) {
+	objectDepth := 2
+	if !isProfileList(data) {
+		objectDepth = 1
+	}
+	keys := profileKeys()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	for {
+		offset := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		if delim, ok := tok.(json.Delim); ok {
+			switch delim {
+			case '[', '{':
+				depth++
+				if delim == '{' && depth == objectDepth {
+					starts = append(starts, offset+int64(bytes.IndexByte(data[offset:], '{')))
+				}
+			default:
+				depth--
+			}
+			continue
+		}
+		key, ok := tok.(string)
+		if !ok || depth != objectDepth {
+			continue
+		}
+		if !keys[key] {
+			line, col := lineColumn(data, offset+int64(bytes.IndexByte(data[offset:], '"')))
+			problems = append(problems, profileProblem{Line: line, Column: col, Message: fmt.Sprintf("profile #%d: unknown key %q", len(starts), key)})
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			break
+		}
+	}
+	return starts, problems
+}
+
+// validateProfileFile checks a profile file against the schema: valid JSON,
+// a list of objects with known keys of the right types and values in range.
+// Problems carry the line and column of the key or profile concerned.
+func validateProfileFile(data []byte) []profileProblem {
+	profiles, err := parseBatteryProfiles(data)
+	if err != nil {
+		return []profileProblem{{Message: err.Error()}}
+	}
+	problems := []profileProblem{}
+	at := func(offset int64, message string) {
+		line, col := lineColumn(data, offset)
+		problems = append(problems, profileProblem{Line: line, Column: col, Message: message})
+	}
+	if !isProfileList(data) {
+		at(0, "the file holds a single profile, not a list; saving it with the profile commands fixes this")
+	}
+	starts, unknown := profileKeyProblems(data)
+	problems = append(problems, unknown...)
+	for _, issue := range checkProfiles(profiles) {
+		var offset int64
+		if issue.Index < len(starts) {
+			offset = starts[issue.Index]
+		}
+		at(offset, issue.Message)
+	}
+	return problems
+}
+
+// findProfile returns the index of a profile given by name or as "#N".
+func findProfile(profiles []batteryProfile, ref string) (int, error) {
+	if strings.HasPrefix(ref, "#") {
+		var n int
+		if _, err := fmt.Sscanf(ref, "#%d", &n); err == nil && n >= 1 && n <= len(profiles) {
+			return n - 1, nil
+		}
+		return -1, fmt.Errorf("no profile %s", ref)
+	}
+	for i, p := range profiles {
+		if p.AssociatedDeviceName == ref {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("no profile named \"%s\"", ref)
+}
+
+// profileCriteria describes what a profile matches on, e.g.
+// "prefix 1234. battery RRC2040*".
+func profileCriteria(p batteryProfile) string {
+	parts := []string{}
+	for _, c := range []struct{ label, value string }{
+		{"prefix", p.AssociateDevSnPrefix},
+		{"device", p.DevSnPattern},
+		{"regex", p.DevSnRegex},
+		{"battery", p.BatteryName},
+		{"manufacturer", p.Manufacturer},
+	} {
+		if c.value != "" {
+			parts = append(parts, c.label+" "+c.value)
+		}
+	}
+	if len(parts) == 0 {
+		return "any battery"
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProfileKeyProblems(t *testing.T) {
+	data := []byte(`[
+  {
+    "associateddevicename": "Ventilator",
+    "maxcyles": 300
+  },
+  {"associateddevicename": "Monitor", "associatedevsnprefix": "5678.", "removed": true}
+]`)
+	starts, problems := profileKeyProblems(data)
+	if len(starts) != 2 {
+		t.Errorf("found %d profiles, want 2", len(starts))
+	}
+	want := []profileProblem{{Line: 4, Column: 5, Message: `profile #1: unknown key "maxcyles"`}}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("problems = %+v, want %+v", problems, want)
+	}
+}
+
+func TestEvaluateProfile(t *testing.T) {
+	dataset := testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20)
+	dataset.DevSerialNumber = "1234.5678"
+	noDevice := dataset
+	noDevice.DevSerialNumber = "(none)"
+	tests := []struct {
+		name     string
+		profile  batteryProfile
+		dataset  rrcBatteryData
+		matched  bool
+		criteria int
+	}{
+		{"no criteria", batteryProfile{}, dataset, true, 0},
+		{"prefix", batteryProfile{AssociateDevSnPrefix: "1234."}, dataset, true, 1},
+		{"other prefix", batteryProfile{AssociateDevSnPrefix: "5678."}, dataset, false, 1},
+		{"prefix without a device", batteryProfile{AssociateDevSnPrefix: "1234."}, noDevice, false, 1},
+		{"no criteria without a device", batteryProfile{}, noDevice, true, 0},
+		{"serial glob", batteryProfile{DevSnPattern: "1234.5*"}, dataset, true, 1},
+		{"serial glob mismatch", batteryProfile{DevSnPattern: "1234.6*"}, dataset, false, 1},
+		{"invalid glob", batteryProfile{DevSnPattern: "["}, dataset, false, 1},
+		{"serial regex", batteryProfile{DevSnRegex: `^1234\.[5-6]`}, dataset, true, 1},
+		{"serial regex mismatch", batteryProfile{DevSnRegex: `^1234\.[7-9]`}, dataset, false, 1},
+		{"invalid regex", batteryProfile{DevSnRegex: "("}, dataset, false, 1},
+		{"name glob ignores case", batteryProfile{BatteryName: "rrc20*"}, dataset, true, 1},
+		{"manufacturer", batteryProfile{Manufacturer: "rrc"}, dataset, true, 1},
+		{"one of three fails", batteryProfile{AssociateDevSnPrefix: "1234.", BatteryName: "RRC20*", Manufacturer: "Other"}, dataset, false, 3},
+	}
+	for _, tt := range tests {
+		m := evaluateProfile(0, tt.profile, tt.dataset)
+		if m.Matched != tt.matched || m.Criteria != tt.criteria {
+			t.Errorf("%s: matched %v with %d criteria %q, want %v with %d", tt.name, m.Matched, m.Criteria, m.Reasons, tt.matched, tt.criteria)
+		}
+	}
+}
+
+func TestChooseProfile(t *testing.T) {
+	dataset := testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20)
+	dataset.DevSerialNumber = "1234.5678"
+	profile := func(name string, p batteryProfile) batteryProfile {
+		p.AssociatedDeviceName = name
+		return p
+	}
+	tests := []struct {
+		name     string
+		profiles []batteryProfile
+		want     string // "" when none matches
+		ties     int
+	}{
+		{"priority before criteria", []batteryProfile{
+			profile("A", batteryProfile{AssociateDevSnPrefix: "1234.5", BatteryName: "RRC*"}),
+			profile("B", batteryProfile{Priority: 1}),
+		}, "B", 0},
+		{"higher priority that does not match", []batteryProfile{
+			profile("A", batteryProfile{Priority: 5, AssociateDevSnPrefix: "9"}),
+			profile("B", batteryProfile{}),
+		}, "B", 0},
+		{"more criteria", []batteryProfile{
+			profile("A", batteryProfile{AssociateDevSnPrefix: "1234."}),
+			profile("B", batteryProfile{AssociateDevSnPrefix: "1234.", BatteryName: "RRC*"}),
+		}, "B", 0},
+		{"prefix before the catch-all", []batteryProfile{
+			profile("A", batteryProfile{}),
+			profile("B", batteryProfile{AssociateDevSnPrefix: "1234."}),
+		}, "B", 0},
+		{"longer prefix", []batteryProfile{
+			profile("A", batteryProfile{AssociateDevSnPrefix: "1234."}),
+			profile("B", batteryProfile{AssociateDevSnPrefix: "1234.56"}),
+		}, "B", 0},
+		{"prefix against a regex of equal weight", []batteryProfile{
+			profile("A", batteryProfile{DevSnRegex: `^1234\.`}),
+			profile("B", batteryProfile{AssociateDevSnPrefix: "1234."}),
+		}, "B", 0},
+		{"file order", []batteryProfile{
+			profile("A", batteryProfile{BatteryName: "RRC*"}),
+			profile("B", batteryProfile{Manufacturer: "rrc"}),
+			profile("C", batteryProfile{DevSnPattern: "1234.*"}),
+		}, "A", 2},
+		{"no match", []batteryProfile{
+			profile("A", batteryProfile{AssociateDevSnPrefix: "9"}),
+		}, "", 0},
+	}
+	for _, tt := range tests {
+		best, ties, ok := chooseProfile(evaluateProfiles(tt.profiles, dataset))
+		got := ""
+		if ok {
+			got = best.Profile.AssociatedDeviceName
+		}
+		if got != tt.want || ties != tt.ties {
+			t.Errorf("%s: chose %q with %d tie(s), want %q with %d", tt.name, got, ties, tt.want, tt.ties)
+		}
+	}
+}
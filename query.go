@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// batteryQuery selects batteries for the query command. Zero values match
+// everything.
+type batteryQuery struct {
+	batteryFilter
+	MinCycles  int
+	MaxCycles  int // -1 for no limit
+	MinSoH     float64
+	MaxSoH     float64 // -1 for no limit
+	SeenAfter  time.Time
+	SeenBefore time.Time
+	Status     string
+}
+
+// queryRow is one battery in the query output, described by its latest
+// reading.
+type queryRow struct {
+	ID              string  `json:"id"`
+	Name            string  `json:"name"`
+	SerialNumber    string  `json:"serial"`
+	Chemistry       string  `json:"chemistry"`
+	DevSerialNumber string  `json:"devserialnumber"`
+	Profile         string  `json:"profile"`
+	CycleCount      int     `json:"cyclecount"`
+	SoH             float64 `json:"soh"`
+	Status          string  `json:"status"`
+	Readings        int     `json:"readings"`
+	LastSeen        string  `json:"lastseen"`
+}
+
+// runQuery returns the batteries matching the query, using the profiles to
+// rate their health.
+func runQuery(store Store, query batteryQuery, profiles []batteryProfile) ([]queryRow, error) {
+	// The device prefix is matched against the current attachment below.
+	filter := query.batteryFilter
+	filter.DevSerialPrefix = ""
+	batteries, err := store.ListBatteries(filter)
+	if err != nil {
+		return nil, err
+	}
+	rows := []queryRow{}
+	for _, b := range batteries {
+		readings, err := store.Readings(b.ID)
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading \"%s\": %w", b.ID, err)
+		}
+		latest := readings[len(readings)-1]
+		devSN, err := store.DeviceFor(b.ID)
+		if err != nil {
+			return nil, err
+		}
+		row := queryRow{
+			ID:              b.ID,
+			Name:            b.Name,
+			SerialNumber:    b.SerialNumber,
+			Chemistry:       b.Chemistry,
+			DevSerialNumber: devSN,
+			CycleCount:      latest.CycleCount,
+			SoH:             stateOfHealth(latest),
+			Readings:        b.Readings,
+			LastSeen:        b.LastSeen,
+		}
+		latest.DevSerialNumber = devSN
+		if profile, ok := profileFor(profiles, latest); ok {
+			row.Profile = profile.AssociatedDeviceName
+			row.Status = evaluateHealth(latest, profile).Status
+		}
+		if query.match(row) {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+func (q batteryQuery) match(row queryRow) bool {
+	if !strings.HasPrefix(row.DevSerialNumber, q.DevSerialPrefix) {
+		return false
+	}
+	if row.CycleCount < q.MinCycles || (q.MaxCycles >= 0 && row.CycleCount > q.MaxCycles) {
+		return false
+	}
+	if row.SoH < q.MinSoH || (q.MaxSoH >= 0 && row.SoH > q.MaxSoH) {
+		return false
+	}
+	if q.Status != "" && row.Status != q.Status {
+		return false
+	}
+	if q.SeenAfter.IsZero() && q.SeenBefore.IsZero() {
+		return true
+	}
+	seen, err := parseTimestamp(row.LastSeen)
+	if err != nil {
+		return false
+	}
+	return (q.SeenAfter.IsZero() || !seen.Before(q.SeenAfter)) &&
+		(q.SeenBefore.IsZero() || seen.Before(q.SeenBefore))
+}
+
+// writeQueryRows prints the rows as "table", "json" or "csv".
+func writeQueryRows(out io.Writer, rows []queryRow, format string) error {
+	header := []string{"ID", "NAME", "SERIAL", "CHEMISTRY", "DEVICE", "PROFILE", "CYCLES", "SOH", "STATUS", "READINGS", "LASTSEEN"}
+	fields := func(r queryRow) []string {
+		return []string{r.ID, r.Name, r.SerialNumber, r.Chemistry, r.DevSerialNumber, r.Profile,
+			strconv.Itoa(r.CycleCount), strconv.FormatFloat(r.SoH, 'f', 1, 64), r.Status, strconv.Itoa(r.Readings), r.LastSeen}
+	}
+	switch format {
+	case "table":
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		writeTabRow(w, header)
+		for _, r := range rows {
+			writeTabRow(w, fields(r))
+		}
+		return w.Flush()
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "\t")
+		return encoder.Encode(rows)
+	case "csv":
+		w := csv.NewWriter(out)
+		if err := w.Write(header); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			if err := w.Write(fields(r)); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+	default:
+		return fmt.Errorf("unknown format \"%s\", use table, json or csv", format)
+	}
+}
+
+func writeTabRow(w io.Writer, fields []string) {
+	for i, f := range fields {
+		if i > 0 {
+			fmt.Fprint(w, "\t")
+		}
+		fmt.Fprint(w, f)
+	}
+	fmt.Fprintln(w)
+}
+
+// parseQueryDate reads a YYYY-MM-DD date in local time.
+func parseQueryDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation(fmtDateTimeISO, value, time.Local)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// assetDirectory is where the images named in the profiles are looked up.
+func assetDirectory(genConfig generalConfiguration) string {
+	if genConfig.AssetsDir != "" {
+		return genConfig.AssetsDir
+	}
+	return assetsDir
+}
+
+// inlineImage reads an image from the assets directory as a data URI, so
+// the report does not depend on the file staying next to it.
+func inlineImage(dir, file string) (template.URL, error) {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	mediaType := mime.TypeByExtension(strings.ToLower(filepath.Ext(file)))
+	if !strings.HasPrefix(mediaType, "image/") {
+		mediaType = http.DetectContentType(data)
+	}
+	if !strings.HasPrefix(mediaType, "image/") {
+		return "", fmt.Errorf("\"%s\" is not an image (%s)", file, mediaType)
+	}
+	return template.URL("data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data)), nil
+}
+
+// reportImage is a profile image of the report header.
+type reportImage struct {
+	Caption string
+	Source  template.URL
+}
+
+// summaryCard holds what the report header shows next to the images.
+type summaryCard struct {
+	Images   []reportImage
+	Title    string
+	Rows     [][2]string
+	Status   string
+	Color    string
+	Reasons  []string
+	Model    string   // rated values of the battery's model
+	Warnings []string // where the readings differ from them
+}
+
+var summaryCardTemplate = template.Must(template.New("card").Parse(`
+<style>
+.summary {display: flex; justify-content: center; align-items: center; gap: 24px; margin: 16px auto; font-family: sans-serif;}
+.summary figure {margin: 0; text-align: center;}
+.summary img {max-width: 240px; max-height: 180px;}
+.summary .card {border: 1px solid #ccc; border-left: 8px solid {{.Color}}; border-radius: 4px; padding: 8px 16px;}
+.summary .card h2 {margin: 4px 0;}
+.summary .card td {padding: 1px 8px 1px 0;}
+.summary .status {color: {{.Color}}; font-weight: bold;}
+.summary .mismatch {color: #E01010; font-weight: bold;}
+</style>
+<div class="summary">
+{{range .Images}}<figure><img src="{{.Source}}" alt="{{.Caption}}"><figcaption>{{.Caption}}</figcaption></figure>
+{{end}}<div class="card">
+<h2>{{.Title}}</h2>
+<table>
+{{range .Rows}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>
+{{end}}</table>
+{{if .Status}}<p class="status">{{.Status}}</p>{{end}}
+{{if .Reasons}}<ul>{{range .Reasons}}<li>{{.}}</li>{{end}}</ul>{{end}}
+{{if .Warnings}}<p class="mismatch">Does not match {{.Model}}: counterfeit, mis-programmed or rebuilt pack?</p>
+<ul class="mismatch">{{range .Warnings}}<li>{{.}}</li>{{end}}</ul>{{else if .Model}}<p>Matches {{.Model}}</p>{{end}}
+</div>
+</div>
+`))
+
+// newSummaryCard describes a reading and the profile it was rated against.
+// Images that cannot be read are reported and left out.
+func newSummaryCard(dataset rrcBatteryData, profile batteryProfile, dir string) summaryCard {
+	card := summaryCard{
+		Title: fmt.Sprintf("%s %s", dataset.Name, dataset.SerialNumber),
+		Color: statusColor(dataset.Health.Status),
+	}
+	for _, image := range []struct{ caption, file string }{
+		{profile.AssociatedDeviceName, profile.ImageFileDevice},
+		{dataset.Name, profile.ImageFileBattery},
+	} {
+		if image.file == "" {
+			continue
+		}
+		source, err := inlineImage(dir, image.file)
+		if err != nil {
+			fmt.Printf("Report image left out: %v\n", err)
+			continue
+		}
+		card.Images = append(card.Images, reportImage{Caption: image.caption, Source: source})
+	}
+	add := func(label, value string) {
+		if value != "" {
+			card.Rows = append(card.Rows, [2]string{label, value})
+		}
+	}
+	add("Manufacturer", dataset.Manufacturer)
+	if _, ok := lookupChemistry(dataset.Chemistry); ok {
+		add("Chemistry", chemistrySummary(dataset))
+	} else {
+		add("Chemistry", dataset.Chemistry)
+	}
+	add("Manufactured", dataset.MfgDate)
+	add("Device", dataset.DevSerialNumber)
+	add("Profile", profile.AssociatedDeviceName)
+	add("Cycles", fmt.Sprintf("%d", dataset.CycleCount))
+	if soh := stateOfHealth(dataset); soh > 0 {
+		add("Full capacity", fmt.Sprintf("%d of %d mAh (%.1f%%)", dataset.FullCapacity, dataset.DesignCapacity, soh))
+	}
+	if dataset.EnergySoH > 0 {
+		add("Energy SoH", fmt.Sprintf("%.1f%% of %d mWh", dataset.EnergySoH, dataset.DesignCapacity*dataset.DesignVoltage/1000))
+	}
+	add("Read", dataset.Timestamp)
+	if dataset.Health.Status != "" {
+		card.Status = "Health: " + strings.ToUpper(dataset.Health.Status)
+		card.Reasons = dataset.Health.Reasons
+	}
+	return card
+}
+
+// renderWithHeader renders a page and puts the summary card at the top of
+// its body.
+func renderWithHeader(out io.Writer, render func(io.Writer) error, card summaryCard) error {
+	var header bytes.Buffer
+	if err := summaryCardTemplate.Execute(&header, card); err != nil {
+		return err
+	}
+	return renderWithHTML(out, render, header.Bytes(), nil)
+}
+
+// renderWithHTML renders a page and adds header at the top of its body and
+// footer at the bottom.
+func renderWithHTML(out io.Writer, render func(io.Writer) error, header, footer []byte) error {
+	var page bytes.Buffer
+	if err := render(&page); err != nil {
+		return err
+	}
+	html := page.Bytes()
+	top := bytes.Index(html, []byte("<body>"))
+	bottom := bytes.LastIndex(html, []byte("</body>"))
+	if top < 0 || bottom < top {
+		_, err := out.Write(bytes.Join([][]byte{header, html, footer}, nil))
+		return err
+	}
+	top += len("<body>")
+	_, err := out.Write(bytes.Join([][]byte{html[:top], header, html[top:bottom], footer, html[bottom:]}, nil))
+	return err
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retentionTier downsamples monitoring samples older than After to one
+// aggregate per Resolution.
+type retentionTier struct {
+	After      string `json:"after"`      // sample age, e.g. "7d" or "36h"
+	Resolution string `json:"resolution"` // aggregate interval, e.g. "1m" or "1h"
+}
+
+// defaultRetention keeps samples at full resolution for 7 days, then per
+// minute, and per hour after 30 days.
+var defaultRetention = []retentionTier{
+	{After: "7d", Resolution: "1m"},
+	{After: "30d", Resolution: "1h"},
+}
+
+// parseAge reads a duration that may also be given in days ("7d").
+func parseAge(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration \"%s\"", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+type parsedTier struct {
+	after      time.Duration
+	resolution time.Duration
+}
+
+// retentionPolicy returns the configured tiers, youngest first.
+func retentionPolicy(genConfig generalConfiguration) ([]parsedTier, error) {
+	tiers := genConfig.Retention
+	if tiers == nil {
+		tiers = defaultRetention
+	}
+	policy := []parsedTier{}
+	for _, t := range tiers {
+		after, err := parseAge(t.After)
+		if err != nil {
+			return nil, err
+		}
+		resolution, err := parseAge(t.Resolution)
+		if err != nil {
+			return nil, err
+		}
+		if resolution <= 0 {
+			return nil, fmt.Errorf("retention resolution must be positive, got \"%s\"", t.Resolution)
+		}
+		policy = append(policy, parsedTier{after: after, resolution: resolution})
+	}
+	sort.Slice(policy, func(i, j int) bool { return policy[i].after < policy[j].after })
+	return policy, nil
+}
+
+type compactReport struct {
+	Batteries  int
+	Removed    int
+	Aggregates int
+}
+
+func (r compactReport) String() string {
+	return fmt.Sprintf("%d battery(s) compacted: %d sample(s) merged into %d aggregate(s)\n", r.Batteries, r.Removed, r.Aggregates)
+}
+
+// compactStore downsamples the monitoring samples of every battery.
+// Snapshot readouts (readings not marked as samples) are never touched.
+func compactStore(store Store, policy []parsedTier, now time.Time, dryRun bool) (compactReport, error) {
+	var report compactReport
+	batteries, err := store.ListBatteries(batteryFilter{})
+	if err != nil {
+		return report, err
+	}
+	for _, b := range batteries {
+		readings, err := store.Readings(b.ID)
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			return report, fmt.Errorf("reading \"%s\": %w", b.ID, err)
+		}
+		removed, aggregates, err := compactReadings(store, readings, policy, now, dryRun)
+		if err != nil {
+			return report, fmt.Errorf("compacting \"%s\": %w", b.ID, err)
+		}
+		if aggregates > 0 {
+			report.Batteries++
+			report.Removed += removed
+			report.Aggregates += aggregates
+		}
+	}
+	return report, nil
+}
+
+// compactReadings merges the samples of one battery that fall into the same
+// interval of the coarsest tier their age reaches.
+func compactReadings(store Store, readings []rrcBatteryData, policy []parsedTier, now time.Time, dryRun bool) (int, int, error) {
+	type bucketKey struct {
+		resolution time.Duration
+		start      time.Time
+	}
+	buckets := make(map[bucketKey][]rrcBatteryData)
+	keys := []bucketKey{}
+	for _, r := range readings {
+		if !r.Sample {
+			continue
+		}
+		ts, err := parseTimestamp(r.Timestamp)
+		if err != nil {
+			continue
+		}
+		var tier *parsedTier
+		for i := range policy {
+			if now.Sub(ts) >= policy[i].after {
+				tier = &policy[i]
+			}
+		}
+		if tier == nil {
+			continue
+		}
+		key := bucketKey{resolution: tier.resolution, start: ts.Truncate(tier.resolution)}
+		if buckets[key] == nil {
+			keys = append(keys, key)
+		}
+		buckets[key] = append(buckets[key], r)
+	}
+	removed, aggregates := 0, 0
+	for _, key := range keys {
+		group := buckets[key]
+		if len(group) < 2 {
+			continue
+		}
+		// The aggregate takes the place of the newest sample, whose key no
+		// other reading can hold.
+		aggregate := aggregateSamples(group)
+		removed += len(group)
+		aggregates++
+		if dryRun {
+			continue
+		}
+		if err := store.Append(aggregate); err != nil {
+			return removed, aggregates, err
+		}
+		for _, r := range group {
+			if r.Timestamp == aggregate.Timestamp {
+				continue
+			}
+			if err := store.Delete(batteryKey(r), r.Timestamp); err != nil {
+				return removed, aggregates, err
+			}
+		}
+	}
+	return removed, aggregates, nil
+}
+
+// aggregateSamples averages the measurements of a group of samples, weighted
+// by how many samples earlier aggregates already hold. Identity fields,
+// registers and counters are taken from the newest sample.
+func aggregateSamples(group []rrcBatteryData) rrcBatteryData {
+	aggregate := group[len(group)-1]
+	var weight, voltage, voltageMeasured, current, ntc, chargingVoltage, chargingCurrent float64
+	var relativeCharge, absoluteCharge, remainingCapacity, timeToFull, timeToEmpty, kelvin, celsius float64
+	for _, r := range group {
+		w := float64(r.Aggregated)
+		if w < 1 {
+			w = 1
+		}
+		weight += w
+		voltage += w * float64(r.Voltage)
+		voltageMeasured += w * float64(r.VoltageMeasured)
+		current += w * float64(r.Current)
+		ntc += w * float64(r.NTC)
+		chargingVoltage += w * float64(r.ChargingVoltage)
+		chargingCurrent += w * float64(r.ChargingCurrent)
+		relativeCharge += w * float64(r.RelativeCharge)
+		absoluteCharge += w * float64(r.AbsoluteCharge)
+		remainingCapacity += w * float64(r.RemainingCapacity)
+		timeToFull += w * float64(r.TimeToFull)
+		timeToEmpty += w * float64(r.TimeToEmpty)
+		kelvin += w * r.TemperatureK
+		celsius += w * r.TemperatureC
+	}
+	mean := func(sum float64) int { return int(math.Round(sum / weight)) }
+	aggregate.Voltage = mean(voltage)
+	aggregate.VoltageMeasured = mean(voltageMeasured)
+	aggregate.Current = mean(current)
+	aggregate.NTC = mean(ntc)
+	aggregate.ChargingVoltage = mean(chargingVoltage)
+	aggregate.ChargingCurrent = mean(chargingCurrent)
+	aggregate.RelativeCharge = mean(relativeCharge)
+	aggregate.AbsoluteCharge = mean(absoluteCharge)
+	aggregate.RemainingCapacity = mean(remainingCapacity)
+	aggregate.TimeToFull = mean(timeToFull)
+	aggregate.TimeToEmpty = mean(timeToEmpty)
+	aggregate.TemperatureK = kelvin / weight
+	aggregate.TemperatureC = celsius / weight
+	aggregate.Aggregated = int(weight)
+	setStateOfHealth(&aggregate)
+	return aggregate
+}
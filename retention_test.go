@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStoreSample(t *testing.T) {
+	chdirTemp(t)
+	store := newMemStore()
+	reading := testReading("RRC2040-2", "#1", "", 20)
+	now := time.Date(2021, 1, 15, 12, 30, 0, 0, time.UTC)
+	if err := storeSample(store, generalConfiguration{}, &reading, now, false); err != nil {
+		t.Fatal(err)
+	}
+	readings, err := store.Readings(batteryKey(reading))
+	if err != nil || len(readings) != 1 {
+		t.Fatalf("Readings = %d, %v, want 1", len(readings), err)
+	}
+	if !readings[0].Sample || readings[0].Timestamp != "2021-01-15T12:30:00Z" {
+		t.Errorf("stored %s sample=%v, want a sample at 2021-01-15T12:30:00Z", readings[0].Timestamp, readings[0].Sample)
+	}
+}
+
+func TestCompactKeepsSnapshots(t *testing.T) {
+	policy := []parsedTier{{after: 24 * time.Hour, resolution: time.Minute}}
+	now := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+	sample := func(ts string, charge int) rrcBatteryData {
+		r := testReading("RRC2040-2", "#1", ts, 20)
+		r.Sample = true
+		r.RelativeCharge = charge
+		return r
+	}
+	// The snapshot sits on the start of the minute the samples fall into.
+	snapshot := testReading("RRC2040-2", "#1", "2021-01-15T12:31:00Z", 20)
+	forEachBackend(t, func(t *testing.T, store Store) {
+		appendAll(t, store,
+			sample("2021-01-15T12:30:10Z", 40),
+			sample("2021-01-15T12:30:40Z", 50),
+			snapshot,
+			sample("2021-01-15T12:31:20Z", 60),
+			sample("2021-01-15T12:31:50Z", 80),
+		)
+		report, err := compactStore(store, policy, now, false)
+		if err != nil || report.Removed != 4 || report.Aggregates != 2 {
+			t.Fatalf("compactStore = %+v, %v, want 4 samples merged into 2 aggregates", report, err)
+		}
+		readings, err := store.Readings("RRC2040-2#1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"2021-01-15T12:30:40Z", "2021-01-15T12:31:00Z", "2021-01-15T12:31:50Z"}
+		if got := timestampsOf(readings); len(got) != 3 || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+			t.Fatalf("Readings = %v, want %v", got, want)
+		}
+		if readings[1].Sample || readings[1].Aggregated != 0 {
+			t.Errorf("snapshot replaced by an aggregate: %+v", readings[1])
+		}
+		if readings[2].Aggregated != 2 || readings[2].RelativeCharge != 70 {
+			t.Errorf("aggregate holds %d samples at %d%%, want 2 at 70%%", readings[2].Aggregated, readings[2].RelativeCharge)
+		}
+		// Compacting again changes nothing.
+		if report, err := compactStore(store, policy, now, false); err != nil || report.Aggregates != 0 {
+			t.Errorf("second compactStore = %+v, %v, want nothing to do", report, err)
+		}
+	})
+}
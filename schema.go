@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// recordMigrations upgrade a stored reading, decoded into a generic map, by
+// one version: recordMigrations[i] turns version i into version i+1.
+// Records written before versioning have no "schemaversion" and are
+// version 0. Append a function here whenever rrcBatteryData changes in a
+// way old records cannot be read with.
+var recordMigrations = []func(record map[string]interface{}) error{
+	// 0 -> 1: unversioned records already have the version 1 layout.
+	func(record map[string]interface{}) error { return nil },
+	// 1 -> 2: timestamps move from local YYYYMMDDhhmmss to RFC 3339 in UTC,
+	// and the offset of the station, taken from legacyZone, is kept.
+	func(record map[string]interface{}) error {
+		timestamp, _ := record["timestamp"].(string)
+		if timestamp == "" {
+			return nil
+		}
+		t, err := time.ParseInLocation(fmtDateTime, timestamp, legacyZone)
+		if err != nil {
+			return fmt.Errorf("timestamp \"%s\": %w", timestamp, err)
+		}
+		record["timestamp"] = formatTimestamp(t)
+		record["zone"] = zoneOf(t)
+		return nil
+	},
+	// 2 -> 3: the state of health is stored with the reading.
+	func(record map[string]interface{}) error {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		var reading rrcBatteryData
+		if err := json.Unmarshal(data, &reading); err != nil {
+			return err
+		}
+		setStateOfHealth(&reading)
+		record["soh"] = reading.SoH
+		record["energysoh"] = reading.EnergySoH
+		return nil
+	},
+}
+
+// recordVersion is the schema version new readings are written with.
+var recordVersion = len(recordMigrations)
+
+// recordSchemaVersion returns the version a raw record was written with.
+func recordSchemaVersion(record map[string]interface{}) (int, error) {
+	value, ok := record["schemaversion"]
+	if !ok || value == nil {
+		return 0, nil
+	}
+	version, ok := value.(float64)
+	if !ok || version < 0 || version != float64(int(version)) {
+		return 0, fmt.Errorf("invalid schema version %v", value)
+	}
+	return int(version), nil
+}
+
+// decodeRecord reads a stored reading and upgrades it to recordVersion. The
+// version it was stored with is returned as well.
+func decodeRecord(data []byte) (rrcBatteryData, int, error) {
+	var reading rrcBatteryData
+	var record map[string]interface{}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return reading, 0, err
+	}
+	version, err := recordSchemaVersion(record)
+	if err != nil {
+		return reading, 0, err
+	}
+	if version > recordVersion {
+		return reading, version, fmt.Errorf("schema version %d is newer than this rrcreader supports (%d)", version, recordVersion)
+	}
+	for v := version; v < recordVersion; v++ {
+		if err := recordMigrations[v](record); err != nil {
+			return reading, version, fmt.Errorf("migrating from schema version %d: %w", v, err)
+		}
+	}
+	record["schemaversion"] = recordVersion
+	upgraded, err := json.Marshal(record)
+	if err != nil {
+		return reading, version, err
+	}
+	if err := json.Unmarshal(upgraded, &reading); err != nil {
+		return reading, version, err
+	}
+	return reading, version, nil
+}
+
+// skipRecord reports a record Readings leaves out because it cannot be read.
+func skipRecord(source string, err error) {
+	fmt.Printf("Skipping unreadable record \"%s\": %v (see \"rrcreader db verify\")\n", source, err)
+}
+
+// recordProblem is an unreadable or inconsistent record found by Verify.
+type recordProblem struct {
+	Source  string // file or table row holding the record
+	Problem string
+}
+
+// verifyReport is the result of checking every stored reading.
+type verifyReport struct {
+	Records  int
+	Outdated []readingRef // sound records stored with an older schema version
+	Problems []recordProblem
+}
+
+func (r verifyReport) String() string {
+	var b strings.Builder
+	for _, p := range r.Problems {
+		fmt.Fprintf(&b, "%s: %s\n", p.Source, p.Problem)
+	}
+	fmt.Fprintf(&b, "%d record(s) checked, %d problem(s), %d with an older schema version\n", r.Records, len(r.Problems), len(r.Outdated))
+	return b.String()
+}
+
+// verifyRecord decodes a stored record and checks it against the battery and
+// timestamp it is stored under. Problems are added to the report.
+func (r *verifyReport) verifyRecord(source, batteryID, timestamp string, data []byte) {
+	r.Records++
+	reading, version, err := decodeRecord(data)
+	if err != nil {
+		r.Problems = append(r.Problems, recordProblem{Source: source, Problem: err.Error()})
+		return
+	}
+	problems := len(r.Problems)
+	for _, problem := range readingProblems(reading) {
+		r.Problems = append(r.Problems, recordProblem{Source: source, Problem: problem})
+	}
+	if key := batteryKey(reading); key != batteryID {
+		r.Problems = append(r.Problems, recordProblem{Source: source, Problem: fmt.Sprintf("belongs to battery \"%s\"", key)})
+	}
+	if timestampKey(reading.Timestamp) != timestampKey(normalizeTimestamp(timestamp)) {
+		r.Problems = append(r.Problems, recordProblem{Source: source, Problem: fmt.Sprintf("has timestamp \"%s\"", reading.Timestamp)})
+	}
+	if version < recordVersion && len(r.Problems) == problems {
+		r.Outdated = append(r.Outdated, readingRef{BatteryID: batteryID, Timestamp: timestamp})
+	}
+}
+
+// readingProblems lists the values of a reading that cannot be right.
+func readingProblems(reading rrcBatteryData) []string {
+	problems := []string{}
+	if reading.Name == "" || reading.SerialNumber == "" {
+		problems = append(problems, "battery name or serial number missing")
+	}
+	if _, err := time.Parse(time.RFC3339, reading.Timestamp); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid timestamp \"%s\"", reading.Timestamp))
+	}
+	if reading.CycleCount < 0 {
+		problems = append(problems, fmt.Sprintf("negative cycle count %d", reading.CycleCount))
+	}
+	if reading.FullCapacity < 0 || reading.DesignCapacity < 0 || reading.RemainingCapacity < 0 {
+		problems = append(problems, "negative capacity")
+	}
+	if reading.RelativeCharge < 0 || reading.RelativeCharge > 100 || reading.AbsoluteCharge < 0 || reading.AbsoluteCharge > 255 {
+		problems = append(problems, fmt.Sprintf("charge out of range (relative %d%%, absolute %d%%)", reading.RelativeCharge, reading.AbsoluteCharge))
+	}
+	return problems
+}
+
+// upgradeRecords rewrites the outdated records found by Verify with the
+// current schema version. Append replaces the record stored under the old
+// form of its timestamp.
+func upgradeRecords(store Store, outdated []readingRef) (int, error) {
+	// battery -> file name key of the upgraded timestamp
+	byBattery := make(map[string]map[string]bool)
+	for _, ref := range outdated {
+		if byBattery[ref.BatteryID] == nil {
+			byBattery[ref.BatteryID] = make(map[string]bool)
+		}
+		byBattery[ref.BatteryID][timestampKey(normalizeTimestamp(ref.Timestamp))] = true
+	}
+	upgraded := 0
+	for batteryID, timestamps := range byBattery {
+		readings, err := store.Readings(batteryID)
+		if err != nil {
+			return upgraded, fmt.Errorf("reading \"%s\": %w", batteryID, err)
+		}
+		for _, r := range readings {
+			if !timestamps[timestampKey(r.Timestamp)] {
+				continue
+			}
+			if err := store.Append(r); err != nil {
+				return upgraded, err
+			}
+			upgraded++
+		}
+	}
+	return upgraded, nil
+}
+
+// upgradeRegistry rewrites the attachments and notes, converting the times
+// stored before schema version 2.
+func upgradeRegistry(store Store) error {
+	attachments, err := store.Attachments("")
+	if err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		if err := store.PutAttachment(a); err != nil {
+			return err
+		}
+	}
+	notes, err := store.Notes()
+	if err != nil {
+		return err
+	}
+	for _, n := range notes {
+		if err := store.PutNote(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upgradeReading brings a reading received from another station, which may
+// run an older version, to the current schema.
+func upgradeReading(reading rrcBatteryData) (rrcBatteryData, error) {
+	payload, err := json.Marshal(reading)
+	if err != nil {
+		return reading, err
+	}
+	upgraded, _, err := decodeRecord(payload)
+	return upgraded, err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const legacyRecord = `{"manufacturer": "RRC", "name": "RRC2040-2", "serial": "#1", "timestamp": "20210115123000",
+	"cyclecount": 20, "fullcapacity": 6210, "designcapacity": 6900, "designvoltage": 10800,
+	"optmfg3f": "0e10 hex", "optmfg3e": "0e10 hex", "optmfg3d": "0e10 hex"}`
+
+func TestDecodeRecordMigrates(t *testing.T) {
+	useUTC(t)
+	reading, version, err := decodeRecord([]byte(legacyRecord))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Errorf("version = %d, want 0 for a record without schemaversion", version)
+	}
+	if reading.SchemaVersion != recordVersion {
+		t.Errorf("SchemaVersion = %d, want %d", reading.SchemaVersion, recordVersion)
+	}
+	if reading.Timestamp != "2021-01-15T12:30:00Z" || reading.Zone != "+00:00" {
+		t.Errorf("Timestamp, Zone = %s, %s, want 2021-01-15T12:30:00Z, +00:00", reading.Timestamp, reading.Zone)
+	}
+	if reading.SoH != 90 {
+		t.Errorf("SoH = %g, want 90", reading.SoH)
+	}
+}
+
+func TestDecodeRecordRejects(t *testing.T) {
+	for _, record := range []string{
+		`{"name": "RRC2040-2", "schemaversion": 999}`,
+		`{"name": "RRC2040-2", "schemaversion": 1.5}`,
+		`{"name": "RRC2040-2", "schemaversion": 1, "timestamp": "yesterday"}`,
+		`{"name": `,
+	} {
+		if _, _, err := decodeRecord([]byte(record)); err == nil {
+			t.Errorf("decodeRecord(%s) succeeded, want an error", record)
+		}
+	}
+}
+
+func TestUpgradeRecords(t *testing.T) {
+	useUTC(t)
+	var legacy rrcBatteryData
+	if err := json.Unmarshal([]byte(legacyRecord), &legacy); err != nil {
+		t.Fatal(err)
+	}
+	// ageRecord stores the legacy reading the way a version before 2 did.
+	ageRecord := map[string]func(t *testing.T, store Store){
+		"memory": func(t *testing.T, store Store) {},
+		"json": func(t *testing.T, store Store) {
+			dir := filepath.Join(store.(*scribbleStore).dir, "RRC2040-2#1")
+			if err := os.Rename(filepath.Join(dir, "20210115T123000Z.json"), filepath.Join(dir, "20210115123000.json")); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"sql": func(t *testing.T, store Store) {
+			if _, err := store.(*sqlStore).db.Exec(`UPDATE readings SET timestamp = '20210115123000' WHERE timestamp = '2021-01-15T12:30:00Z'`); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	for name, open := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			store := open()
+			defer store.Close()
+			appendAll(t, store, legacy, testReading("RRC2040-2", "#1", "2021-03-01T10:00:00Z", 30))
+			ageRecord[name](t, store)
+
+			report, err := store.Verify()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Outdated) != 1 || len(report.Problems) != 0 {
+				t.Fatalf("Verify = %+v, want one outdated record", report)
+			}
+			upgraded, err := upgradeRecords(store, report.Outdated)
+			if err != nil || upgraded != 1 {
+				t.Fatalf("upgradeRecords = %d, %v, want 1", upgraded, err)
+			}
+			if report, err = store.Verify(); err != nil || report.Records != 2 || len(report.Outdated) != 0 || len(report.Problems) != 0 {
+				t.Errorf("Verify after upgrading = %+v, %v, want 2 current records", report, err)
+			}
+			readings, err := store.Readings("RRC2040-2#1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"2021-01-15T12:30:00Z", "2021-03-01T10:00:00Z"}
+			if got := timestampsOf(readings); strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("Readings = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestSQLSchemaMigration opens a database created by the first SQL version
+// and checks every migration is applied once.
+func TestSQLSchemaMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rrcreader.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(sqlSchema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO devices (serial, firstseen, lastseen) VALUES ('1234.1', '2021-01-01T00:00:00Z', '2021-01-01T00:00:00Z')`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	for i := 0; i < 2; i++ {
+		store, err := openSQLStore(path)
+		if err != nil {
+			t.Fatalf("open #%d: %v", i+1, err)
+		}
+		var version int
+		if err := store.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+		if version != len(sqlMigrations) {
+			t.Errorf("open #%d: user_version = %d, want %d", i+1, version, len(sqlMigrations))
+		}
+		devices, err := store.Devices()
+		if err != nil || len(devices) != 1 || devices[0].Serial != "1234.1" {
+			t.Errorf("open #%d: Devices = %+v, %v, want the device from before the migration", i+1, devices, err)
+		}
+		store.Close()
+	}
+}
+
+func TestDecodeRecordLegacyZone(t *testing.T) {
+	zone := legacyZone
+	t.Cleanup(func() { legacyZone = zone })
+	if err := setLegacyZone("Europe/Helsinki"); err != nil {
+		t.Fatal(err)
+	}
+	reading, _, err := decodeRecord([]byte(legacyRecord))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reading.Timestamp != "2021-01-15T10:30:00Z" || reading.Zone != "+02:00" {
+		t.Errorf("Timestamp, Zone = %s, %s, want 2021-01-15T10:30:00Z, +02:00", reading.Timestamp, reading.Zone)
+	}
+	if err := setLegacyZone("Nowhere/Atlantis"); err == nil {
+		t.Error("setLegacyZone accepted an unknown zone")
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	scribble "github.com/nanobox-io/golang-scribble"
+)
+
+// scribbleStore keeps one JSON file per reading in
+// <dir>/<battery key>/<timestamp>.json. Devices and attachment histories
+// live next to it in registry/devices/<serial>.json and
+// registry/attachments/<battery key>.json, notes in registry/notes/<id>.json.
+//
+// Several processes may share the tree: writes hold the lock file
+// <dir>.lock and replace files atomically, so readers never see a partial
+// record and need no lock.
+type scribbleStore struct {
+	dir         string
+	registryDir string
+	lockPath    string
+	db          *scribble.Driver
+}
+
+func openScribbleStore(dir string) (*scribbleStore, error) {
+	db, err := scribble.New(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	regDir := filepath.Join(filepath.Dir(dir), filepath.Base(registryDir))
+	return &scribbleStore{dir: dir, registryDir: regDir, lockPath: filepath.Clean(dir) + ".lock", db: db}, nil
+}
+
+// openScribbleSource opens an existing JSON database for reading only; no
+// directory is created. Writes to it fail.
+func openScribbleSource(dir string) (Store, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("\"%s\" is not a directory", dir)
+	}
+	regDir := filepath.Join(filepath.Dir(dir), filepath.Base(registryDir))
+	return readOnlyStore{&scribbleStore{dir: dir, registryDir: regDir}}, nil
+}
+
+// locked runs a write while holding the store's lock file.
+func (s *scribbleStore) locked(write func() error) error {
+	lock, err := lockFile(s.lockPath)
+	if err != nil {
+		return err
+	}
+	err = write()
+	if unlockErr := lock.Unlock(); err == nil {
+		err = unlockErr
+	}
+	return err
+}
+
+// jsonFiles lists the ".json" files of a directory, sorted by name. Files
+// of unfinished writes are left out.
+func jsonFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// fileName makes a battery key, note ID or timestamp safe to use as one
+// path component, so records sent by other stations stay inside the store.
+func fileName(name string) string {
+	name = strings.NewReplacer("/", "_", `\`, "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "_" + name
+	}
+	return name
+}
+
+// recordFiles lists the record files of a collection, sorted by name.
+func (s *scribbleStore) recordFiles(batteryID string) ([]string, error) {
+	names, err := jsonFiles(filepath.Join(s.dir, fileName(batteryID)))
+	if os.IsNotExist(err) {
+		return nil, errNotFound
+	}
+	return names, err
+}
+
+func (s *scribbleStore) Readings(batteryID string) ([]rrcBatteryData, error) {
+	names, err := s.recordFiles(batteryID)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, errNotFound
+	}
+	recordslist := []rrcBatteryData{}
+	for _, name := range names {
+		path := filepath.Join(s.dir, fileName(batteryID), name)
+		byteValue, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			// Removed since the directory was listed.
+			continue
+		}
+		if err != nil {
+			skipRecord(path, err)
+			continue
+		}
+		recFound, _, err := decodeRecord(byteValue)
+		if err != nil {
+			skipRecord(path, err)
+			continue
+		}
+		recordslist = append(recordslist, recFound)
+	}
+	if len(recordslist) == 0 {
+		return nil, errNotFound
+	}
+	sortReadings(recordslist)
+	return recordslist, nil
+}
+
+// Append stores the reading under its timestamp in the stored form and
+// removes a file left under the old local form of the same time.
+func (s *scribbleStore) Append(reading rrcBatteryData) error {
+	return s.locked(func() error {
+		dir := filepath.Join(s.dir, fileName(batteryKey(reading)))
+		key := fileName(timestampKey(normalizeTimestamp(reading.Timestamp)))
+		if err := writeJSONFile(filepath.Join(dir, key+".json"), reading); err != nil {
+			return err
+		}
+		for _, candidate := range timestampCandidates(reading.Timestamp) {
+			if old := fileName(timestampKey(candidate)); old != key {
+				if err := os.Remove(filepath.Join(dir, old+".json")); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *scribbleStore) Delete(batteryID, timestamp string) error {
+	return s.locked(func() error {
+		return s.delete(batteryID, timestamp)
+	})
+}
+
+func (s *scribbleStore) delete(batteryID, timestamp string) error {
+	key := ""
+	for _, candidate := range timestampCandidates(timestamp) {
+		path := filepath.Join(s.dir, fileName(batteryID), fileName(timestampKey(candidate))+".json")
+		if _, err := os.Stat(path); err == nil {
+			key = fileName(timestampKey(candidate))
+			break
+		}
+	}
+	if key == "" {
+		return errNotFound
+	}
+	if err := s.db.Delete(fileName(batteryID), key); err != nil {
+		return err
+	}
+	names, err := s.recordFiles(batteryID)
+	if err == nil && len(names) == 0 {
+		return os.Remove(filepath.Join(s.dir, fileName(batteryID)))
+	}
+	return nil
+}
+
+func (s *scribbleStore) DeviceFor(batteryID string) (string, error) {
+	readings, err := s.Readings(batteryID)
+	if err != nil {
+		return "", err
+	}
+	attachments, err := s.Attachments(batteryID)
+	if err != nil {
+		return "", err
+	}
+	return deviceFromHistory(batteryID, attachments, readings), nil
+}
+
+// readRegistry decodes every record of a registry collection into out,
+// which is called once per file.
+func (s *scribbleStore) readRegistry(collection string, out func([]byte) error) error {
+	dir := filepath.Join(s.registryDir, collection)
+	names, err := jsonFiles(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, name := range names {
+		record, err := os.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			// Removed since the directory was listed.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := out(record); err != nil {
+			return fmt.Errorf("%s: %w", collection, err)
+		}
+	}
+	return nil
+}
+
+// writeRegistry stores one record of a registry collection.
+func (s *scribbleStore) writeRegistry(collection, name string, v interface{}) error {
+	return writeJSONFile(filepath.Join(s.registryDir, collection, fileName(name)+".json"), v)
+}
+
+func (s *scribbleStore) Devices() ([]deviceRecord, error) {
+	list := []deviceRecord{}
+	err := s.readRegistry("devices", func(record []byte) error {
+		var device deviceRecord
+		if err := json.Unmarshal(record, &device); err != nil {
+			return err
+		}
+		list = append(list, device)
+		return nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Serial < list[j].Serial })
+	return list, err
+}
+
+func (s *scribbleStore) PutDevice(device deviceRecord) error {
+	return s.locked(func() error {
+		return s.writeRegistry("devices", identityUnsafe.ReplaceAllString(device.Serial, "_"), device)
+	})
+}
+
+func (s *scribbleStore) Attachments(batteryID string) ([]attachment, error) {
+	list := []attachment{}
+	if batteryID != "" {
+		record, err := os.ReadFile(filepath.Join(s.registryDir, "attachments", fileName(batteryID)+".json"))
+		if err == nil {
+			err = json.Unmarshal(record, &list)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	} else {
+		err := s.readRegistry("attachments", func(record []byte) error {
+			var history []attachment
+			if err := json.Unmarshal(record, &history); err != nil {
+				return err
+			}
+			list = append(list, history...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := range list {
+		list[i] = normalizeAttachment(list[i])
+	}
+	return list, nil
+}
+
+// PutAttachment rewrites the battery's history under the lock, so
+// concurrent swaps recorded by other processes are not lost.
+func (s *scribbleStore) PutAttachment(a attachment) error {
+	return s.locked(func() error {
+		return s.putAttachment(a)
+	})
+}
+
+func (s *scribbleStore) putAttachment(a attachment) error {
+	history, err := s.Attachments(a.BatteryID)
+	if err != nil {
+		return err
+	}
+	replaced := false
+	for i := range history {
+		if history[i].Attached == a.Attached {
+			history[i] = a
+			replaced = true
+		}
+	}
+	if !replaced {
+		history = append(history, a)
+	}
+	sortAttachments(history)
+	return s.writeRegistry("attachments", a.BatteryID, history)
+}
+
+func (s *scribbleStore) Notes() ([]note, error) {
+	list := []note{}
+	err := s.readRegistry("notes", func(record []byte) error {
+		var n note
+		if err := json.Unmarshal(record, &n); err != nil {
+			return err
+		}
+		list = append(list, normalizeNote(n))
+		return nil
+	})
+	sortNotes(list)
+	return list, err
+}
+
+func (s *scribbleStore) PutNote(n note) error {
+	return s.locked(func() error {
+		return s.writeRegistry("notes", n.ID, n)
+	})
+}
+
+func (s *scribbleStore) ListBatteries(filter batteryFilter) ([]batterySummary, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	list := []batterySummary{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		readings, err := s.Readings(e.Name())
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if summary := summarize(e.Name(), readings); filter.match(summary) {
+			list = append(list, summary)
+		}
+	}
+	return list, nil
+}
+
+func (s *scribbleStore) Verify() (verifyReport, error) {
+	var report verifyReport
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return report, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		names, err := s.recordFiles(e.Name())
+		if err != nil {
+			return report, err
+		}
+		for _, name := range names {
+			path := filepath.Join(s.dir, e.Name(), name)
+			byteValue, err := os.ReadFile(path)
+			if err != nil {
+				report.Records++
+				report.Problems = append(report.Problems, recordProblem{Source: path, Problem: err.Error()})
+				continue
+			}
+			report.verifyRecord(path, e.Name(), strings.TrimSuffix(name, ".json"), byteValue)
+		}
+	}
+	return report, nil
+}
+
+func (s *scribbleStore) Close() error {
+	return nil
+}
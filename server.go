@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syncServer is the collection server stations sync against. Readings are
+// kept in the regular store, so a server data directory can also be used
+// with the other commands.
+type syncServer struct {
+	mu       sync.Mutex
+	store    Store
+	log      *changeLog
+	user     string
+	password string
+}
+
+func newSyncServer(store Store, log *changeLog, genConfig generalConfiguration) *syncServer {
+	return &syncServer{
+		store:    store,
+		log:      log,
+		user:     genConfig.RemoteUser,
+		password: genConfig.RemotePassword,
+	}
+}
+
+func (s *syncServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/push", s.handlePush)
+	mux.HandleFunc("/api/v1/changes", s.handleChanges)
+	mux.HandleFunc("/api/v1/batteries", s.handleBatteries)
+	mux.HandleFunc("/api/v1/readings", s.handleReadings)
+	mux.Handle("/reports/", http.StripPrefix("/reports/", http.FileServer(http.Dir(htmlDir))))
+	return s.authenticate(mux)
+}
+
+func (s *syncServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(s.user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="rrcreader"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+func (s *syncServer) handlePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var batch syncBatch
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<20)).Decode(&batch); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if batch.Station == "" {
+		http.Error(w, "bad request: station missing", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, err := s.accept(batch)
+	if err != nil {
+		log.Printf("Push from \"%s\" failed: %v", batch.Station, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Push from \"%s\": %d accepted, %d updated, %d duplicate(s), %d deleted, %d device/attachment/note update(s), %d profile(s)", batch.Station, result.Accepted, result.Updated, result.Duplicates, result.Deleted, result.Registry, result.Profiles)
+	writeJSON(w, result)
+}
+
+// accept stores the readings of a push that the server does not have yet.
+// A reading is a duplicate when its battery already has the same reading
+// under its timestamp. One that differs, such as the aggregate a station's
+// compaction left under the timestamp of its newest sample, replaces it.
+func (s *syncServer) accept(batch syncBatch) (syncPushResult, error) {
+	var result syncPushResult
+	tracked := newTrackedStore(s.store, s.log, batch.Station)
+	known := make(map[string]map[string]rrcBatteryData)
+	for _, reading := range batch.Readings {
+		// Stations running an older version push older records.
+		reading, err := upgradeReading(reading)
+		if err != nil {
+			return result, err
+		}
+		id := batteryKey(reading)
+		if reading.Name == "" || reading.Timestamp == "" {
+			return result, fmt.Errorf("reading without battery name or timestamp")
+		}
+		if err := checkReading(reading); err != nil {
+			return result, err
+		}
+		if known[id] == nil {
+			known[id] = make(map[string]rrcBatteryData)
+			existing, err := s.store.Readings(id)
+			if err != nil && err != errNotFound {
+				return result, err
+			}
+			for _, e := range existing {
+				known[id][e.Timestamp] = e
+			}
+		}
+		have, ok := known[id][reading.Timestamp]
+		if ok && sameReading(have, reading) {
+			result.Duplicates++
+			continue
+		}
+		if err := tracked.Append(reading); err != nil {
+			return result, err
+		}
+		known[id][reading.Timestamp] = reading
+		if ok {
+			result.Updated++
+		} else {
+			result.Accepted++
+		}
+	}
+	deleted, err := applyDeletes(tracked, batch.Deleted)
+	result.Deleted = deleted
+	if err != nil {
+		return result, err
+	}
+	applied, err := applyRegistry(tracked, batch.Devices, batch.Attachments)
+	result.Registry = applied
+	if err != nil {
+		return result, err
+	}
+	applied, err = applyNotes(tracked, batch.Notes)
+	result.Registry += applied
+	if err != nil {
+		return result, err
+	}
+	if len(batch.Profiles) > 0 {
+		profiles, err := loadProfileRecords()
+		if err != nil && !os.IsNotExist(err) {
+			return result, err
+		}
+		merged, changed, conflicts := mergeProfiles(profiles, batch.Profiles)
+		for _, c := range conflicts {
+			log.Printf("Profile conflict from \"%s\" (server kept): %s", batch.Station, c)
+		}
+		if changed > 0 {
+			if err := saveProfileRecords(merged); err != nil {
+				return result, err
+			}
+		}
+		result.Profiles = changed
+	}
+	return result, nil
+}
+
+// handleChanges returns the readings stored and deleted since the given
+// cursor, leaving out the changes the asking station sent itself.
+func (s *syncServer) handleChanges(w http.ResponseWriter, r *http.Request) {
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		since = 0
+	}
+	station := r.URL.Query().Get("station")
+	entries, err := s.log.Entries(since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	batch := syncBatch{Next: since, Readings: []rrcBatteryData{}, Deleted: []readingRef{}}
+	histories := make(map[string][]rrcBatteryData)
+	changedDevices := make(map[string]bool)
+	changedAttachments := make(map[readingRef]bool)
+	changedNotes := make(map[string]bool)
+	for _, e := range entries {
+		if len(batch.Readings) >= syncBatchSize {
+			batch.More = true
+			break
+		}
+		batch.Next = e.Seq
+		if e.Origin == station {
+			continue
+		}
+		switch e.Kind {
+		case "delete":
+			batch.Deleted = append(batch.Deleted, readingRef{BatteryID: e.BatteryID, Timestamp: e.Timestamp})
+			continue
+		case "device":
+			changedDevices[e.Device] = true
+			continue
+		case "attachment":
+			changedAttachments[readingRef{BatteryID: e.BatteryID, Timestamp: e.Timestamp}] = true
+			continue
+		case "note":
+			changedNotes[e.Note] = true
+			continue
+		}
+		history, ok := histories[e.BatteryID]
+		if !ok {
+			history, err = s.store.Readings(e.BatteryID)
+			if err != nil && err != errNotFound {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			histories[e.BatteryID] = history
+		}
+		for _, reading := range history {
+			if reading.Timestamp == e.Timestamp {
+				batch.Readings = append(batch.Readings, reading)
+				break
+			}
+		}
+	}
+	if err := s.collectRegistry(&batch, changedDevices, changedAttachments, changedNotes); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	profiles, err := loadProfileRecords()
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	batch.Profiles = profiles
+	writeJSON(w, batch)
+}
+
+// collectRegistry adds the current state of the changed devices,
+// attachments and notes to a pull batch.
+func (s *syncServer) collectRegistry(batch *syncBatch, devices map[string]bool, attachments map[readingRef]bool, notes map[string]bool) error {
+	if len(devices) > 0 {
+		all, err := s.store.Devices()
+		if err != nil {
+			return err
+		}
+		for _, d := range all {
+			if devices[d.Serial] {
+				batch.Devices = append(batch.Devices, d)
+			}
+		}
+	}
+	if len(attachments) > 0 {
+		all, err := s.store.Attachments("")
+		if err != nil {
+			return err
+		}
+		for _, a := range all {
+			if attachments[readingRef{BatteryID: a.BatteryID, Timestamp: a.Attached}] {
+				batch.Attachments = append(batch.Attachments, a)
+			}
+		}
+	}
+	if len(notes) > 0 {
+		all, err := s.store.Notes()
+		if err != nil {
+			return err
+		}
+		for _, n := range all {
+			if notes[n.ID] {
+				batch.Notes = append(batch.Notes, n)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *syncServer) handleBatteries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	list, err := s.store.ListBatteries(batteryFilter{
+		NamePrefix:      query.Get("name"),
+		Chemistry:       query.Get("chemistry"),
+		DevSerialPrefix: query.Get("device"),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, list)
+}
+
+func (s *syncServer) handleReadings(w http.ResponseWriter, r *http.Request) {
+	readings, err := s.store.Readings(r.URL.Query().Get("battery"))
+	if err == errNotFound {
+		http.Error(w, "battery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, readings)
+}
+
+// scheduleCompaction downsamples old samples and drops superseded change
+// log entries every compactinterval.
+func (s *syncServer) scheduleCompaction(genConfig generalConfiguration) error {
+	policy, err := retentionPolicy(genConfig)
+	if err != nil {
+		return fmt.Errorf("invalid retention policy: %w", err)
+	}
+	interval := 24 * time.Hour
+	if genConfig.CompactInterval != "" {
+		if interval, err = parseAge(genConfig.CompactInterval); err != nil {
+			return fmt.Errorf("invalid compactinterval: %w", err)
+		}
+	}
+	if interval <= 0 {
+		return nil
+	}
+	go func() {
+		for range time.Tick(interval) {
+			s.mu.Lock()
+			report, err := compactStore(newTrackedStore(s.store, s.log, ""), policy, time.Now(), false)
+			s.mu.Unlock()
+			if err != nil {
+				log.Printf("Compaction failed: %v", err)
+				continue
+			}
+			log.Printf("Compaction: %s", strings.TrimSpace(report.String()))
+			if kept, removed, err := s.log.Compact(); err != nil {
+				log.Printf("Change log compaction failed: %v", err)
+			} else {
+				log.Printf("Change log: %d entries kept, %d superseded entries removed", kept, removed)
+			}
+		}
+	}()
+	return nil
+}
+
+// runServer serves the sync API and the HTML reports until it fails.
+func runServer(genConfig generalConfiguration, listen, certFile, keyFile string) error {
+	if genConfig.RemoteUser == "" || genConfig.RemotePassword == "" {
+		return fmt.Errorf("remoteuser and remotepassword must be set in \"%s\"", configFile)
+	}
+	store, err := openBaseStore(genConfig)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	server := newSyncServer(store, openChangeLog(changeLogFile), genConfig)
+	if err := server.scheduleCompaction(genConfig); err != nil {
+		return err
+	}
+	log.Printf("Serving on %s (reports from \"%s\")", listen, htmlDir)
+	if certFile != "" {
+		return http.ListenAndServeTLS(listen, certFile, keyFile, server.routes())
+	}
+	return http.ListenAndServe(listen, server.routes())
+}
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS batteries (
+	id             TEXT PRIMARY KEY,
+	name           TEXT NOT NULL,
+	serial         TEXT NOT NULL,
+	manufacturer   TEXT,
+	chemistry      TEXT,
+	mfgdate        TEXT,
+	designcapacity INTEGER,
+	designvoltage  INTEGER,
+	firstseen      TEXT,
+	lastseen       TEXT
+);
+CREATE INDEX IF NOT EXISTS batteries_name ON batteries(name);
+CREATE INDEX IF NOT EXISTS batteries_chemistry ON batteries(chemistry);
+
+CREATE TABLE IF NOT EXISTS devices (
+	serial    TEXT PRIMARY KEY,
+	firstseen TEXT,
+	lastseen  TEXT
+);
+
+CREATE TABLE IF NOT EXISTS readings (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	batteryid    TEXT NOT NULL REFERENCES batteries(id),
+	devserial    TEXT,
+	timestamp    TEXT NOT NULL,
+	cyclecount   INTEGER,
+	fullcapacity INTEGER,
+	data         TEXT NOT NULL,
+	UNIQUE(batteryid, timestamp)
+);
+CREATE INDEX IF NOT EXISTS readings_battery ON readings(batteryid, timestamp);
+CREATE INDEX IF NOT EXISTS readings_device ON readings(devserial);
+`
+
+// sqlMigrations upgrade databases created with an older sqlSchema. The
+// database's user_version counts the migrations applied.
+var sqlMigrations = []string{
+	`ALTER TABLE devices ADD COLUMN model TEXT NOT NULL DEFAULT '';
+	ALTER TABLE devices ADD COLUMN owner TEXT NOT NULL DEFAULT '';
+	ALTER TABLE devices ADD COLUMN location TEXT NOT NULL DEFAULT '';
+	ALTER TABLE devices ADD COLUMN updated TEXT NOT NULL DEFAULT '';
+	CREATE TABLE IF NOT EXISTS attachments (
+		batteryid TEXT NOT NULL,
+		devserial TEXT NOT NULL,
+		attached  TEXT NOT NULL,
+		detached  TEXT NOT NULL DEFAULT '',
+		updated   TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY(batteryid, attached)
+	);
+	CREATE INDEX IF NOT EXISTS attachments_device ON attachments(devserial);`,
+	`CREATE TABLE IF NOT EXISTS notes (
+		id        TEXT PRIMARY KEY,
+		batteryid TEXT NOT NULL DEFAULT '',
+		devserial TEXT NOT NULL DEFAULT '',
+		data      TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS notes_battery ON notes(batteryid);`,
+	`ALTER TABLE attachments ADD COLUMN removed INTEGER NOT NULL DEFAULT 0;`,
+}
+
+// sqlStore keeps batteries, devices and readings in an embedded SQLite
+// database. The full readout is stored as JSON next to the indexed columns.
+type sqlStore struct {
+	db *sql.DB
+}
+
+func openSQLStore(path string) (*sqlStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	// Other processes may hold the database; wait for them instead of
+	// failing with "database is locked".
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(10000)")
+	if err != nil {
+		return nil, err
+	}
+	// A single connection serializes writers within the process.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqlSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating schema: %w", err)
+	}
+	if err := migrateSQLSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlStore{db: db}, nil
+}
+
+// openSQLSource opens an existing database for reading only. A database
+// with an older schema is read from a migrated temporary copy, so the
+// source is never changed. Writes to it fail.
+func openSQLSource(path string) (Store, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro&_pragma=busy_timeout(10000)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if version > len(sqlMigrations) {
+		db.Close()
+		return nil, fmt.Errorf("schema version %d is newer than this rrcreader supports (%d)", version, len(sqlMigrations))
+	}
+	if version == len(sqlMigrations) {
+		return readOnlyStore{&sqlStore{db: db}}, nil
+	}
+	tmp, err := os.MkdirTemp("", "rrcreader-source-")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	copyPath := filepath.Join(tmp, filepath.Base(path))
+	_, err = db.Exec(`VACUUM INTO ?`, copyPath)
+	db.Close()
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("copying for migration: %w", err)
+	}
+	store, err := openSQLStore(copyPath)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	return readOnlyStore{&tempSQLStore{sqlStore: store, dir: tmp}}, nil
+}
+
+// vacuumSQLInto writes a compacted copy of the database at path to dest
+// with VACUUM INTO. The copy is one consistent state, taken in a read
+// transaction, so other processes may keep writing.
+func vacuumSQLInto(path, dest string) error {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(10000)")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(`VACUUM INTO ?`, dest)
+	return err
+}
+
+// tempSQLStore is a temporary database removed when it is closed.
+type tempSQLStore struct {
+	*sqlStore
+	dir string
+}
+
+func (s *tempSQLStore) Close() error {
+	err := s.sqlStore.Close()
+	if removeErr := os.RemoveAll(s.dir); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+func migrateSQLSchema(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(sqlMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqlMigrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrating schema to version %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) Append(dataset rrcBatteryData) error {
+	identifier := batteryKey(dataset)
+	timestamp := normalizeTimestamp(dataset.Timestamp)
+	payload, err := json.Marshal(dataset)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO batteries (id, name, serial, manufacturer, chemistry, mfgdate, designcapacity, designvoltage, firstseen, lastseen)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO NOTHING`,
+		identifier, dataset.Name, dataset.SerialNumber, dataset.Manufacturer, dataset.Chemistry, dataset.MfgDate,
+		dataset.DesignCapacity, dataset.DesignVoltage, timestamp, timestamp)
+	if err != nil {
+		return err
+	}
+	if err := widenSeen(tx, "batteries", "id", identifier, timestamp); err != nil {
+		return err
+	}
+	if hasDevice(dataset.DevSerialNumber) {
+		_, err = tx.Exec(`INSERT INTO devices (serial, firstseen, lastseen) VALUES (?, ?, ?)
+			ON CONFLICT(serial) DO NOTHING`,
+			dataset.DevSerialNumber, timestamp, timestamp)
+		if err != nil {
+			return err
+		}
+		if err := widenSeen(tx, "devices", "serial", dataset.DevSerialNumber, timestamp); err != nil {
+			return err
+		}
+	}
+	// A row not upgraded yet may hold the same time in the old local form.
+	for _, candidate := range timestampCandidates(timestamp) {
+		if candidate == timestamp {
+			continue
+		}
+		if _, err := tx.Exec(`DELETE FROM readings WHERE batteryid = ? AND timestamp = ?`, identifier, candidate); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO readings (batteryid, devserial, timestamp, cyclecount, fullcapacity, data)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(batteryid, timestamp) DO UPDATE SET
+			devserial = excluded.devserial,
+			cyclecount = excluded.cyclecount,
+			fullcapacity = excluded.fullcapacity,
+			data = excluded.data`,
+		identifier, dataset.DevSerialNumber, timestamp, dataset.CycleCount, dataset.FullCapacity, string(payload))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// widenSeen extends the firstseen/lastseen range of a battery or device row
+// to a timestamp. The stored values are compared as times: databases
+// written before version 2 may still hold local YYYYMMDDhhmmss values, which
+// do not sort with RFC 3339.
+func widenSeen(tx *sql.Tx, table, keyColumn, key, timestamp string) error {
+	var first, last sql.NullString
+	err := tx.QueryRow(`SELECT firstseen, lastseen FROM `+table+` WHERE `+keyColumn+` = ?`, key).Scan(&first, &last)
+	if err != nil {
+		return err
+	}
+	firstSeen, lastSeen := normalizeTimestamp(first.String), normalizeTimestamp(last.String)
+	if firstSeen == "" || timestamp < firstSeen {
+		firstSeen = timestamp
+	}
+	if lastSeen == "" || timestamp > lastSeen {
+		lastSeen = timestamp
+	}
+	_, err = tx.Exec(`UPDATE `+table+` SET firstseen = ?, lastseen = ? WHERE `+keyColumn+` = ?`, firstSeen, lastSeen, key)
+	return err
+}
+
+// seenRange returns the first and the last timestamp of a battery's
+// readings, compared as times.
+func seenRange(tx *sql.Tx, batteryID string) (string, string, error) {
+	rows, err := tx.Query(`SELECT timestamp FROM readings WHERE batteryid = ?`, batteryID)
+	if err != nil {
+		return "", "", err
+	}
+	defer rows.Close()
+	var firstSeen, lastSeen string
+	for rows.Next() {
+		var timestamp string
+		if err := rows.Scan(&timestamp); err != nil {
+			return "", "", err
+		}
+		timestamp = normalizeTimestamp(timestamp)
+		if firstSeen == "" || timestamp < firstSeen {
+			firstSeen = timestamp
+		}
+		if timestamp > lastSeen {
+			lastSeen = timestamp
+		}
+	}
+	return firstSeen, lastSeen, rows.Err()
+}
+
+func (s *sqlStore) Readings(batteryID string) ([]rrcBatteryData, error) {
+	rows, err := s.db.Query(`SELECT id, data FROM readings WHERE batteryid = ?`, batteryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	recordslist := []rrcBatteryData{}
+	for rows.Next() {
+		var id int64
+		var payload string
+		if err := rows.Scan(&id, &payload); err != nil {
+			return nil, err
+		}
+		recFound, _, err := decodeRecord([]byte(payload))
+		if err != nil {
+			skipRecord(fmt.Sprintf("readings row %d", id), err)
+			continue
+		}
+		recordslist = append(recordslist, recFound)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(recordslist) == 0 {
+		return nil, errNotFound
+	}
+	// Sorted after decoding: rows not upgraded yet hold old local timestamps.
+	sortReadings(recordslist)
+	return recordslist, nil
+}
+
+func (s *sqlStore) Delete(batteryID, timestamp string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	deleted := int64(0)
+	for _, candidate := range timestampCandidates(timestamp) {
+		res, err := tx.Exec(`DELETE FROM readings WHERE batteryid = ? AND timestamp = ?`, batteryID, candidate)
+		if err != nil {
+			return err
+		}
+		if deleted, _ = res.RowsAffected(); deleted > 0 {
+			break
+		}
+	}
+	if deleted == 0 {
+		return errNotFound
+	}
+	_, err = tx.Exec(`DELETE FROM batteries WHERE id = ? AND NOT EXISTS (SELECT 1 FROM readings WHERE batteryid = ?)`, batteryID, batteryID)
+	if err != nil {
+		return err
+	}
+	firstSeen, lastSeen, err := seenRange(tx, batteryID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE batteries SET firstseen = ?, lastseen = ? WHERE id = ?`, firstSeen, lastSeen, batteryID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) DeviceFor(batteryID string) (string, error) {
+	var seen int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM batteries WHERE id = ?`, batteryID).Scan(&seen); err != nil {
+		return "", err
+	}
+	if seen == 0 {
+		return "", errNotFound
+	}
+	attachments, err := s.Attachments(batteryID)
+	if err != nil {
+		return "", err
+	}
+	if len(liveAttachments(attachments)) > 0 {
+		return deviceFromHistory(batteryID, attachments, nil), nil
+	}
+	var devSN string
+	err = s.db.QueryRow(`SELECT devserial FROM readings
+		WHERE batteryid = ? AND devserial != '' AND devserial != '(none)'
+		ORDER BY timestamp DESC LIMIT 1`, batteryID).Scan(&devSN)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return devSN, err
+}
+
+func (s *sqlStore) Devices() ([]deviceRecord, error) {
+	rows, err := s.db.Query(`SELECT serial, model, owner, location, updated FROM devices ORDER BY serial`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []deviceRecord{}
+	for rows.Next() {
+		var device deviceRecord
+		if err := rows.Scan(&device.Serial, &device.Model, &device.Owner, &device.Location, &device.Updated); err != nil {
+			return nil, err
+		}
+		list = append(list, device)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) PutDevice(device deviceRecord) error {
+	_, err := s.db.Exec(`INSERT INTO devices (serial, model, owner, location, updated) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(serial) DO UPDATE SET
+			model = excluded.model,
+			owner = excluded.owner,
+			location = excluded.location,
+			updated = excluded.updated`,
+		device.Serial, device.Model, device.Owner, device.Location, device.Updated)
+	return err
+}
+
+func (s *sqlStore) Attachments(batteryID string) ([]attachment, error) {
+	rows, err := s.db.Query(`SELECT batteryid, devserial, attached, detached, removed, updated FROM attachments
+		WHERE ? = '' OR batteryid = ? ORDER BY attached`, batteryID, batteryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []attachment{}
+	for rows.Next() {
+		var a attachment
+		if err := rows.Scan(&a.BatteryID, &a.DeviceSerial, &a.Attached, &a.Detached, &a.Removed, &a.Updated); err != nil {
+			return nil, err
+		}
+		list = append(list, normalizeAttachment(a))
+	}
+	sortAttachments(list)
+	return list, rows.Err()
+}
+
+func (s *sqlStore) PutAttachment(a attachment) error {
+	// Replace the row of the same attachment stored with an old attach time.
+	if legacy := legacyTimestamp(a.Attached); legacy != a.Attached {
+		if _, err := s.db.Exec(`DELETE FROM attachments WHERE batteryid = ? AND attached = ?`, a.BatteryID, legacy); err != nil {
+			return err
+		}
+	}
+	_, err := s.db.Exec(`INSERT INTO attachments (batteryid, devserial, attached, detached, removed, updated) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(batteryid, attached) DO UPDATE SET
+			devserial = excluded.devserial,
+			detached = excluded.detached,
+			removed = excluded.removed,
+			updated = excluded.updated`,
+		a.BatteryID, a.DeviceSerial, a.Attached, a.Detached, a.Removed, a.Updated)
+	return err
+}
+
+func (s *sqlStore) Notes() ([]note, error) {
+	rows, err := s.db.Query(`SELECT data FROM notes`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []note{}
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		var n note
+		if err := json.Unmarshal([]byte(payload), &n); err != nil {
+			return nil, err
+		}
+		list = append(list, normalizeNote(n))
+	}
+	sortNotes(list)
+	return list, rows.Err()
+}
+
+func (s *sqlStore) PutNote(n note) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO notes (id, batteryid, devserial, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			batteryid = excluded.batteryid,
+			devserial = excluded.devserial,
+			data = excluded.data`,
+		n.ID, n.BatteryID, n.Device, string(payload))
+	return err
+}
+
+func (s *sqlStore) ListBatteries(filter batteryFilter) ([]batterySummary, error) {
+	rows, err := s.db.Query(`SELECT b.id, b.name, b.serial, b.manufacturer, b.chemistry, b.firstseen, b.lastseen,
+			(SELECT COUNT(*) FROM readings r WHERE r.batteryid = b.id),
+			COALESCE((SELECT r.devserial FROM readings r
+				WHERE r.batteryid = b.id AND r.devserial != '' AND r.devserial != '(none)'
+				ORDER BY r.timestamp DESC LIMIT 1), '')
+		FROM batteries b ORDER BY b.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []batterySummary{}
+	for rows.Next() {
+		var summary batterySummary
+		if err := rows.Scan(&summary.ID, &summary.Name, &summary.SerialNumber, &summary.Manufacturer, &summary.Chemistry,
+			&summary.FirstSeen, &summary.LastSeen, &summary.Readings, &summary.DevSerialNumber); err != nil {
+			return nil, err
+		}
+		summary.FirstSeen, summary.LastSeen = normalizeTimestamp(summary.FirstSeen), normalizeTimestamp(summary.LastSeen)
+		if filter.match(summary) {
+			list = append(list, summary)
+		}
+	}
+	return list, rows.Err()
+}
+
+func (s *sqlStore) Verify() (verifyReport, error) {
+	var report verifyReport
+	rows, err := s.db.Query(`SELECT id, batteryid, timestamp, data FROM readings ORDER BY batteryid, timestamp`)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var batteryID, timestamp, payload string
+		if err := rows.Scan(&id, &batteryID, &timestamp, &payload); err != nil {
+			return report, err
+		}
+		report.verifyRecord(fmt.Sprintf("readings row %d (%s %s)", id, batteryID, timestamp), batteryID, timestamp, []byte(payload))
+	}
+	return report, rows.Err()
+}
+
+// migrateReport counts what migrateJSONToSQL copied.
+type migrateReport struct {
+	Readings    int
+	Skipped     int // unreadable reading files
+	Devices     int
+	Attachments int
+	Notes       int
+}
+
+func (r migrateReport) String() string {
+	return fmt.Sprintf("%d reading(s), %d device(s), %d attachment(s), %d note(s) migrated, %d reading(s) skipped\n", r.Readings, r.Devices, r.Attachments, r.Notes, r.Skipped)
+}
+
+// migrateJSONToSQL copies every data/db/<Name+Serial>/<timestamp>.json
+// record, and the devices, attachments and notes of the registry next to
+// it, into the SQL store. Records already present are overwritten with the same
+// content, so the migration can be re-run safely.
+func migrateJSONToSQL(dbdir string, store *sqlStore) (migrateReport, error) {
+	var report migrateReport
+	collections, err := os.ReadDir(dbdir)
+	if err != nil {
+		return report, err
+	}
+	for _, c := range collections {
+		if !c.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(dbdir, c.Name()))
+		if err != nil {
+			return report, err
+		}
+		names := []string{}
+		for _, f := range files {
+			if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+				names = append(names, f.Name())
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			path := filepath.Join(dbdir, c.Name(), name)
+			byteValue, err := os.ReadFile(path)
+			if err != nil {
+				fmt.Printf("Skipping \"%s\": %v\n", path, err)
+				report.Skipped++
+				continue
+			}
+			recFound, _, err := decodeRecord(byteValue)
+			if err != nil {
+				fmt.Printf("Skipping \"%s\": %v\n", path, err)
+				report.Skipped++
+				continue
+			}
+			if recFound.Timestamp == "" {
+				recFound.Timestamp = strings.TrimSuffix(name, ".json")
+			}
+			if err := store.Append(recFound); err != nil {
+				return report, fmt.Errorf("writing \"%s\": %w", path, err)
+			}
+			report.Readings++
+		}
+	}
+	src, err := openScribbleSource(dbdir)
+	if err != nil {
+		return report, err
+	}
+	defer src.Close()
+	devices, err := src.Devices()
+	if err != nil {
+		return report, fmt.Errorf("reading devices: %w", err)
+	}
+	for _, d := range devices {
+		if err := store.PutDevice(d); err != nil {
+			return report, fmt.Errorf("writing device \"%s\": %w", d.Serial, err)
+		}
+		report.Devices++
+	}
+	attachments, err := src.Attachments("")
+	if err != nil {
+		return report, fmt.Errorf("reading attachments: %w", err)
+	}
+	for _, a := range attachments {
+		if err := store.PutAttachment(a); err != nil {
+			return report, fmt.Errorf("writing attachment of \"%s\": %w", a.BatteryID, err)
+		}
+		report.Attachments++
+	}
+	notes, err := src.Notes()
+	if err != nil {
+		return report, fmt.Errorf("reading notes: %w", err)
+	}
+	for _, n := range notes {
+		if err := store.PutNote(n); err != nil {
+			return report, fmt.Errorf("writing note \"%s\": %w", n.ID, err)
+		}
+		report.Notes++
+	}
+	return report, nil
+}
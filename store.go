@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// errNotFound is returned by Store methods for batteries without any readings.
+var errNotFound = errors.New("not found")
+
+// Store is the battery database. Batteries are identified by the key
+// returned from batteryKey.
+type Store interface {
+	// Readings returns every reading of a battery, oldest first.
+	Readings(batteryID string) ([]rrcBatteryData, error)
+	// Append stores a reading. A reading with the same battery and timestamp
+	// is replaced.
+	Append(reading rrcBatteryData) error
+	// Delete removes one reading. Batteries left without readings are
+	// removed as well.
+	Delete(batteryID, timestamp string) error
+	// DeviceFor returns the serial of the device the battery is attached
+	// to, or "" if it is not attached. Batteries without an attachment
+	// history fall back to the device recorded with their latest reading.
+	DeviceFor(batteryID string) (string, error)
+	// Devices lists the registered devices.
+	Devices() ([]deviceRecord, error)
+	// PutDevice registers or updates a device.
+	PutDevice(device deviceRecord) error
+	// Attachments returns the attachment history of a battery, or of every
+	// battery for "", ordered by attach time. Removed ones are included.
+	Attachments(batteryID string) ([]attachment, error)
+	// PutAttachment stores an attachment, replacing the one with the same
+	// battery and attach time.
+	PutAttachment(a attachment) error
+	// Notes returns every note, removed ones included.
+	Notes() ([]note, error)
+	// PutNote stores a note, replacing the one with the same id.
+	PutNote(n note) error
+	// ListBatteries summarizes the batteries matching the filter.
+	ListBatteries(filter batteryFilter) ([]batterySummary, error)
+	// Verify checks every stored reading and reports the unreadable,
+	// inconsistent and outdated ones.
+	Verify() (verifyReport, error)
+	Close() error
+}
+
+// batteryFilter selects batteries in ListBatteries. Empty fields match all.
+type batteryFilter struct {
+	Name            string // exact battery name
+	SerialNumber    string // exact battery serial
+	NamePrefix      string
+	Chemistry       string
+	DevSerialPrefix string
+}
+
+type batterySummary struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	SerialNumber    string `json:"serial"`
+	Manufacturer    string `json:"manufacturer"`
+	Chemistry       string `json:"chemistry"`
+	DevSerialNumber string `json:"devserialnumber"`
+	Readings        int    `json:"readings"`
+	FirstSeen       string `json:"firstseen"`
+	LastSeen        string `json:"lastseen"`
+}
+
+// batteryKey returns the identity a reading is stored under. Records written
+// before identities were assigned fall back to Name+SerialNumber.
+func batteryKey(dataset rrcBatteryData) string {
+	if dataset.BatteryID != "" {
+		return dataset.BatteryID
+	}
+	return dataset.Name + dataset.SerialNumber
+}
+
+// checkName rejects a battery key, note ID or timestamp received from
+// another station that is not one clean path component.
+func checkName(kind, name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("invalid %s \"%s\"", kind, name)
+	}
+	return nil
+}
+
+func hasDevice(devSN string) bool {
+	return devSN != "" && devSN != "(none)"
+}
+
+func (f batteryFilter) match(summary batterySummary) bool {
+	if f.Name != "" && summary.Name != f.Name {
+		return false
+	}
+	if f.SerialNumber != "" && summary.SerialNumber != f.SerialNumber {
+		return false
+	}
+	if !strings.HasPrefix(summary.Name, f.NamePrefix) {
+		return false
+	}
+	if f.Chemistry != "" && !strings.EqualFold(summary.Chemistry, f.Chemistry) {
+		return false
+	}
+	return strings.HasPrefix(summary.DevSerialNumber, f.DevSerialPrefix)
+}
+
+// summarize builds a batterySummary from a battery's readings, oldest first.
+func summarize(id string, readings []rrcBatteryData) batterySummary {
+	summary := batterySummary{ID: id, Readings: len(readings)}
+	for _, r := range readings {
+		summary.Name = r.Name
+		summary.SerialNumber = r.SerialNumber
+		summary.Manufacturer = r.Manufacturer
+		summary.Chemistry = r.Chemistry
+		if hasDevice(r.DevSerialNumber) {
+			summary.DevSerialNumber = r.DevSerialNumber
+		}
+		if summary.FirstSeen == "" || r.Timestamp < summary.FirstSeen {
+			summary.FirstSeen = r.Timestamp
+		}
+		if r.Timestamp > summary.LastSeen {
+			summary.LastSeen = r.Timestamp
+		}
+	}
+	return summary
+}
+
+// deviceFromHistory implements DeviceFor on top of a battery's attachments
+// and readings.
+func deviceFromHistory(batteryID string, attachments []attachment, readings []rrcBatteryData) string {
+	if len(liveAttachments(attachments)) > 0 {
+		if current, ok := currentAttachment(attachments); ok {
+			return current.DeviceSerial
+		}
+		return ""
+	}
+	return summarize(batteryID, readings).DevSerialNumber
+}
+
+func sortReadings(readings []rrcBatteryData) {
+	sort.SliceStable(readings, func(i, j int) bool {
+		return readings[i].Timestamp < readings[j].Timestamp
+	})
+}
+
+// openStore opens the store selected by the configuration. Writes are
+// recorded in the change log for sync.
+func openStore(genConfig generalConfiguration) (Store, error) {
+	store, err := openBaseStore(genConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newTrackedStore(store, openChangeLog(changeLogFile), ""), nil
+}
+
+func openBaseStore(genConfig generalConfiguration) (Store, error) {
+	switch genConfig.DatabaseBackend {
+	case "", backendJSON:
+		return openScribbleStore(dbDir)
+	case backendSQL:
+		return openSQLStore(sqlDBFile)
+	default:
+		return nil, fmt.Errorf("unknown database backend \"%s\"", genConfig.DatabaseBackend)
+	}
+}
+
+// errReadOnly is returned by the writes of a store opened for reading only.
+var errReadOnly = errors.New("store is read-only")
+
+// readOnlyStore refuses every write, so reading another station's database
+// never changes it.
+type readOnlyStore struct {
+	Store
+}
+
+func (readOnlyStore) Append(rrcBatteryData) error    { return errReadOnly }
+func (readOnlyStore) Delete(string, string) error    { return errReadOnly }
+func (readOnlyStore) PutDevice(deviceRecord) error   { return errReadOnly }
+func (readOnlyStore) PutAttachment(attachment) error { return errReadOnly }
+func (readOnlyStore) PutNote(note) error             { return errReadOnly }
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testBackends opens an empty store of every kind. File and SQL stores live
+// in a temporary directory.
+func testBackends(t *testing.T) map[string]func() Store {
+	return map[string]func() Store{
+		"memory": func() Store { return newMemStore() },
+		"json": func() Store {
+			store, err := openScribbleStore(filepath.Join(t.TempDir(), "data", "db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+		"sql": func() Store {
+			store, err := openSQLStore(filepath.Join(t.TempDir(), "data", "rrcreader.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+	}
+}
+
+// forEachBackend runs a test against every kind of store.
+func forEachBackend(t *testing.T, test func(t *testing.T, store Store)) {
+	for name, open := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			store := open()
+			defer store.Close()
+			test(t, store)
+		})
+	}
+}
+
+// useUTC reads old local timestamps in UTC for the test, so they mean the
+// same on every machine.
+func useUTC(t *testing.T) {
+	zone := legacyZone
+	legacyZone = time.UTC
+	t.Cleanup(func() { legacyZone = zone })
+}
+
+// chdirTemp runs the test in an empty directory, for code using the paths
+// under ./data.
+func chdirTemp(t *testing.T) string {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+func testReading(name, serial, timestamp string, cycles int) rrcBatteryData {
+	return rrcBatteryData{
+		Manufacturer:   "RRC",
+		Name:           name,
+		Chemistry:      "LION",
+		SerialNumber:   serial,
+		CycleCount:     cycles,
+		FullCapacity:   6800 - 10*cycles,
+		DesignCapacity: 6900,
+		DesignVoltage:  10800,
+		Timestamp:      timestamp,
+		SchemaVersion:  recordVersion,
+	}
+}
+
+func appendAll(t *testing.T, store Store, readings ...rrcBatteryData) {
+	t.Helper()
+	for _, r := range readings {
+		if err := store.Append(r); err != nil {
+			t.Fatalf("Append(%s %s): %v", batteryKey(r), r.Timestamp, err)
+		}
+	}
+}
+
+func timestampsOf(readings []rrcBatteryData) []string {
+	list := []string{}
+	for _, r := range readings {
+		list = append(list, r.Timestamp)
+	}
+	return list
+}
+
+func TestStoreReadingsOldestFirst(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		appendAll(t, store,
+			testReading("RRC2040-2", "#1", "2021-03-01T10:00:00Z", 30),
+			testReading("RRC2040-2", "#1", "2020-12-24T08:00:00Z", 10),
+			testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20),
+		)
+		readings, err := store.Readings("RRC2040-2#1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"2020-12-24T08:00:00Z", "2021-01-15T12:30:00Z", "2021-03-01T10:00:00Z"}
+		if got := timestampsOf(readings); !reflect.DeepEqual(got, want) {
+			t.Errorf("Readings = %v, want %v", got, want)
+		}
+		if _, err := store.Readings("RRC2040-2#2"); err != errNotFound {
+			t.Errorf("Readings of an unknown battery: err = %v, want errNotFound", err)
+		}
+	})
+}
+
+func TestStoreAppendReplaces(t *testing.T) {
+	useUTC(t)
+	forEachBackend(t, func(t *testing.T, store Store) {
+		appendAll(t, store, testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20))
+		replaced := testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 21)
+		appendAll(t, store, replaced)
+		// The same time in the old local form is the same reading.
+		legacy := testReading("RRC2040-2", "#1", "20210115123000", 22)
+		appendAll(t, store, legacy)
+		readings, err := store.Readings("RRC2040-2#1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(readings) != 1 || readings[0].CycleCount != 22 {
+			t.Errorf("Readings = %+v, want the last of three appends at the same time", readings)
+		}
+	})
+}
+
+func TestStoreDelete(t *testing.T) {
+	useUTC(t)
+	forEachBackend(t, func(t *testing.T, store Store) {
+		appendAll(t, store,
+			testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20),
+			testReading("RRC2040-2", "#1", "2021-03-01T10:00:00Z", 30),
+		)
+		// Either form of the timestamp finds the reading.
+		if err := store.Delete("RRC2040-2#1", "20210115123000"); err != nil {
+			t.Fatalf("Delete by old timestamp: %v", err)
+		}
+		if err := store.Delete("RRC2040-2#1", "2021-01-15T12:30:00Z"); err != errNotFound {
+			t.Errorf("second Delete: err = %v, want errNotFound", err)
+		}
+		batteries, err := store.ListBatteries(batteryFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batteries) != 1 || batteries[0].Readings != 1 || batteries[0].FirstSeen != "2021-03-01T10:00:00Z" {
+			t.Errorf("ListBatteries = %+v, want one battery first seen at its remaining reading", batteries)
+		}
+		if err := store.Delete("RRC2040-2#1", "2021-03-01T10:00:00Z"); err != nil {
+			t.Fatal(err)
+		}
+		if batteries, err = store.ListBatteries(batteryFilter{}); err != nil || len(batteries) != 0 {
+			t.Errorf("ListBatteries after the last Delete = %+v, %v, want none", batteries, err)
+		}
+	})
+}
+
+func TestStoreListBatteries(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		first := testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20)
+		first.DevSerialNumber = "1234.1"
+		other := testReading("RRC2020", "#7", "2021-02-01T09:00:00Z", 5)
+		other.Chemistry = "LiFePO4"
+		appendAll(t, store, first, testReading("RRC2040-2", "#1", "2021-03-01T10:00:00Z", 30), other)
+
+		batteries, err := store.ListBatteries(batteryFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []batterySummary{
+			{ID: "RRC2020#7", Name: "RRC2020", SerialNumber: "#7", Manufacturer: "RRC", Chemistry: "LiFePO4", Readings: 1, FirstSeen: "2021-02-01T09:00:00Z", LastSeen: "2021-02-01T09:00:00Z"},
+			{ID: "RRC2040-2#1", Name: "RRC2040-2", SerialNumber: "#1", Manufacturer: "RRC", Chemistry: "LION", DevSerialNumber: "1234.1", Readings: 2, FirstSeen: "2021-01-15T12:30:00Z", LastSeen: "2021-03-01T10:00:00Z"},
+		}
+		if !reflect.DeepEqual(batteries, want) {
+			t.Errorf("ListBatteries =\n%+v\nwant\n%+v", batteries, want)
+		}
+		for _, filter := range []batteryFilter{{NamePrefix: "RRC2040"}, {Chemistry: "lion"}, {DevSerialPrefix: "1234."}, {Name: "RRC2040-2", SerialNumber: "#1"}} {
+			batteries, err := store.ListBatteries(filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(batteries) != 1 || batteries[0].ID != "RRC2040-2#1" {
+				t.Errorf("ListBatteries(%+v) = %+v, want RRC2040-2#1 only", filter, batteries)
+			}
+		}
+	})
+}
+
+func TestStoreDevicesAndAttachments(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		reading := testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20)
+		reading.DevSerialNumber = "1234.1"
+		appendAll(t, store, reading)
+		// Without an attachment history the device of the latest reading is used.
+		if device, err := store.DeviceFor("RRC2040-2#1"); err != nil || device != "1234.1" {
+			t.Errorf("DeviceFor = %q, %v, want the device of the reading", device, err)
+		}
+
+		devices := []deviceRecord{
+			{Serial: "1234.2", Model: "Ventilator", Owner: "Ward 3", Updated: "2021-02-01T00:00:00Z"},
+			{Serial: "1234.1", Model: "Ventilator", Location: "Store", Updated: "2021-01-01T00:00:00Z"},
+		}
+		for _, d := range devices {
+			if err := store.PutDevice(d); err != nil {
+				t.Fatal(err)
+			}
+		}
+		devices[1].Location = "Ward 1"
+		if err := store.PutDevice(devices[1]); err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.Devices()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var have []deviceRecord
+		for _, d := range got {
+			if d.Serial == "1234.1" || d.Serial == "1234.2" {
+				have = append(have, d)
+			}
+		}
+		if want := []deviceRecord{devices[1], devices[0]}; !reflect.DeepEqual(have, want) {
+			t.Errorf("Devices = %+v, want %+v", have, want)
+		}
+
+		swaps := []attachment{
+			{BatteryID: "RRC2040-2#1", DeviceSerial: "1234.2", Attached: "2021-02-01T08:00:00Z"},
+			{BatteryID: "RRC2040-2#1", DeviceSerial: "1234.1", Attached: "2021-01-01T08:00:00Z", Detached: "2021-02-01T08:00:00Z"},
+			{BatteryID: "RRC2020#7", DeviceSerial: "1234.1", Attached: "2021-02-02T08:00:00Z"},
+		}
+		for _, a := range swaps {
+			if err := store.PutAttachment(a); err != nil {
+				t.Fatal(err)
+			}
+		}
+		history, err := store.Attachments("RRC2040-2#1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []attachment{swaps[1], swaps[0]}; !reflect.DeepEqual(history, want) {
+			t.Errorf("Attachments = %+v, want %+v", history, want)
+		}
+		if all, err := store.Attachments(""); err != nil || len(all) != 3 {
+			t.Errorf("Attachments(\"\") = %d, %v, want all 3", len(all), err)
+		}
+		if device, err := store.DeviceFor("RRC2040-2#1"); err != nil || device != "1234.2" {
+			t.Errorf("DeviceFor = %q, %v, want the current attachment", device, err)
+		}
+		swaps[0].Detached = "2021-03-01T08:00:00Z"
+		if err := store.PutAttachment(swaps[0]); err != nil {
+			t.Fatal(err)
+		}
+		if device, err := store.DeviceFor("RRC2040-2#1"); err != nil || device != "" {
+			t.Errorf("DeviceFor after detaching = %q, %v, want \"\"", device, err)
+		}
+	})
+}
+
+func TestStoreNotes(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		notes := []note{
+			{ID: "b", BatteryID: "RRC2040-2#1", Text: "swollen", Tags: []string{"swollen"}, Created: "2021-02-01T00:00:00Z"},
+			{ID: "a", Device: "1234.1", Text: "dropped", Tags: []string{"dropped"}, Created: "2021-01-01T00:00:00Z"},
+		}
+		for _, n := range notes {
+			if err := store.PutNote(n); err != nil {
+				t.Fatal(err)
+			}
+		}
+		notes[0].Removed = true
+		if err := store.PutNote(notes[0]); err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.Notes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []note{notes[1], notes[0]}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Notes = %+v, want %+v", got, want)
+		}
+	})
+}
+
+func TestStoreVerify(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		appendAll(t, store,
+			testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20),
+			testReading("RRC2020", "#7", "2021-02-01T09:00:00Z", 5),
+		)
+		report, err := store.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Records != 2 || len(report.Problems) != 0 || len(report.Outdated) != 0 {
+			t.Errorf("Verify = %+v, want 2 sound records", report)
+		}
+	})
+}
+
+func TestAttachBatteryUnknown(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		if err := attachBattery(store, "RRC2040-2#1", "1234.1", "2021-01-15T12:30:00Z", false); err != errNotFound {
+			t.Errorf("attachBattery without readings = %v, want %v", err, errNotFound)
+		}
+		if attachments, err := store.Attachments(""); err != nil || len(attachments) != 0 {
+			t.Errorf("Attachments = %+v, %v, want none", attachments, err)
+		}
+	})
+}
+
+func TestAttachBatteryTimes(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		appendAll(t, store, testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20))
+		if err := attachBattery(store, "RRC2040-2#1", "1234.1", "2021-02-01T00:00:00Z", false); err != nil {
+			t.Fatal(err)
+		}
+		// A reassign or detach at or before the current attachment is refused.
+		for _, when := range []string{"2021-01-01T00:00:00Z", "2021-02-01T00:00:00Z"} {
+			if err := attachBattery(store, "RRC2040-2#1", "1234.2", when, true); err == nil {
+				t.Errorf("reassign at %s succeeded, want an error", when)
+			}
+			if err := detachBattery(store, "RRC2040-2#1", when); err == nil {
+				t.Errorf("detach at %s succeeded, want an error", when)
+			}
+		}
+		if err := detachBattery(store, "RRC2040-2#1", "2021-03-01T00:00:00Z"); err != nil {
+			t.Fatal(err)
+		}
+		// So is putting it back before it was taken out.
+		if err := attachBattery(store, "RRC2040-2#1", "1234.2", "2021-02-15T00:00:00Z", false); err == nil {
+			t.Error("attach before the last detach succeeded, want an error")
+		}
+		if err := attachBattery(store, "RRC2040-2#1", "1234.2", "2021-03-01T00:00:00Z", false); err != nil {
+			t.Errorf("attach at the last detach = %v, want nil", err)
+		}
+		attachments, err := store.Attachments("RRC2040-2#1")
+		if err != nil || len(attachments) != 2 || attachments[0].Detached != "2021-03-01T00:00:00Z" {
+			t.Errorf("Attachments = %+v, %v, want 1234.1 until March, then 1234.2", attachments, err)
+		}
+	})
+}
+
+func TestMigrateJSONToSQL(t *testing.T) {
+	dir := t.TempDir()
+	src, err := openScribbleStore(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, src,
+		testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20),
+		testReading("RRC2040-2", "#1", "2021-03-01T10:00:00Z", 30),
+	)
+	if err := attachBattery(src, "RRC2040-2#1", "1234.1", "2021-01-15T12:30:00Z", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.PutNote(note{ID: "n1", BatteryID: "RRC2040-2#1", Text: "dropped", Created: "2021-01-16T00:00:00Z"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "db", "RRC2040-2#1", "20210401T000000Z.json"), []byte(`{"name": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := openSQLStore(filepath.Join(dir, "rrcreader.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	report, err := migrateJSONToSQL(filepath.Join(dir, "db"), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := migrateReport{Readings: 2, Skipped: 1, Devices: 1, Attachments: 1, Notes: 1}
+	if report != want {
+		t.Errorf("report = %+v, want %+v", report, want)
+	}
+	if device, err := dst.DeviceFor("RRC2040-2#1"); err != nil || device != "1234.1" {
+		t.Errorf("DeviceFor = %q, %v, want 1234.1", device, err)
+	}
+	if notes, err := dst.Notes(); err != nil || len(notes) != 1 || notes[0].Text != "dropped" {
+		t.Errorf("Notes = %+v, %v, want the note", notes, err)
+	}
+}
@@ -3,67 +3,139 @@ package main
 const dbDir = "./data/db"
 const htmlDir = "./data/html"
 const miscDir = "./data/misc"
+const assetsDir = "./data/assets"
 const configFile = "./data/GeneralConfiguration.json"
 const batteryProfiles = "./data/BatteryProfiles.json"
+const batteryModelsFile = "./data/BatteryModels.json"
+const sqlDBFile = "./data/rrcreader.db"
+const registryDir = "./data/registry"
+const changeLogFile = "./data/misc/changelog.jsonl"
+const syncStateFile = "./data/misc/syncstate.json"
+
+const backendJSON = "json"
+const backendSQL = "sql"
 
 const fmtDateTime string = "20060102150405"
 const fmtDateTimeISO string = "2006-01-02"
+const fmtUpdated string = "20060102150405.000000"
 const maxRx = 1130
 
 type rrcBatteryData struct {
-	Manufacturer      string  `json:"manufacturer"`      // "RRC"
-	Name              string  `json:"name"`              // "RRC2020"
-	Chemistry         string  `json:"chemistry"`         // "LION"
-	Specification     string  `json:"specification"`     // "ID3.1 Vs0 IPs0"
-	SerialNumber      string  `json:"serial"`            // "#0000"
-	MfgDate           string  `json:"mfgdate"`           // "YEAR / MONTH / DAY"
-	Voltage           int     `json:"voltage"`           // "00000 mV"
-	VoltageMeasured   int     `json:"voltagemeasured"`   // "00000 mV"
-	Current           int     `json:"current"`           // "-00 mA"
-	TemperatureK      float64 `json:"kelvin"`            // "00.0 K"
-	TemperatureC      float64 `json:"celsius"`           // "00.0 C"
-	NTC               int     `json:"ntc"`               // "000 ohm"
-	ChargingVoltage   int     `json:"chargingvoltage"`   // 00000 mV
-	ChargingCurrent   int     `json:"chargingcurrent"`   // 0000 mA
-	RelativeCharge    int     `json:"relativecharge"`    // "00 %"
-	RemainingCapacity int     `json:"remainingcapacity"` // "0000 mAh"
-	FullCapacity      int     `json:"fullcapacity"`      // "0000 mAh"
-	AbsoluteCharge    int     `json:"absolutecharge"`    // "00 %"
-	DesignCapacity    int     `json:"designcapacity"`    // "0000 mAh"
-	DesignVoltage     int     `json:"designvoltage"`     // "00000 mV"
-	StateRegister     string  `json:"stateregister"`     // "00e0 hex"
-	ModeRegister      string  `json:"moderegister"`      // "0001 hex"
-	CycleCount        int     `json:"cyclecount"`        // "#0"
-	MaxError          int     `json:"maxerror"`          // "1 %"
-	TimeAlarm         int     `json:"timealarm"`         // "10 min"
-	TimeToFull        int     `json:"timetofull"`        // "0 min"
-	TimeToEmpty       int     `json:"timetoempty"`       // "00000 min"
-	CapacityAlarm     int     `json:"capacityalarm"`     // "000 mAh"
-	BatteryUsesPEC    string  `json:"batteryusespec"`    // "Yes"
-	OptMfg2f          string  `json:"optmfg2f"`          // "000a hex"
-	OptMfg3c          string  `json:"optmfg3c"`          // "0000 hex"
-	OptMfg3d          string  `json:"optmfg3d"`          // "0fdc hex
-	OptMfg3e          string  `json:"optmfg3e"`          // "0fd1 hex"
-	OptMfg3f          string  `json:"optmfg3f"`          // "0fde hex"
-	DevSerialNumber   string  `json:"devserialnumber"`   // device under test sn
-	Timestamp         string  `json:"timestamp"`         // current time
+	Manufacturer      string       `json:"manufacturer"`      // "RRC"
+	Name              string       `json:"name"`              // "RRC2020"
+	Chemistry         string       `json:"chemistry"`         // "LION"
+	Specification     string       `json:"specification"`     // "ID3.1 Vs0 IPs0"
+	SerialNumber      string       `json:"serial"`            // "#0000"
+	MfgDate           string       `json:"mfgdate"`           // "YEAR / MONTH / DAY"
+	Voltage           int          `json:"voltage"`           // "00000 mV"
+	VoltageMeasured   int          `json:"voltagemeasured"`   // "00000 mV"
+	Current           int          `json:"current"`           // "-00 mA"
+	TemperatureK      float64      `json:"kelvin"`            // "00.0 K"
+	TemperatureC      float64      `json:"celsius"`           // "00.0 C"
+	NTC               int          `json:"ntc"`               // "000 ohm"
+	ChargingVoltage   int          `json:"chargingvoltage"`   // 00000 mV
+	ChargingCurrent   int          `json:"chargingcurrent"`   // 0000 mA
+	RelativeCharge    int          `json:"relativecharge"`    // "00 %"
+	RemainingCapacity int          `json:"remainingcapacity"` // "0000 mAh"
+	FullCapacity      int          `json:"fullcapacity"`      // "0000 mAh"
+	AbsoluteCharge    int          `json:"absolutecharge"`    // "00 %"
+	DesignCapacity    int          `json:"designcapacity"`    // "0000 mAh"
+	DesignVoltage     int          `json:"designvoltage"`     // "00000 mV"
+	StateRegister     string       `json:"stateregister"`     // "00e0 hex"
+	ModeRegister      string       `json:"moderegister"`      // "0001 hex"
+	CycleCount        int          `json:"cyclecount"`        // "#0"
+	MaxError          int          `json:"maxerror"`          // "1 %"
+	TimeAlarm         int          `json:"timealarm"`         // "10 min"
+	TimeToFull        int          `json:"timetofull"`        // "0 min"
+	TimeToEmpty       int          `json:"timetoempty"`       // "00000 min"
+	CapacityAlarm     int          `json:"capacityalarm"`     // "000 mAh"
+	BatteryUsesPEC    string       `json:"batteryusespec"`    // "Yes"
+	OptMfg2f          string       `json:"optmfg2f"`          // "000a hex"
+	OptMfg3c          string       `json:"optmfg3c"`          // "0000 hex"
+	OptMfg3d          string       `json:"optmfg3d"`          // "0fdc hex
+	OptMfg3e          string       `json:"optmfg3e"`          // "0fd1 hex"
+	OptMfg3f          string       `json:"optmfg3f"`          // "0fde hex"
+	DevSerialNumber   string       `json:"devserialnumber"`   // device under test sn
+	Timestamp         string       `json:"timestamp"`         // time of the reading, RFC 3339 in UTC
+	Zone              string       `json:"zone"`              // UTC offset of the station that took the reading, e.g. "+02:00"
+	BatteryID         string       `json:"batteryid"`         // battery identity, Name+SerialNumber for older records
+	SchemaVersion     int          `json:"schemaversion"`     // record layout version, 0 for unversioned records
+	Sample            bool         `json:"sample"`            // monitoring sample that may be downsampled, false for snapshot readouts
+	Aggregated        int          `json:"aggregated"`        // number of samples averaged into this record, 0 for raw readings
+	SoH               float64      `json:"soh"`               // FullCapacity as % of DesignCapacity, 0 if unknown
+	EnergySoH         float64      `json:"energysoh"`         // FullCapacity×Voltage as % of DesignCapacity×DesignVoltage, 0 if unknown
+	Health            healthReport `json:"health"`            // rating against the device profile when the reading was taken
+}
+
+type deviceRecord struct {
+	Serial   string `json:"serial"`   // device serial number
+	Model    string `json:"model"`    // (optional) device model
+	Owner    string `json:"owner"`    // (optional) owner or customer
+	Location string `json:"location"` // (optional) where the device is kept
+	Updated  string `json:"updated"`  // last change, newest wins when syncing
+}
+
+// attachment is one period a battery spent in a device.
+type attachment struct {
+	BatteryID    string `json:"battery"`  // battery key
+	DeviceSerial string `json:"device"`   // device serial number
+	Attached     string `json:"attached"` // time the battery was put in
+	Detached     string `json:"detached"` // time the battery was taken out, "" while attached
+	Removed      bool   `json:"removed"`  // removed attachments are kept so the removal syncs
+	Updated      string `json:"updated"`  // last change, newest wins when syncing
+}
+
+// note is an operator note on a reading, a battery or a device.
+type note struct {
+	ID        string   `json:"id"`        // unique note id
+	BatteryID string   `json:"battery"`   // battery key, "" for device notes
+	Timestamp string   `json:"timestamp"` // reading timestamp for notes on a reading, "" otherwise
+	Device    string   `json:"device"`    // device serial for device notes, "" otherwise
+	Text      string   `json:"text"`      // free text
+	Tags      []string `json:"tags"`      // e.g. "dropped", "swollen"
+	Author    string   `json:"author"`    // who wrote the note
+	Created   string   `json:"created"`   // when the note was written
+	Removed   bool     `json:"removed"`   // removed notes are kept so the removal syncs
+	Updated   string   `json:"updated"`   // last change, newest wins when syncing
 }
 
 type generalConfiguration struct {
-	SerialPort     string `json:"serialport"`     // Serial port
-	RemoteHost     string `json:"remotehost"`     // Remote host for syncing database
-	RemotePort     string `json:"remoteport"`     // Port for syncing database
-	RemoteUser     string `json:"remoteuser"`     // Username for remote access
-	RemotePassword string `json:"remotepassword"` // Password for remote access
+	SerialPort      string          `json:"serialport"`      // Serial port
+	RemoteHost      string          `json:"remotehost"`      // Remote host for syncing database
+	RemotePort      string          `json:"remoteport"`      // Port for syncing database
+	RemoteUser      string          `json:"remoteuser"`      // Username for remote access
+	RemotePassword  string          `json:"remotepassword"`  // Password for remote access
+	DatabaseBackend string          `json:"databasebackend"` // (optional) "json" (default) or "sql"
+	StationName     string          `json:"stationname"`     // (optional) name of this station for sync, defaults to hostname
+	Operator        string          `json:"operator"`        // (optional) author of notes, defaults to the login name
+	IdentityFields  []string        `json:"identityfields"`  // (optional) fields added to Name+SerialNumber to identify a battery
+	Retention       []retentionTier `json:"retention"`       // (optional) downsampling tiers for monitoring samples
+	CompactInterval string          `json:"compactinterval"` // (optional) how often serve compacts samples, default "24h", "0" to disable
+	DuplicateWindow string          `json:"duplicatewindow"` // (optional) readouts this close without a cycle change are duplicates, default "6h", "0" to disable
+	AssetsDir       string          `json:"assetsdir"`       // (optional) directory of the profile images, default "./data/assets"
+	FadeModel       string          `json:"fademodel"`       // (optional) capacity fade model for forecasts, default "linear"
+	LegacyZone      string          `json:"legacyzone"`      // (optional) time zone of timestamps written before version 2, e.g. "Europe/Helsinki", default this host's
 }
 
 type batteryProfile struct {
-	AssociatedDeviceName string  `json:"associateddevicename"` // Associated device name
-	AssociateDevSnPrefix string  `json:"assosiatedevsnprefix"` // Associate devices with serial expected with prefix (1234.******)
-	MaxCycles            int     `json:"maxcycles"`            // MAX cycles as defined by device manufacturer
-	MinCapacityFactor    float64 `json:"mincapacityfactor"`    // MIN capacity as defined by device manufacturer
-	WarnCycles           int     `json:"warncycles"`           // (optional) number of cycles to trigger yellow health status
-	WarnCapacityFactor   float64 `json:"warncapacityfactor"`   // (optional) capacity level to trigger yellow heatlh status
-	ImageFileDevice      string  `json:"imagefiledevice"`      // (optional) image file for the associated device
-	ImageFileBattery     string  `json:"imagefilebattery"`     // (optional) image file for the battery
+	AssociatedDeviceName string   `json:"associateddevicename"` // Associated device name
+	AssociateDevSnPrefix string   `json:"assosiatedevsnprefix"` // Associate devices with serial expected with prefix (1234.******)
+	DevSnPattern         string   `json:"devsnpattern"`         // (optional) glob on the device serial, e.g. "1234.5*"
+	DevSnRegex           string   `json:"devsnregex"`           // (optional) regular expression on the device serial
+	BatteryName          string   `json:"batteryname"`          // (optional) glob on the battery name, e.g. "RRC2040*"
+	Manufacturer         string   `json:"manufacturer"`         // (optional) glob on the battery manufacturer
+	Priority             int      `json:"priority"`             // (optional) the matching profile with the highest priority is used
+	MaxCycles            int      `json:"maxcycles"`            // MAX cycles as defined by device manufacturer
+	MinCapacityFactor    float64  `json:"mincapacityfactor"`    // MIN capacity as defined by device manufacturer
+	WarnCycles           int      `json:"warncycles"`           // (optional) number of cycles to trigger yellow health status
+	WarnCapacityFactor   float64  `json:"warncapacityfactor"`   // (optional) capacity level to trigger yellow heatlh status
+	MinTemperature       *float64 `json:"mintemperature"`       // (optional) lowest allowed pack temperature in °C, null if not limited
+	MaxTemperature       *float64 `json:"maxtemperature"`       // (optional) highest allowed pack temperature in °C, null if not limited
+	MinVoltage           int      `json:"minvoltage"`           // (optional) lowest allowed pack voltage in mV
+	MaxCellSpread        int      `json:"maxcellspread"`        // (optional) largest allowed difference between cell voltages in mV
+	MaxAgeMonths         int      `json:"maxagemonths"`         // (optional) calendar age in months since the manufacture date
+	ImageFileDevice      string   `json:"imagefiledevice"`      // (optional) image file for the associated device
+	ImageFileBattery     string   `json:"imagefilebattery"`     // (optional) image file for the battery
+	Removed              bool     `json:"removed,omitempty"`    // removed profiles are kept so the removal syncs
+	Updated              string   `json:"updated,omitempty"`    // last change, newest wins when syncing
 }
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const syncBatchSize = 500
+
+// syncBatch is the payload exchanged with the sync server, both for pushes
+// and for pulls.
+type syncBatch struct {
+	Station     string           `json:"station"`     // sending station
+	Next        int64            `json:"next"`        // pull: server cursor to ask from next time
+	More        bool             `json:"more"`        // pull: more changes are waiting
+	Readings    []rrcBatteryData `json:"readings"`    // new or changed readings
+	Deleted     []readingRef     `json:"deleted"`     // removed readings
+	Devices     []deviceRecord   `json:"devices"`     // new or changed devices
+	Attachments []attachment     `json:"attachments"` // new or changed attachments
+	Notes       []note           `json:"notes"`       // new or changed notes
+	Profiles    []batteryProfile `json:"profiles"`    // full profile list of the sender
+}
+
+type readingRef struct {
+	BatteryID string `json:"battery"`
+	Timestamp string `json:"timestamp"`
+}
+
+type syncPushResult struct {
+	Accepted   int `json:"accepted"`   // readings stored
+	Updated    int `json:"updated"`    // readings that replaced a different one under the same timestamp
+	Duplicates int `json:"duplicates"` // readings the server already had
+	Deleted    int `json:"deleted"`    // readings removed on the server
+	Registry   int `json:"registry"`   // devices, attachments and notes updated on the server
+	Profiles   int `json:"profiles"`   // profiles added, changed or removed on the server
+}
+
+// syncState remembers how far both directions got, in data/misc/syncstate.json.
+type syncState struct {
+	PushedSeq int64  `json:"pushedseq"` // last local change log entry pushed
+	PulledSeq int64  `json:"pulledseq"` // server cursor of the last pull
+	FullPush  bool   `json:"fullpush"`  // every stored reading has been pushed once
+	LastSync  string `json:"lastsync"`  // time of the last completed sync
+}
+
+type syncReport struct {
+	PushedReadings    int
+	UpdatedReadings   int
+	DuplicateReadings int
+	PushedDeletes     int
+	PushedRegistry    int
+	PushedProfiles    int
+	PulledReadings    int
+	PulledDeletes     int
+	PulledRegistry    int
+	PulledProfiles    int
+	ProfileConflicts  []string
+}
+
+func (r syncReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Pushed: %d reading(s), %d updated (%d already on server), %d deletion(s), %d device/attachment/note update(s), %d profile(s)\n", r.PushedReadings, r.UpdatedReadings, r.DuplicateReadings, r.PushedDeletes, r.PushedRegistry, r.PushedProfiles)
+	fmt.Fprintf(&b, "Pulled: %d reading(s), %d deletion(s), %d device/attachment/note update(s), %d profile(s)\n", r.PulledReadings, r.PulledDeletes, r.PulledRegistry, r.PulledProfiles)
+	for _, c := range r.ProfileConflicts {
+		fmt.Fprintf(&b, "Profile conflict (local kept): %s\n", c)
+	}
+	return b.String()
+}
+
+type syncClient struct {
+	baseURL  string
+	user     string
+	password string
+	station  string
+	retries  int
+	client   *http.Client
+}
+
+func stationName(genConfig generalConfiguration) string {
+	if genConfig.StationName != "" {
+		return genConfig.StationName
+	}
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return "station"
+}
+
+// remoteURL builds the server address from RemoteHost and RemotePort.
+// RemoteHost may carry a scheme, https is used otherwise.
+func remoteURL(genConfig generalConfiguration) (string, error) {
+	host := genConfig.RemoteHost
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return "", err
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("no remote host configured")
+	}
+	if u.Port() == "" && genConfig.RemotePort != "" {
+		u.Host = net.JoinHostPort(u.Hostname(), genConfig.RemotePort)
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+func newSyncClient(genConfig generalConfiguration, retries int) (*syncClient, error) {
+	base, err := remoteURL(genConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &syncClient{
+		baseURL:  base,
+		user:     genConfig.RemoteUser,
+		password: genConfig.RemotePassword,
+		station:  stationName(genConfig),
+		retries:  retries,
+		client:   &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+// do sends a request, retrying with a growing delay while the server is
+// unreachable or answers with a server error.
+func (c *syncClient) do(method, path string, body interface{}, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	var lastErr error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			delay := time.Second << uint(attempt-1)
+			fmt.Printf("Sync: %v, retrying in %v ...\n", lastErr, delay)
+			time.Sleep(delay)
+		}
+		req, err := http.NewRequest(method, c.baseURL+path, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(c.user, c.password)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := c.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<20))
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			lastErr = fmt.Errorf("server error: %s", resp.Status)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(respBody)))
+		}
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(respBody, out)
+	}
+	return fmt.Errorf("%s unreachable: %w", c.baseURL, lastErr)
+}
+
+func (c *syncClient) push(batch syncBatch) (syncPushResult, error) {
+	var result syncPushResult
+	batch.Station = c.station
+	err := c.do(http.MethodPost, "/api/v1/push", batch, &result)
+	return result, err
+}
+
+func (c *syncClient) pull(since int64) (syncBatch, error) {
+	var batch syncBatch
+	path := "/api/v1/changes?since=" + strconv.FormatInt(since, 10) + "&station=" + url.QueryEscape(c.station)
+	err := c.do(http.MethodGet, path, nil, &batch)
+	return batch, err
+}
+
+func loadSyncState() (syncState, error) {
+	var state syncState
+	byteValue, err := ioutil.ReadFile(syncStateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, err
+	}
+	err = json.Unmarshal(byteValue, &state)
+	return state, err
+}
+
+func saveSyncState(state syncState) error {
+	byteWriter, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(syncStateFile), os.ModePerm); err != nil {
+		return err
+	}
+	return atomicWriteFile(syncStateFile, byteWriter, 0644)
+}
+
+func profileKey(profile batteryProfile) string {
+	return profile.AssociatedDeviceName + " (" + profile.AssociateDevSnPrefix + ")"
+}
+
+// sameReading reports whether two readings store the same values.
+func sameReading(a, b rrcBatteryData) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+// sameProfile reports whether two profiles differ in nothing but the time
+// of their last change.
+func sameProfile(a, b batteryProfile) bool {
+	a.Updated, b.Updated = "", ""
+	return reflect.DeepEqual(a, b)
+}
+
+// mergeProfiles merges the incoming profiles, removed ones included, into
+// local and returns how many were added, changed or removed. Of two
+// versions of a profile with the same device name and prefix the newest
+// wins; versions changed at the same time, or before profiles carried an
+// update time, are reported as conflicts and the local version is kept.
+// Edit either version to resolve the conflict on the next sync.
+func mergeProfiles(local, incoming []batteryProfile) ([]batteryProfile, int, []string) {
+	merged := append([]batteryProfile{}, local...)
+	known := make(map[string]int)
+	for i, p := range merged {
+		known[profileKey(p)] = i
+	}
+	changed := 0
+	conflicts := []string{}
+	for _, p := range incoming {
+		i, ok := known[profileKey(p)]
+		switch {
+		case !ok:
+			known[profileKey(p)] = len(merged)
+			merged = append(merged, p)
+			changed++
+		case sameProfile(merged[i], p) || p.Updated < merged[i].Updated:
+			// The local version is the same or newer.
+		case p.Updated > merged[i].Updated:
+			merged[i] = p
+			changed++
+		default:
+			conflicts = append(conflicts, profileKey(p))
+		}
+	}
+	return merged, changed, conflicts
+}
+
+// pendingChanges collects the local readings, deletions, devices,
+// attachments and notes changed since the last push. Until the first full push
+// everything in the store is pending.
+func pendingChanges(store Store, log *changeLog, state syncState) (syncBatch, int64, error) {
+	pending := syncBatch{Readings: []rrcBatteryData{}, Deleted: []readingRef{}}
+	lastSeq, err := log.LastSeq()
+	if err != nil {
+		return pending, 0, err
+	}
+	devices, err := store.Devices()
+	if err != nil {
+		return pending, 0, err
+	}
+	attachments, err := store.Attachments("")
+	if err != nil {
+		return pending, 0, err
+	}
+	notes, err := store.Notes()
+	if err != nil {
+		return pending, 0, err
+	}
+	if !state.FullPush {
+		batteries, err := store.ListBatteries(batteryFilter{})
+		if err != nil {
+			return pending, 0, err
+		}
+		for _, b := range batteries {
+			readings, err := store.Readings(b.ID)
+			if err != nil {
+				return pending, 0, err
+			}
+			pending.Readings = append(pending.Readings, readings...)
+		}
+		pending.Devices = devices
+		pending.Attachments = attachments
+		pending.Notes = notes
+		return pending, lastSeq, nil
+	}
+	entries, err := log.Entries(state.PushedSeq)
+	if err != nil {
+		return pending, 0, err
+	}
+	// Only the last change of each reading matters.
+	latest := make(map[readingRef]string)
+	changedDevices := make(map[string]bool)
+	changedAttachments := make(map[readingRef]bool)
+	changedNotes := make(map[string]bool)
+	for _, e := range entries {
+		if e.Origin != "" {
+			continue
+		}
+		switch e.Kind {
+		case "reading", "delete":
+			latest[readingRef{BatteryID: e.BatteryID, Timestamp: e.Timestamp}] = e.Kind
+		case "device":
+			changedDevices[e.Device] = true
+		case "attachment":
+			changedAttachments[readingRef{BatteryID: e.BatteryID, Timestamp: e.Timestamp}] = true
+		case "note":
+			changedNotes[e.Note] = true
+		}
+	}
+	wanted := make(map[string]map[string]bool)
+	for ref, kind := range latest {
+		switch kind {
+		case "reading":
+			if wanted[ref.BatteryID] == nil {
+				wanted[ref.BatteryID] = make(map[string]bool)
+			}
+			wanted[ref.BatteryID][ref.Timestamp] = true
+		case "delete":
+			pending.Deleted = append(pending.Deleted, ref)
+		}
+	}
+	for batteryID, timestamps := range wanted {
+		readings, err := store.Readings(batteryID)
+		if err != nil && err != errNotFound {
+			return pending, 0, err
+		}
+		for _, r := range readings {
+			if timestamps[r.Timestamp] {
+				pending.Readings = append(pending.Readings, r)
+			}
+		}
+	}
+	for _, d := range devices {
+		if changedDevices[d.Serial] {
+			pending.Devices = append(pending.Devices, d)
+		}
+	}
+	for _, a := range attachments {
+		if changedAttachments[readingRef{BatteryID: a.BatteryID, Timestamp: a.Attached}] {
+			pending.Attachments = append(pending.Attachments, a)
+		}
+	}
+	for _, n := range notes {
+		if changedNotes[n.ID] {
+			pending.Notes = append(pending.Notes, n)
+		}
+	}
+	return pending, lastSeq, nil
+}
+
+// checkReading rejects a received reading whose battery key or timestamp
+// cannot be stored as a file name.
+func checkReading(reading rrcBatteryData) error {
+	if err := checkName("battery key", batteryKey(reading)); err != nil {
+		return err
+	}
+	return checkName("timestamp", reading.Timestamp)
+}
+
+// applyDeletes removes the given readings, ignoring the ones already gone.
+func applyDeletes(store Store, deleted []readingRef) (int, error) {
+	count := 0
+	for _, ref := range deleted {
+		if err := checkName("battery key", ref.BatteryID); err != nil {
+			return count, err
+		}
+		if err := checkName("timestamp", ref.Timestamp); err != nil {
+			return count, err
+		}
+		err := store.Delete(ref.BatteryID, ref.Timestamp)
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// applyRegistry stores the incoming devices and attachments that are newer
+// than the local ones and returns how many were taken over.
+func applyRegistry(store Store, devices []deviceRecord, attachments []attachment) (int, error) {
+	applied := 0
+	if len(devices) > 0 {
+		local, err := store.Devices()
+		if err != nil {
+			return applied, err
+		}
+		known := make(map[string]deviceRecord)
+		for _, d := range local {
+			known[d.Serial] = d
+		}
+		for _, d := range devices {
+			if have, ok := known[d.Serial]; ok && have.Updated >= d.Updated {
+				continue
+			}
+			if err := store.PutDevice(d); err != nil {
+				return applied, err
+			}
+			applied++
+		}
+	}
+	histories := make(map[string][]attachment)
+	for _, a := range attachments {
+		a = normalizeAttachment(a)
+		if err := checkName("battery key", a.BatteryID); err != nil {
+			return applied, err
+		}
+		history, ok := histories[a.BatteryID]
+		if !ok {
+			var err error
+			if history, err = store.Attachments(a.BatteryID); err != nil {
+				return applied, err
+			}
+			histories[a.BatteryID] = history
+		}
+		newer := true
+		for _, have := range history {
+			if have.Attached == a.Attached && have.Updated >= a.Updated {
+				newer = false
+			}
+		}
+		if !newer {
+			continue
+		}
+		if err := store.PutAttachment(a); err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// runSync pushes local changes to the remote server and pulls the changes
+// made by other stations. Progress is saved after every step, so an
+// interrupted sync continues where it stopped.
+func runSync(genConfig generalConfiguration, retries int) (syncReport, error) {
+	var report syncReport
+	client, err := newSyncClient(genConfig, retries)
+	if err != nil {
+		return report, err
+	}
+	base, err := openBaseStore(genConfig)
+	if err != nil {
+		return report, err
+	}
+	defer base.Close()
+	log := openChangeLog(changeLogFile)
+	state, err := loadSyncState()
+	if err != nil {
+		return report, fmt.Errorf("reading \"%s\": %w", syncStateFile, err)
+	}
+
+	pending, lastSeq, err := pendingChanges(base, log, state)
+	if err != nil {
+		return report, err
+	}
+	profiles, err := loadProfileRecords()
+	if err != nil && !os.IsNotExist(err) {
+		return report, fmt.Errorf("reading \"%s\": %w", batteryProfiles, err)
+	}
+	for start := 0; start == 0 || start < len(pending.Readings); start += syncBatchSize {
+		batch := syncBatch{}
+		if start == 0 {
+			batch.Profiles = profiles
+			batch.Deleted = pending.Deleted
+			batch.Devices = pending.Devices
+			batch.Attachments = pending.Attachments
+			batch.Notes = pending.Notes
+		}
+		end := start + syncBatchSize
+		if end > len(pending.Readings) {
+			end = len(pending.Readings)
+		}
+		batch.Readings = pending.Readings[start:end]
+		result, err := client.push(batch)
+		if err != nil {
+			return report, err
+		}
+		report.PushedReadings += result.Accepted
+		report.UpdatedReadings += result.Updated
+		report.DuplicateReadings += result.Duplicates
+		report.PushedDeletes += result.Deleted
+		report.PushedRegistry += result.Registry
+		report.PushedProfiles += result.Profiles
+	}
+	state.PushedSeq = lastSeq
+	state.FullPush = true
+	if err := saveSyncState(state); err != nil {
+		return report, err
+	}
+
+	pulled := newTrackedStore(base, log, client.baseURL)
+	for {
+		batch, err := client.pull(state.PulledSeq)
+		if err != nil {
+			return report, err
+		}
+		for _, r := range batch.Readings {
+			r, err := upgradeReading(r)
+			if err != nil {
+				return report, err
+			}
+			if err := checkReading(r); err != nil {
+				return report, err
+			}
+			if err := pulled.Append(r); err != nil {
+				return report, err
+			}
+			report.PulledReadings++
+		}
+		removed, err := applyDeletes(pulled, batch.Deleted)
+		report.PulledDeletes += removed
+		if err != nil {
+			return report, err
+		}
+		applied, err := applyRegistry(pulled, batch.Devices, batch.Attachments)
+		report.PulledRegistry += applied
+		if err != nil {
+			return report, err
+		}
+		applied, err = applyNotes(pulled, batch.Notes)
+		report.PulledRegistry += applied
+		if err != nil {
+			return report, err
+		}
+		if len(batch.Profiles) > 0 {
+			merged, changed, conflicts := mergeProfiles(profiles, batch.Profiles)
+			if changed > 0 {
+				if err := saveProfileRecords(merged); err != nil {
+					return report, err
+				}
+			}
+			profiles = merged
+			report.PulledProfiles += changed
+			report.ProfileConflicts = append(report.ProfileConflicts, conflicts...)
+		}
+		state.PulledSeq = batch.Next
+		if err := saveSyncState(state); err != nil {
+			return report, err
+		}
+		if !batch.More {
+			break
+		}
+	}
+	state.LastSync = formatTimestamp(time.Now())
+	return report, saveSyncState(state)
+}
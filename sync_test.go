@@ -0,0 +1,224 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testSyncServer runs a collection server on a memory store.
+func testSyncServer(t *testing.T) (*syncServer, generalConfiguration) {
+	cfg := generalConfiguration{RemoteUser: "station", RemotePassword: "secret"}
+	server := newSyncServer(newMemStore(), openChangeLog(filepath.Join(t.TempDir(), "changelog.jsonl")), cfg)
+	httpServer := httptest.NewServer(server.routes())
+	t.Cleanup(httpServer.Close)
+	cfg.RemoteHost = httpServer.URL
+	return server, cfg
+}
+
+// openStation moves the test into a new station directory and opens its
+// store the way the commands do.
+func openStation(t *testing.T, cfg generalConfiguration, name string) (Store, generalConfiguration, string) {
+	dir := chdirTemp(t)
+	cfg.StationName = name
+	store, err := openStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, cfg, dir
+}
+
+func mustSync(t *testing.T, cfg generalConfiguration) syncReport {
+	t.Helper()
+	report, err := runSync(cfg, 0)
+	if err != nil {
+		t.Fatalf("sync %s: %v", cfg.StationName, err)
+	}
+	return report
+}
+
+func TestSyncBetweenStations(t *testing.T) {
+	server, cfg := testSyncServer(t)
+
+	storeA, cfgA, dirA := openStation(t, cfg, "A")
+	appendAll(t, storeA,
+		testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20),
+		testReading("RRC2040-2", "#1", "2021-03-01T10:00:00Z", 30),
+	)
+	if err := storeA.PutDevice(deviceRecord{Serial: "1234.1", Model: "Ventilator", Updated: "2021-01-01T00:00:00Z"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeA.PutAttachment(attachment{BatteryID: "RRC2040-2#1", DeviceSerial: "1234.1", Attached: "2021-01-01T08:00:00Z", Updated: "2021-01-01T08:00:00Z"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeA.PutNote(note{ID: "n1", BatteryID: "RRC2040-2#1", Text: "dropped", Created: "2021-01-02T00:00:00Z", Updated: "2021-01-02T00:00:00Z"}); err != nil {
+		t.Fatal(err)
+	}
+	report := mustSync(t, cfgA)
+	if report.PushedReadings != 2 || report.PushedRegistry != 3 {
+		t.Errorf("first sync of A: %+v, want 2 readings and 3 registry updates pushed", report)
+	}
+	if readings, err := server.store.Readings("RRC2040-2#1"); err != nil || len(readings) != 2 {
+		t.Fatalf("server readings = %d, %v, want 2", len(readings), err)
+	}
+	if report := mustSync(t, cfgA); report.PushedReadings != 0 || report.PulledReadings != 0 {
+		t.Errorf("sync of A without changes: %+v, want nothing exchanged", report)
+	}
+
+	storeB, cfgB, _ := openStation(t, cfg, "B")
+	report = mustSync(t, cfgB)
+	if report.PulledReadings != 2 || report.PulledRegistry != 3 {
+		t.Errorf("first sync of B: %+v, want 2 readings and 3 registry updates pulled", report)
+	}
+	if device, err := storeB.DeviceFor("RRC2040-2#1"); err != nil || device != "1234.1" {
+		t.Errorf("B: DeviceFor = %q, %v, want 1234.1", device, err)
+	}
+	if notes, err := storeB.Notes(); err != nil || len(notes) != 1 || notes[0].Text != "dropped" {
+		t.Errorf("B: Notes = %+v, %v, want the note from A", notes, err)
+	}
+
+	// A deletion on B reaches A through the server.
+	if err := storeB.Delete("RRC2040-2#1", "2021-01-15T12:30:00Z"); err != nil {
+		t.Fatal(err)
+	}
+	if report := mustSync(t, cfgB); report.PushedDeletes != 1 {
+		t.Errorf("sync of B after a delete: %+v, want 1 deletion pushed", report)
+	}
+	if err := os.Chdir(dirA); err != nil {
+		t.Fatal(err)
+	}
+	if report := mustSync(t, cfgA); report.PulledDeletes != 1 {
+		t.Errorf("sync of A after the delete on B: %+v, want 1 deletion pulled", report)
+	}
+	if readings, err := storeA.Readings("RRC2040-2#1"); err != nil || len(readings) != 1 {
+		t.Errorf("A: %d readings, %v, want 1 left", len(readings), err)
+	}
+}
+
+// The aggregate compaction leaves under the newest sample's timestamp
+// replaces the sample the server already has.
+func TestSyncCompactedSamples(t *testing.T) {
+	server, cfg := testSyncServer(t)
+	storeA, cfgA, _ := openStation(t, cfg, "A")
+	sample := func(ts string, charge int) rrcBatteryData {
+		r := testReading("RRC2040-2", "#1", ts, 20)
+		r.Sample = true
+		r.RelativeCharge = charge
+		return r
+	}
+	appendAll(t, storeA, sample("2021-01-15T12:30:10Z", 40), sample("2021-01-15T12:30:40Z", 60))
+	mustSync(t, cfgA)
+	policy := []parsedTier{{after: 24 * time.Hour, resolution: time.Minute}}
+	if _, err := compactStore(storeA, policy, time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC), false); err != nil {
+		t.Fatal(err)
+	}
+	report := mustSync(t, cfgA)
+	if report.UpdatedReadings != 1 || report.PushedDeletes != 1 {
+		t.Errorf("sync after compact: %+v, want 1 reading updated and 1 deletion", report)
+	}
+	readings, err := server.store.Readings("RRC2040-2#1")
+	if err != nil || len(readings) != 1 {
+		t.Fatalf("server readings = %d, %v, want 1", len(readings), err)
+	}
+	if readings[0].Aggregated != 2 || readings[0].RelativeCharge != 50 {
+		t.Errorf("server holds %d samples at %d%%, want the aggregate of 2 at 50%%", readings[0].Aggregated, readings[0].RelativeCharge)
+	}
+}
+
+func TestSyncRejectsPathNames(t *testing.T) {
+	server, _ := testSyncServer(t)
+	escape := testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20)
+	escape.BatteryID = "../../escape"
+	for _, batch := range []syncBatch{
+		{Station: "A", Readings: []rrcBatteryData{escape}},
+		{Station: "A", Readings: []rrcBatteryData{testReading("RRC2040-2", "#1", "../x", 20)}},
+		{Station: "A", Deleted: []readingRef{{BatteryID: "..", Timestamp: "2021-01-15T12:30:00Z"}}},
+		{Station: "A", Attachments: []attachment{{BatteryID: "a/b", DeviceSerial: "1234.1", Attached: "2021-01-01T08:00:00Z"}}},
+		{Station: "A", Notes: []note{{ID: "../n1", BatteryID: "RRC2040-2#1", Text: "x"}}},
+	} {
+		if _, err := server.accept(batch); err == nil {
+			t.Errorf("accept(%+v) succeeded, want an invalid name error", batch)
+		}
+	}
+}
+
+func TestScribbleStoreKeepsNamesInside(t *testing.T) {
+	chdirTemp(t)
+	store, err := openScribbleStore(dbDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reading := testReading("RRC2040-2", "#1", "2021-01-15T12:30:00Z", 20)
+	reading.BatteryID = "../escape"
+	appendAll(t, store, reading)
+	if err := store.PutNote(note{ID: "../n1", BatteryID: "RRC2040-2#1", Text: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, outside := range []string{filepath.Join(filepath.Dir(dbDir), "escape"), filepath.Join(registryDir, "n1.json")} {
+		if _, err := os.Stat(outside); err == nil {
+			t.Errorf("\"%s\" written outside the store", outside)
+		}
+	}
+	if readings, err := store.Readings("../escape"); err != nil || len(readings) != 1 {
+		t.Errorf("Readings = %d, %v, want the reading back", len(readings), err)
+	}
+}
+
+func TestMergeProfiles(t *testing.T) {
+	local := []batteryProfile{
+		{AssociatedDeviceName: "Ventilator", AssociateDevSnPrefix: "1234.", MaxCycles: 200, Updated: "20210101000000.000000"},
+		{AssociatedDeviceName: "Monitor", AssociateDevSnPrefix: "5678.", MaxCycles: 300, Updated: "20210101000000.000000"},
+		{AssociatedDeviceName: "Pump", AssociateDevSnPrefix: "9.", MaxCycles: 100},
+	}
+	incoming := []batteryProfile{
+		{AssociatedDeviceName: "Ventilator", AssociateDevSnPrefix: "1234.", MaxCycles: 250, Updated: "20210201000000.000000"},
+		{AssociatedDeviceName: "Monitor", AssociateDevSnPrefix: "5678.", Removed: true, Updated: "20201201000000.000000"},
+		{AssociatedDeviceName: "Pump", AssociateDevSnPrefix: "9.", MaxCycles: 150},
+		{AssociatedDeviceName: "Charger", AssociateDevSnPrefix: "42.", Removed: true, Updated: "20210201000000.000000"},
+	}
+	merged, changed, conflicts := mergeProfiles(local, incoming)
+	if changed != 2 {
+		t.Errorf("changed = %d, want 2", changed)
+	}
+	if len(conflicts) != 1 || conflicts[0] != "Pump (9.)" {
+		t.Errorf("conflicts = %v, want the unversioned Pump profile", conflicts)
+	}
+	if merged[0].MaxCycles != 250 {
+		t.Errorf("Ventilator MaxCycles = %d, want the newer 250", merged[0].MaxCycles)
+	}
+	if merged[1].Removed {
+		t.Error("Monitor removed by an older version")
+	}
+	if len(merged) != 4 || !merged[3].Removed {
+		t.Errorf("merged = %+v, want the removed Charger added", merged)
+	}
+}
+
+func TestSaveBatteryProfilesKeepsRemovals(t *testing.T) {
+	chdirTemp(t)
+	if err := os.MkdirAll(filepath.Dir(batteryProfiles), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	ventilator := batteryProfile{AssociatedDeviceName: "Ventilator", AssociateDevSnPrefix: "1234.", MaxCycles: 200}
+	monitor := batteryProfile{AssociatedDeviceName: "Monitor", AssociateDevSnPrefix: "5678.", MaxCycles: 300}
+	if err := saveBatteryProfiles([]batteryProfile{ventilator, monitor}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveBatteryProfiles([]batteryProfile{ventilator}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := loadProfileRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Updated == "" || !records[1].Removed || records[1].Updated == "" {
+		t.Errorf("records = %+v, want Ventilator and a removed Monitor, both with an update time", records)
+	}
+	profiles, err := loadBatteryProfiles()
+	if err != nil || len(profiles) != 1 || profiles[0].AssociatedDeviceName != "Ventilator" {
+		t.Errorf("loadBatteryProfiles = %+v, %v, want only Ventilator", profiles, err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	// Zone names for legacyzone also resolve on hosts without a zone
+	// database, such as Windows.
+	_ "time/tzdata"
+)
+
+// Readings are timestamped in RFC 3339 in UTC, e.g. "2021-12-04T22:23:38Z",
+// with the offset of the station that took them in Zone. Records written
+// before schema version 2 used fmtDateTime in the station's local time.
+
+const fmtTimestampKey = "20060102T150405Z"
+
+// legacyZone is the time zone of the station that wrote timestamps before
+// schema version 2. It is "legacyzone" from the configuration, or the zone
+// of this host when unset, which is only right if the data never moved.
+var legacyZone = time.Local
+
+// setLegacyZone sets legacyZone from a zone name such as "Europe/Helsinki".
+// "" selects the zone of this host.
+func setLegacyZone(name string) error {
+	zone, err := loadLegacyZone(name)
+	if err != nil {
+		return err
+	}
+	legacyZone = zone
+	return nil
+}
+
+// loadLegacyZone resolves a legacyzone name, "" being the zone of this host.
+func loadLegacyZone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	zone, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid legacy zone: %w", err)
+	}
+	return zone, nil
+}
+
+// inLegacyZone runs read with legacyZone set to zone, for data written by
+// another station.
+func inLegacyZone(zone *time.Location, read func()) {
+	saved := legacyZone
+	legacyZone = zone
+	defer func() { legacyZone = saved }()
+	read()
+}
+
+// formatTimestamp formats a time the way timestamps are stored.
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// zoneOf returns the UTC offset of t, e.g. "+02:00".
+func zoneOf(t time.Time) string {
+	return t.Format("-07:00")
+}
+
+// parseTimestamp reads a stored timestamp. Timestamps in the old local
+// YYYYMMDDhhmmss form are accepted too and read in legacyZone.
+func parseTimestamp(timestamp string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, timestamp); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(fmtDateTime, timestamp, legacyZone)
+}
+
+// normalizeTimestamp converts an old local YYYYMMDDhhmmss timestamp, read in
+// legacyZone, to the stored form. Other values are returned unchanged.
+func normalizeTimestamp(timestamp string) string {
+	if strings.Contains(timestamp, "T") {
+		return timestamp
+	}
+	t, err := time.ParseInLocation(fmtDateTime, timestamp, legacyZone)
+	if err != nil {
+		return timestamp
+	}
+	return formatTimestamp(t)
+}
+
+// timestampKey is the file name a reading is stored under: the timestamp in
+// the basic ISO 8601 form, which sorts like the timestamp and holds no
+// characters file systems reject. Old timestamps are returned unchanged,
+// matching the files written before version 2.
+func timestampKey(timestamp string) string {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp
+	}
+	return t.UTC().Format(fmtTimestampKey)
+}
+
+// legacyTimestamp returns the local YYYYMMDDhhmmss form a timestamp had
+// before version 2, to find records that have not been upgraded yet.
+func legacyTimestamp(timestamp string) string {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp
+	}
+	return t.In(legacyZone).Format(fmtDateTime)
+}
+
+// timestampCandidates lists the forms a reading with the given timestamp may
+// be stored under, the given form first.
+func timestampCandidates(timestamp string) []string {
+	candidates := []string{timestamp}
+	for _, c := range []string{normalizeTimestamp(timestamp), legacyTimestamp(normalizeTimestamp(timestamp))} {
+		known := false
+		for _, have := range candidates {
+			known = known || have == c
+		}
+		if !known {
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates
+}
+
+// chartTime converts a stored timestamp to the local date and time shown on
+// charts.
+func chartTime(timestamp string) string {
+	t, err := parseTimestamp(timestamp)
+	if err != nil {
+		return timestamp
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// normalizeAttachment converts old attach and detach times.
+func normalizeAttachment(a attachment) attachment {
+	a.Attached = normalizeTimestamp(a.Attached)
+	a.Detached = normalizeTimestamp(a.Detached)
+	return a
+}
+
+// normalizeNote converts old note times.
+func normalizeNote(n note) note {
+	n.Timestamp = normalizeTimestamp(n.Timestamp)
+	n.Created = normalizeTimestamp(n.Created)
+	return n
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/fs"
 	"io/ioutil"
 	"log"
 	"math/rand"
@@ -14,6 +14,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	promptui "github.com/manifoldco/promptui"
@@ -127,6 +128,11 @@ func populateFS() bool {
 		fmt.Printf("Error:%v\n", err)
 		return true
 	}
+	err = os.MkdirAll(assetsDir, os.ModePerm)
+	if err != nil {
+		fmt.Printf("Error:%v\n", err)
+		return true
+	}
 	cfgF, err := os.Create(configFile)
 	if err != nil {
 		fmt.Printf("Error:%v\n", err)
@@ -151,12 +157,6 @@ func populateFS() bool {
 		fmt.Printf("Error:%v\n", err)
 		return true
 	}
-	profF, err := os.Create(batteryProfiles)
-	if err != nil {
-		fmt.Printf("Error:%v\n", err)
-		return true
-	}
-	defer profF.Close()
 	var demoProfile batteryProfile
 	demoProfile.AssociatedDeviceName = "Demo Device"
 	demoProfile.AssociateDevSnPrefix = "1234."
@@ -166,14 +166,9 @@ func populateFS() bool {
 	demoProfile.WarnCycles = 178
 	demoProfile.ImageFileBattery = "demobat.png"
 	demoProfile.ImageFileDevice = "demodev.png"
-	byteWriter, err := json.Marshal(demoProfile)
-	if err != nil {
-		fmt.Printf("Error:%v", err)
-		return true
-	}
-	fsErr := ioutil.WriteFile(batteryProfiles, byteWriter, fs.ModeAppend)
-	if fsErr != nil {
-		fmt.Printf("Error:%v", err)
+	// The loader expects a list of profiles.
+	if err := saveBatteryProfiles([]batteryProfile{demoProfile}); err != nil {
+		fmt.Printf("Error:%v\n", err)
 		return true
 	}
 	return false
@@ -185,8 +180,7 @@ func writeCfgFile(config generalConfiguration) error {
 		fmt.Printf("Error:%v", err)
 		return err
 	}
-	fsErr := ioutil.WriteFile(configFile, byteWriter, fs.ModePerm)
-	return fsErr
+	return atomicWriteFile(configFile, byteWriter, 0644)
 }
 
 func removeEmptyStrings(s []string) []string {
@@ -199,9 +193,105 @@ func removeEmptyStrings(s []string) []string {
 	return r
 }
 
-func readBatteryProfile(batSerial string) batteryProfile {
-	profFile, err := os.Open(batteryProfiles)
+// loadBatteryProfiles returns the profiles in use, leaving out removed ones.
+func loadBatteryProfiles() ([]batteryProfile, error) {
+	records, err := loadProfileRecords()
 	if err != nil {
+		return nil, err
+	}
+	profiles := []batteryProfile{}
+	for _, p := range records {
+		if !p.Removed {
+			profiles = append(profiles, p)
+		}
+	}
+	return profiles, nil
+}
+
+// loadProfileRecords returns every profile in the file, removed ones
+// included, as sync and import exchange them. Unknown keys, such as a
+// misspelled limit that would otherwise be ignored, are warned about.
+func loadProfileRecords() ([]batteryProfile, error) {
+	byteValue, err := ioutil.ReadFile(batteryProfiles)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := parseBatteryProfiles(byteValue)
+	if err != nil {
+		return nil, err
+	}
+	warnProfileKeys(byteValue)
+	return profiles, nil
+}
+
+// warnedProfiles is the profile file content last warned about, so a file
+// read for every reading is warned about once.
+var (
+	warnedProfiles   string
+	warnedProfilesMu sync.Mutex
+)
+
+// warnProfileKeys prints the unknown keys of a profile file with their
+// line and column.
+func warnProfileKeys(data []byte) {
+	warnedProfilesMu.Lock()
+	defer warnedProfilesMu.Unlock()
+	if string(data) == warnedProfiles {
+		return
+	}
+	warnedProfiles = string(data)
+	_, problems := profileKeyProblems(data)
+	for _, p := range problems {
+		fmt.Printf("Warning! \"%s\" %s, see rrcreader profile validate\n", batteryProfiles, p)
+	}
+}
+
+// saveBatteryProfiles replaces the profiles in use. Profiles added or
+// changed get a new update time, and profiles no longer in the list are
+// kept as removed, so the change wins when syncing.
+func saveBatteryProfiles(profiles []batteryProfile) error {
+	previous, err := loadProfileRecords()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	known := make(map[string]batteryProfile)
+	for _, p := range previous {
+		known[profileKey(p)] = p
+	}
+	records := []batteryProfile{}
+	kept := make(map[string]bool)
+	for _, p := range profiles {
+		if have, ok := known[profileKey(p)]; ok && sameProfile(have, p) {
+			p.Updated = have.Updated
+		} else {
+			p.Updated = updatedNow()
+		}
+		kept[profileKey(p)] = true
+		records = append(records, p)
+	}
+	for _, p := range previous {
+		if kept[profileKey(p)] {
+			continue
+		}
+		if !p.Removed {
+			p = batteryProfile{AssociatedDeviceName: p.AssociatedDeviceName, AssociateDevSnPrefix: p.AssociateDevSnPrefix, Removed: true, Updated: updatedNow()}
+		}
+		records = append(records, p)
+	}
+	return saveProfileRecords(records)
+}
+
+// saveProfileRecords writes the profile file as it is.
+func saveProfileRecords(records []batteryProfile) error {
+	byteWriter, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return err
+	}
+	return atomicWriteFile(batteryProfiles, byteWriter, 0644)
+}
+
+func readBatteryProfile(dataset rrcBatteryData) batteryProfile {
+	if _, err := os.Stat(batteryProfiles); err != nil {
 		log.Fatalf("Failed to open \"%s\":%v\n", batteryProfiles, err)
 	}
 
@@ -216,25 +306,20 @@ func readBatteryProfile(batSerial string) batteryProfile {
 		ImageFileBattery:     "",
 	}
 
-	defer profFile.Close()
-	byteValue, fsErr := ioutil.ReadAll(profFile)
-	if fsErr != nil {
-		fmt.Printf("Error:%v\n", err)
-		return emptyProfile
-	}
-	var profiles []batteryProfile
-	err = json.Unmarshal(byteValue, &profiles)
+	profiles, err := loadBatteryProfiles()
 	if err != nil {
 		fmt.Printf("Error:%v\n", err)
 		return emptyProfile
 	}
-	for i := range profiles {
-		if strings.HasPrefix(batSerial, profiles[i].AssociateDevSnPrefix) {
-			fmt.Printf("Device profile matched! Sn:%s belongs to %s\n", batSerial, profiles[i].AssociatedDeviceName)
-			return profiles[i]
-		}
+	if profile, ok := matchProfile(profiles, dataset); ok {
+		fmt.Printf("Device profile matched! Sn:%s belongs to %s\n", dataset.DevSerialNumber, profile.AssociatedDeviceName)
+		return profile
+	}
+	fmt.Printf("No profile found for %s in device %s (see rrcreader profile match)\n", dataset.Name, dataset.DevSerialNumber)
+	if profile, ok := chemistryProfile(dataset); ok {
+		fmt.Printf("Using %s\n", profile.AssociatedDeviceName)
+		return profile
 	}
-	fmt.Printf("No profile found for prefix: %s", batSerial)
 	return emptyProfile
 }
 
@@ -293,10 +378,33 @@ func platformSpecifics() (string, string) {
 	}
 }
 
+func askYesNo(question string) bool {
+	replaceInputStr, _ := platformSpecifics()
+	fmt.Printf("%s [y/N]:> ", question)
+	reader := bufio.NewReader(os.Stdin)
+	text, _ := reader.ReadString('\n')
+	text = strings.Replace(text, replaceInputStr, "", -1)
+	return strings.EqualFold(text, "y") || strings.EqualFold(text, "yes")
+}
+
+// promptDuplicate asks what to do with a reading that duplicates an earlier
+// one.
+func promptDuplicate(earlier, reading rrcBatteryData) string {
+	prompt := promptui.Select{
+		Label: fmt.Sprintf("Same readout as %s (%d cycles, %d mAh full)? Now %d mAh full", chartTime(earlier.Timestamp), earlier.CycleCount, earlier.FullCapacity, reading.FullCapacity),
+		Items: []string{duplicateReplace, duplicateKeep, duplicateSkip},
+	}
+	_, result, err := prompt.Run()
+	if err != nil {
+		log.Fatalf("Prompt failed %v\n", err)
+	}
+	return result
+}
+
 func promptMainMenu(menulabel string) string {
 	prompt := promptui.Select{
 		Label: menulabel,
-		Items: []string{"Read battery", "Serial config", "Read-only", "Demo-mode", "Cancel"},
+		Items: []string{"Read battery", "Monitor battery", "Serial config", "Read-only", "Demo-mode", "Cancel"},
 	}
 	_, result, err := prompt.Run()
 	if err != nil {